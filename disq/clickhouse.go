@@ -2,36 +2,65 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
 )
 
-var ch _clickhouse
-
 type (
-	_clickhouse struct{ db driver.Conn }
+	_clickhouse struct {
+		db   driver.Conn
+		user string // see ForUser
+	}
 
+	// one row per user and album; rows are denormalised, so albums owned by
+	// several users are stored once per user
 	ChRow struct {
+		User       string    `ch:"user"`
 		AlbumId    uint32    `ch:"album_id"`
-		ArtistId   uint32    `ch:"artist_id"`
-		ArtistName string    `ch:"artist_name"`
+		ArtistIds  []uint32  `ch:"artist_ids"`
+		Artists    []string  `ch:"artists"`
+		ArtistName string    `ch:"artist_name"` // Artists, " "-delimited
 		Title      string    `ch:"title"`
 		DateAdded  time.Time `ch:"date_added"`
 		Year       uint32    `ch:"year"`
 		Rating     byte      `ch:"rating"`
+		MasterId   uint32    `ch:"master_id"`
+		Genres     []string  `ch:"genres"`
+		Styles     []string  `ch:"styles"`
+		Labels     []string  `ch:"labels"`
 	}
 )
 
-func init_clickhouse() { // {{{
+// openClickhouse connects to a running server, and applies any pending
+// migrations.
+func openClickhouse(addr string) (*_clickhouse, error) {
+	ch, err := connectClickhouse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ch.migrate(context.Background()); err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("clickhouse %s: %w", addr, err)
+	}
+	return ch, nil
+}
+
+// connectClickhouse connects to a running server (e.g. localhost:9000),
+// without migrating it.
+func connectClickhouse(addr string) (*_clickhouse, error) { // {{{
 	// https://clickhouse.com/docs/en/integrations/go#copy-in-some-sample-code
 
 	var (
 		ctx       = context.Background()
 		conn, err = clickhouse.Open(&clickhouse.Options{
-			// Addr: []string{"localhost:9440"},
+			Addr: []string{addr},
 			Auth: clickhouse.Auth{
 				Database: "default",
 				Username: "default",
@@ -55,70 +84,119 @@ func init_clickhouse() { // {{{
 	)
 
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("clickhouse %s: %w", addr, err)
 	}
 
+	// an exception (e.g. bad credentials) includes its code and message
 	if err := conn.Ping(ctx); err != nil {
-		if exception, ok := err.(*clickhouse.Exception); ok {
-			fmt.Printf(
-				"Exception [%d] %s \n%s\n",
-				exception.Code,
-				exception.Message,
-				exception.StackTrace,
-			)
-		}
-		panic(err)
-	}
-
-	ch.db = conn
-
-	// Select columns which align with your common filters. If a column is
-	// used frequently in WHERE clauses, prioritize including these in your
-	// key over those which are used less frequently. Prefer columns which
-	// help exclude a large percentage of the total rows when filtered,
-	// thus reducing the amount of data which needs to be read.
-	//
-	// Prefer columns which are likely to be highly correlated with other
-	// columns in the table. This will help ensure these values are also
-	// stored contiguously, improving compression. GROUP BY and ORDER BY
-	// operations for columns in the ordering key can be made more memory
-	// efficient.
-	//
-	// https://clickhouse.com/docs/en/data-modeling/schema-design#choosing-an-ordering-key
-
-	// clickhouse does not support foreign keys at all. it also discourages
-	// normalised tables and joins
-	//
-	// https://clickhouse.com/docs/en/migrations/bigquery#primary-and-foreign-keys-and-primary-index
-
-	// _ = ch.db.Exec(ctx, "DROP TABLE IF EXISTS albums")
-
-	schema := `
-CREATE TABLE IF NOT EXISTS albums (
-    album_id UInt32 NOT NULL,
-    artist_id UInt32 NOT NULL,
-    artist_name String NOT NULL,
-    title String NOT NULL,
-    date_added DateTime NOT NULL,
-    year UInt32,
-    rating UInt8, -- 0 to 5
-)
+		conn.Close()
+		return nil, fmt.Errorf("clickhouse %s: %w", addr, chErr(err))
+	}
+
+	return &_clickhouse{db: conn}, nil
+} // }}}
 
--- https://clickhouse.com/docs/en/guides/developer/deduplication#using-replacingmergetree-for-upserts
-ENGINE = ReplacingMergeTree
+// chErr marks network errors (e.g. the server is down) as errUnavailable
+func chErr(err error) error {
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return fmt.Errorf("%w: %w", errUnavailable, err)
+	}
+	return err
+}
 
-PRIMARY KEY (artist_name, rating, album_id)
--- PRIMARY KEY (album_id, rating)
--- PRIMARY KEY (album_id)
-`
-	// TODO: investigate query speed with different primary key(s)
+// appliedMigrations returns the versions of the migrations that were applied
+func (ch *_clickhouse) appliedMigrations(ctx context.Context) (map[int]time.Time, error) {
+	err := ch.db.Exec(
+		ctx,
+		`CREATE TABLE IF NOT EXISTS schema_version (
+			version UInt32 NOT NULL,
+			name String NOT NULL,
+			applied_at DateTime NOT NULL
+		)
+		ENGINE = MergeTree
+		ORDER BY version`,
+	)
+	if err != nil {
+		return nil, chErr(err)
+	}
+	var rows []struct {
+		Version   uint32    `ch:"version"`
+		AppliedAt time.Time `ch:"applied_at"`
+	}
+	if err := ch.db.Select(ctx, &rows, "SELECT version, applied_at FROM schema_version"); err != nil {
+		return nil, chErr(err)
+	}
 
-	if err := ch.db.Exec(ctx, schema); err != nil {
-		panic(err)
+	var exists uint8
+	if err := ch.db.QueryRow(ctx, "EXISTS TABLE albums").Scan(&exists); err != nil {
+		return nil, chErr(err)
 	}
-} // }}}
+	if len(rows) == 0 && exists == 1 {
+		// created before migrations existed
+		t := now()
+		if err := ch.recordMigration(ctx, clickhouseMigrations[0], t); err != nil {
+			return nil, err
+		}
+		return map[int]time.Time{1: t}, nil
+	}
+
+	applied := map[int]time.Time{}
+	for _, r := range rows {
+		applied[int(r.Version)] = r.AppliedAt
+	}
+	return applied, nil
+}
+
+func (ch *_clickhouse) recordMigration(ctx context.Context, m migration, t time.Time) error {
+	return chErr(ch.db.Exec(
+		ctx,
+		"INSERT INTO schema_version VALUES (?, ?, ?)",
+		uint32(m.Version),
+		m.Name,
+		t,
+	))
+}
+
+func (ch *_clickhouse) migrationStatus(ctx context.Context) ([]migrationStatus, error) {
+	applied, err := ch.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return migrationStatuses(clickhouseMigrations, applied), nil
+}
+
+// migrate applies migrations one statement at a time. DDL is not
+// transactional, so a migration that fails halfway must be finished (or
+// undone) by hand.
+func (ch *_clickhouse) migrate(ctx context.Context) ([]migration, error) {
+	applied, err := ch.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkVersions(clickhouseMigrations, applied); err != nil {
+		return nil, err
+	}
+
+	var done []migration
+	for _, m := range clickhouseMigrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		for _, stmt := range m.statements() {
+			if err := ch.db.Exec(ctx, stmt); err != nil {
+				return done, fmt.Errorf("migration %s: %w", m, chErr(err))
+			}
+		}
+		if err := ch.recordMigration(ctx, m, now()); err != nil {
+			return done, err
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
 
-func ch_test() { // {{{
+func ch_test(ch *_clickhouse) error { // {{{
 	// https://clickhouse.com/docs/en/integrations/go#using-structs
 	// all tags must be specified, apparently? column name -> struct field
 	// inference doesn't seem to work
@@ -134,37 +212,459 @@ func ch_test() { // {{{
 		&people,
 		"SELECT * FROM person FINAL",
 	); err != nil {
-		panic(err)
+		return err
 	}
 	fmt.Println(people)
+	return nil
 } // }}}
 
-func (ch *_clickhouse) InsertAlbum(batch driver.Batch, rel Release) {
-	// this API is way nicer than NamedExec, damn
-	if err := batch.AppendStruct(&ChRow{
+func (ch *_clickhouse) ForUser(ctx context.Context, user string) (Store, error) {
+	if user == "" {
+		var rows []struct {
+			User string `ch:"user"`
+		}
+		if err := ch.db.Select(ctx, &rows, "SELECT DISTINCT user FROM albums"); err != nil {
+			return nil, chErr(err)
+		}
+		var users []string
+		for _, r := range rows {
+			users = append(users, r.User)
+		}
+		var err error
+		if user, err = onlyUser(users); err != nil {
+			return nil, err
+		}
+	}
+	return &_clickhouse{db: ch.db, user: user}, nil
+}
+
+func (ch *_clickhouse) InsertAlbum(batch driver.Batch, rel Release) error {
+	added, err := time.Parse(time.RFC3339, rel.DateAdded)
+	if err != nil {
+		return fmt.Errorf("release %d: %w", rel.BasicInfo.Id, err)
+	}
+	row := ChRow{
+		User:       ch.user,
 		AlbumId:    uint32(rel.BasicInfo.Id),
-		ArtistId:   uint32(rel.BasicInfo.Artists[0].Id),
-		ArtistName: rel.BasicInfo.Artists[0].Name,
+		ArtistName: rel.artistNames(),
 		Title:      rel.BasicInfo.Title,
-		DateAdded:  Must(time.Parse(time.RFC3339, rel.DateAdded)),
+		DateAdded:  added,
 		Year:       uint32(rel.BasicInfo.Year),
-		Rating:     rel.Rating,
-	}); err != nil {
-		panic(err)
+		Rating:     byte(rel.Rating),
+		MasterId:   uint32(rel.BasicInfo.MasterId),
+		// arrays must not be nil
+		ArtistIds: []uint32{},
+		Artists:   []string{},
+		Genres:    append([]string{}, rel.BasicInfo.Genres...),
+		Styles:    append([]string{}, rel.BasicInfo.Styles...),
+		Labels:    []string{},
+	}
+	for _, a := range rel.BasicInfo.Artists {
+		row.ArtistIds = append(row.ArtistIds, uint32(a.Id))
+		row.Artists = append(row.Artists, a.Name)
+	}
+	for _, l := range rel.BasicInfo.Labels {
+		// a label may be listed once per catno
+		if !slices.Contains(row.Labels, l.Name) {
+			row.Labels = append(row.Labels, l.Name)
+		}
+	}
+	// this API is way nicer than NamedExec, damn
+	return batch.AppendStruct(&row)
+}
+
+// InsertBatch sends all rows as one insert, which clickhouse applies
+// atomically; an insert that fails (or is cancelled) is not applied at all.
+func (ch *_clickhouse) InsertBatch(ctx context.Context, rels []Release) ([]change, error) {
+	var ids []uint32
+	for _, rel := range rels {
+		ids = append(ids, uint32(rel.BasicInfo.Id))
+	}
+	// ReplacingMergeTree only deduplicates when parts are merged, which
+	// happens at some unknown time; FINAL deduplicates when reading
+	rows, err := ch.selectRows(
+		ctx,
+		"SELECT * FROM albums FINAL WHERE user = ? AND album_id IN ?",
+		ch.user,
+		ids,
+	)
+	if err != nil {
+		return nil, err
 	}
+	prev := map[uint32]ChRow{}
+	for _, row := range rows {
+		prev[row.AlbumId] = row
+	}
+
+	batch, err := ch.db.PrepareBatch(ctx, "INSERT INTO albums")
+	if err != nil {
+		return nil, chErr(err)
+	}
+	defer batch.Abort() // no-op once sent
+
+	var changes []change
+	for _, rel := range rels {
+		if err := ch.InsertAlbum(batch, rel); err != nil {
+			return nil, err
+		}
+		old, ok := prev[uint32(rel.BasicInfo.Id)]
+		switch {
+		case !ok:
+			changes = append(changes, albumAdded)
+		case old.Title == rel.BasicInfo.Title &&
+			old.Year == uint32(rel.BasicInfo.Year) &&
+			old.Rating == byte(rel.Rating):
+			changes = append(changes, albumUnchanged)
+		default:
+			changes = append(changes, albumChanged)
+		}
+	}
+
+	if err := batch.Send(); err != nil {
+		return nil, chErr(err)
+	}
+	return changes, nil
 }
 
-// RandomAlbum selects n random albums without performing any filtering.
-func (ch *_clickhouse) RandomAlbum(n int) []ChRow {
+// prune removes the albums of the user that are not in keep. Deletes are
+// lightweight, i.e. rows are hidden at once, and removed when parts are
+// merged.
+func (ch *_clickhouse) prune(ctx context.Context, keep []int) (int, error) {
+	where, args := " WHERE user = ?", []any{ch.user}
+	if len(keep) > 0 {
+		ids := make([]uint32, len(keep))
+		for i, id := range keep {
+			ids[i] = uint32(id)
+		}
+		where += " AND album_id NOT IN ?"
+		args = append(args, ids)
+	}
+	var n uint64
+	if err := ch.db.QueryRow(ctx, "SELECT count() FROM albums FINAL"+where, args...).Scan(&n); err != nil {
+		return 0, chErr(err)
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	if err := ch.db.Exec(ctx, "DELETE FROM albums"+where, args...); err != nil {
+		return 0, chErr(err)
+	}
+	return int(n), nil
+}
+
+func (ch *_clickhouse) selectRows(ctx context.Context, query string, args ...any) ([]ChRow, error) {
 	var rows []ChRow
+	if err := ch.db.Select(ctx, &rows, query, args...); err != nil {
+		return nil, chErr(err)
+	}
+	return rows, nil
+}
+
+func (ch *_clickhouse) selectAlbums(ctx context.Context, query string, args ...any) ([]Album, error) {
+	rows, err := ch.selectRows(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	var albums []Album
+	for _, row := range rows {
+		albums = append(albums, Album{
+			Id:     int(row.AlbumId),
+			Title:  row.Title,
+			Artist: row.ArtistName,
+			Year:   int(row.Year),
+			Rating: int(row.Rating),
+		})
+	}
+	return albums, nil
+}
+
+// chFold is the clickhouse expression that lowercases a string, and removes
+// its diacritics (as far as unicode decomposes them), for matching
+func chFold(expr string) string {
+	return `replaceRegexpAll(normalizeUTF8NFD(lowerUTF8(` + expr + `)), '\\p{Mn}', '')`
+}
+
+// chWhere translates a filter to a WHERE clause over the albums of user, with
+// the same semantics as filter.sql where possible. Labels and notes are not
+// searched by f.Query.
+func (f Filter) chWhere(user string) (string, []any) {
+	conds := []string{"user = ?", "rating >= ?"}
+	args := []any{user, f.MinRating}
+	if f.YearMin > 0 {
+		conds = append(conds, "year >= ?")
+		args = append(args, f.YearMin)
+	}
+	if f.YearMax > 0 {
+		conds = append(conds, "year <= ?")
+		args = append(args, f.YearMax)
+	}
+	if f.GroupMasters {
+		// the highest-rated pressing of each master; albums without a
+		// master are their own group
+		conds = append(conds, `album_id IN (
+			SELECT album_id FROM albums FINAL
+			WHERE user = ?
+			ORDER BY rating DESC, album_id ASC
+			LIMIT 1 BY if(master_id > 0, toInt64(master_id), -toInt64(album_id))
+		)`)
+		args = append(args, user)
+	}
+	if f.Title != "" {
+		conds = append(conds, "positionCaseInsensitiveUTF8(title, ?) > 0")
+		args = append(args, f.Title)
+	}
+	if f.Artist != "" {
+		conds = append(conds, "arrayExists(a -> positionCaseInsensitiveUTF8(a, ?) > 0, artists)")
+		args = append(args, f.Artist)
+	}
+	// like ftsQuery: every word must be the prefix of a word of the artists
+	// or title
+	for _, w := range strings.Fields(strings.ReplaceAll(ftsQuery(f.Query), "*", "")) {
+		conds = append(conds, "arrayExists(t -> startsWith(t, ?), extractAll("+
+			chFold("concat(artist_name, ' ', title)")+`, '[\\p{L}\\p{N}]+'))`)
+		args = append(args, foldDiacritics.Replace(w))
+	}
+	for _, x := range []struct{ col, val string }{
+		{"genres", f.Genre},
+		{"styles", f.Style},
+		{"labels", f.Label},
+	} {
+		if x.val != "" {
+			conds = append(conds, "arrayExists(x -> lowerUTF8(x) = lowerUTF8(?), "+x.col+")")
+			args = append(args, x.val)
+		}
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+func (ch *_clickhouse) RandomAlbum(ctx context.Context, f Filter, n int) ([]Album, error) {
+	f.MinRating = max(f.MinRating, 3)
+	where, args := f.chWhere(ch.user)
+
+	var rows []struct {
+		AlbumId    uint32   `ch:"album_id"`
+		ArtistIds  []uint32 `ch:"artist_ids"`
+		ArtistName string   `ch:"artist_name"`
+		Title      string   `ch:"title"`
+		Year       uint32   `ch:"year"`
+		Rating     byte     `ch:"rating"`
+		LastPlayed uint32   `ch:"last_played"`
+	}
+	// like select_random.sql. without join_use_nulls, albums that were never
+	// played (or listened to) get the default value, i.e. the epoch
 	err := ch.db.Select(
-		context.Background(),
+		ctx,
+		&rows,
+		`SELECT album_id, artist_ids, artist_name, title, year, rating,
+			greatest(toUnixTimestamp(last_play), toUnixTimestamp(last_listen)) AS last_played
+		FROM albums FINAL
+		LEFT JOIN (
+			SELECT album_id, max(played_at) AS last_play FROM plays
+			WHERE user = ?
+			GROUP BY album_id
+		) AS p USING album_id
+		LEFT JOIN (
+			SELECT album_id, max(listened_at) AS last_listen FROM listens
+			WHERE user = ?
+			GROUP BY album_id
+		) AS l USING album_id`+where,
+		append([]any{ch.user, ch.user}, args...)...,
+	)
+	if err != nil {
+		return nil, chErr(err)
+	}
+	var cands []candidate
+	for _, row := range rows {
+		c := candidate{
+			Album: Album{
+				Id:     int(row.AlbumId),
+				Title:  row.Title,
+				Artist: row.ArtistName,
+				Year:   int(row.Year),
+				Rating: int(row.Rating),
+			},
+			LastPlayed: int64(row.LastPlayed),
+		}
+		for _, id := range row.ArtistIds {
+			c.ArtistIds = append(c.ArtistIds, int(id))
+		}
+		cands = append(cands, c)
+	}
+
+	var recentRows []struct {
+		ArtistIds []uint32 `ch:"artist_ids"`
+	}
+	err = ch.db.Select(
+		ctx,
+		&recentRows,
+		`SELECT artist_ids
+		FROM plays FINAL
+		INNER JOIN albums FINAL USING (user, album_id)
+		WHERE user = ?
+		ORDER BY played_at DESC
+		LIMIT ?`,
+		ch.user,
+		artistCooldown,
+	)
+	if err != nil {
+		return nil, chErr(err)
+	}
+
+	var recent []int
+	for _, row := range recentRows {
+		for _, id := range row.ArtistIds {
+			recent = append(recent, int(id))
+		}
+	}
+
+	picked := pickWeighted(cands, n, recent)
+	for _, alb := range picked {
+		if err := ch.insertPlay(ctx, alb.Id, playSuggested); err != nil {
+			return nil, err
+		}
+	}
+	return picked, nil
+}
+
+func (ch *_clickhouse) insertPlay(ctx context.Context, albumId int, kind string) error {
+	return chErr(ch.db.Exec(
+		ctx,
+		"INSERT INTO plays (user, album_id, played_at, kind) VALUES (?, ?, ?, ?)",
+		ch.user,
+		uint32(albumId),
+		now(),
+		kind,
+	))
+}
+
+// copyHistory inserts the plays and listens of h. Both tables are replacing,
+// so that copying the same history again adds nothing (once parts are
+// merged; plays are read with FINAL where duplicates matter).
+func (ch *_clickhouse) copyHistory(ctx context.Context, h history) error {
+	insert := func(query string, rows []play, values func(play) []any) error {
+		if len(rows) == 0 {
+			return nil
+		}
+		batch, err := ch.db.PrepareBatch(ctx, query)
+		if err != nil {
+			return chErr(err)
+		}
+		defer batch.Abort() // no-op once sent
+		for _, p := range rows {
+			if err := batch.Append(values(p)...); err != nil {
+				return chErr(err)
+			}
+		}
+		return chErr(batch.Send())
+	}
+	err := insert("INSERT INTO plays (user, album_id, played_at, kind)", h.Plays, func(p play) []any {
+		return []any{ch.user, uint32(p.AlbumId), time.Unix(p.PlayedAt, 0), p.Kind}
+	})
+	if err != nil {
+		return err
+	}
+	return insert("INSERT INTO listens (user, album_id, listened_at)", h.Listens, func(p play) []any {
+		return []any{ch.user, uint32(p.AlbumId), time.Unix(p.PlayedAt, 0)}
+	})
+}
+
+func (ch *_clickhouse) RecordPlay(ctx context.Context, albumId int) error {
+	return ch.insertPlay(ctx, albumId, playPlayed)
+}
+
+func (ch *_clickhouse) Albums(ctx context.Context, f Filter, p Page) ([]Album, error) {
+	where, args := f.chWhere(ch.user)
+	q := "SELECT * FROM albums FINAL" + where + " ORDER BY " + p.orderBy(map[string]string{
+		"artist": "artist_name",
+		"id":     "album_id",
+	})
+	if p.Limit > 0 {
+		q += " LIMIT ? OFFSET ?"
+		args = append(args, p.Limit, p.Offset)
+	}
+	return ch.selectAlbums(ctx, q, args...)
+}
+
+func (ch *_clickhouse) CountAlbums(ctx context.Context, f Filter) (int, error) {
+	where, args := f.chWhere(ch.user)
+	var n uint64
+	row := ch.db.QueryRow(ctx, "SELECT count() FROM albums FINAL"+where, args...)
+	if err := row.Scan(&n); err != nil {
+		return 0, chErr(err)
+	}
+	return int(n), nil
+}
+
+func (ch *_clickhouse) AlbumsByArtist(ctx context.Context, artist string) ([]Album, error) {
+	return ch.selectAlbums(
+		ctx,
+		"SELECT * FROM albums FINAL WHERE user = ? AND has(artists, ?) ORDER BY year",
+		ch.user,
+		artist,
+	)
+}
+
+// ArtistById finds the artist in the albums of any user, like the artists
+// table of sqlite
+func (ch *_clickhouse) ArtistById(ctx context.Context, id int) (*Artist, error) {
+	var names []struct {
+		Name string `ch:"name"`
+	}
+	err := ch.db.Select(
+		ctx,
+		&names,
+		"SELECT artists[indexOf(artist_ids, ?)] AS name FROM albums FINAL WHERE has(artist_ids, ?) LIMIT 1",
+		uint32(id),
+		uint32(id),
+	)
+	if err != nil {
+		return nil, chErr(err)
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("artist %d: %w", id, errNotFound)
+	}
+	return &Artist{Id: id, Name: names[0].Name}, nil
+}
+
+func (ch *_clickhouse) ArtistStats(ctx context.Context, minAlbums int) ([]ArtistStat, error) {
+	var rows []struct {
+		Artist    string  `ch:"artist"`
+		Albums    uint64  `ch:"albums"`
+		AvgRating float64 `ch:"avg_rating"`
+	}
+	err := ch.db.Select(
+		ctx,
 		&rows,
-		"SELECT * FROM albums ORDER BY rand() LIMIT ?",
-		n,
+		`SELECT any(artist) AS artist, count() AS albums, avg(rating) AS avg_rating
+		FROM albums FINAL
+		ARRAY JOIN artists AS artist, artist_ids AS artist_id
+		WHERE user = ?
+		GROUP BY artist_id
+		HAVING albums >= ?
+		ORDER BY avg_rating DESC, artist ASC`,
+		ch.user,
+		minAlbums,
 	)
 	if err != nil {
-		panic(err)
+		return nil, chErr(err)
+	}
+
+	var stats []ArtistStat
+	for _, row := range rows {
+		stats = append(stats, ArtistStat{
+			Artist:    row.Artist,
+			Albums:    int(row.Albums),
+			AvgRating: row.AvgRating,
+		})
 	}
-	return rows
+	return stats, nil
 }
+
+func (ch *_clickhouse) Search(ctx context.Context, q string) ([]Album, error) {
+	if ftsQuery(q) == "" {
+		return nil, nil
+	}
+	return ch.Albums(ctx, Filter{Query: q}, Page{Sort: sortRelevance})
+}
+
+func (ch *_clickhouse) Close() error { return ch.db.Close() }
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// A minimal server config; all paths are below the data dir
+const clickhouseConfig = `<clickhouse>
+    <logger><level>warning</level><console>true</console></logger>
+    <listen_host>127.0.0.1</listen_host>
+    <tcp_port>%[2]d</tcp_port>
+    <path>%[1]s/</path>
+    <tmp_path>%[1]s/tmp/</tmp_path>
+    <user_files_path>%[1]s/user_files/</user_files_path>
+    <users>
+        <default>
+            <password></password>
+            <networks><ip>127.0.0.1</ip></networks>
+            <profile>default</profile>
+            <quota>default</quota>
+        </default>
+    </users>
+    <profiles><default/></profiles>
+    <quotas><default/></quotas>
+</clickhouse>
+`
+
+// startClickhouse starts a throwaway clickhouse server, and opens a store on
+// it. The test is skipped if there is no clickhouse binary (which also
+// provides clickhouse-local) on PATH.
+//
+// If DISQ_TEST_CLICKHOUSE is set (e.g. in CI, to a container), the server at
+// that address is used instead. It must be throwaway too: every table of its
+// default database is dropped.
+func startClickhouse(t *testing.T) *_clickhouse {
+	if addr := os.Getenv("DISQ_TEST_CLICKHOUSE"); addr != "" {
+		return resetClickhouse(t, addr)
+	}
+	bin, err := exec.LookPath("clickhouse")
+	if err != nil {
+		local, err := exec.LookPath("clickhouse-local")
+		if err != nil {
+			t.Skip("clickhouse not found")
+		}
+		// usually a symlink to the clickhouse binary
+		if bin, err = filepath.EvalSymlinks(local); err != nil || filepath.Base(bin) != "clickhouse" {
+			t.Skip("clickhouse-local is not the clickhouse binary")
+		}
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	dir := t.TempDir()
+	config := filepath.Join(dir, "config.xml")
+	if err := os.WriteFile(config, []byte(fmt.Sprintf(clickhouseConfig, dir, port)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(bin, "server", "--config-file="+config)
+	cmd.Dir = dir
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	for start := time.Now(); ; time.Sleep(100 * time.Millisecond) {
+		conn, err := clickhouse.Open(&clickhouse.Options{Addr: []string{addr}})
+		if err == nil {
+			err = conn.Ping(context.Background())
+			conn.Close()
+		}
+		if err == nil {
+			break
+		}
+		if time.Since(start) > 30*time.Second {
+			t.Fatalf("clickhouse did not start: %v", err)
+		}
+	}
+	ch := Must(openClickhouse(addr))
+	t.Cleanup(func() { ch.Close() })
+	return ch
+}
+
+// resetClickhouse drops every table of the server at addr, and opens a store
+// on it
+func resetClickhouse(t *testing.T, addr string) *_clickhouse {
+	ctx := context.Background()
+	conn, err := clickhouse.Open(&clickhouse.Options{Addr: []string{addr}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var tables []string
+	rows, err := conn.Query(ctx, "SELECT name FROM system.tables WHERE database = 'default'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+	for _, table := range tables {
+		if err := conn.Exec(ctx, "DROP TABLE default.`"+table+"` SYNC"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ch := Must(openClickhouse(addr))
+	t.Cleanup(func() { ch.Close() })
+	return ch
+}
+
+func TestClickhouseStore(t *testing.T) {
+	ch := startClickhouse(t)
+	testStore(t, Must(ch.ForUser(context.Background(), "")))
+}
+
+func TestClickhouseParity(t *testing.T) {
+	ctx := context.Background()
+	ch := startClickhouse(t)
+	s := Must(openSqlite(":memory:"))
+	defer s.Close()
+	alice := Must(s.ForUser(ctx, "alice"))
+	Must(alice.InsertBatch(ctx, parityReleases()))
+	recordHistory(t, alice)
+	Must(Must(s.ForUser(ctx, "bob")).InsertBatch(ctx, parityReleases()[:2]))
+
+	res, err := copyCollection(ctx, s, ch, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, []copyResult{
+		{User: "alice", Copied: 6, Added: 6},
+		{User: "bob", Copied: 2, Added: 2},
+	}, res)
+	testParity(t, alice, Must(ch.ForUser(ctx, "alice")))
+	testRandomParity(t, alice, Must(ch.ForUser(ctx, "alice")))
+
+	// albums that were removed from the collection are removed from
+	// clickhouse
+	cp := alice.(checkpointer)
+	Must(cp.finishSync(ctx, syncState{User: "alice", Started: now().Unix() + 1}, true))
+	res, err = copyCollection(ctx, s, ch, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, copyResult{User: "alice", Removed: 6}, res[0])
+	assert.Equal(t, 0, Must(Must(ch.ForUser(ctx, "alice")).CountAlbums(ctx, Filter{})))
+	assert.Equal(t, 2, Must(Must(ch.ForUser(ctx, "bob")).CountAlbums(ctx, Filter{})))
+}
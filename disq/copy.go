@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+)
+
+// The sqlite db is the source of truth: it is what Discogs is synced to, and
+// what is enriched. `disq sync` copies it to another backend (i.e.
+// clickhouse) in large batches, which suits clickhouse far better than one
+// insert per page.
+
+// pruner is implemented by stores that can remove the albums of their user
+// that are not in keep, i.e. that are no longer in a collection that was
+// copied in full
+type pruner interface {
+	prune(ctx context.Context, keep []int) (int, error)
+}
+
+// historyCopier is implemented by stores that do not record listens, and so
+// need the history of sqlite to weight random picks like it does (see
+// candidate)
+type historyCopier interface {
+	// copyHistory adds the plays and listens that are not yet stored
+	copyHistory(ctx context.Context, h history) error
+}
+
+// history is what random picks are weighted and cooled down by
+type history struct {
+	Plays   []play
+	Listens []play // the last of each album
+}
+
+type play struct {
+	AlbumId  int    `db:"album_id"`
+	PlayedAt int64  `db:"played_at"` // unix seconds
+	Kind     string `db:"kind"`      // suggested or played; empty for listens
+}
+
+type copyResult struct {
+	User    string
+	Copied  int
+	Added   int
+	Changed int
+	Removed int
+}
+
+// copyCollection copies the collection of every user of src to dst, batchSize
+// releases at a time. Plays and listens are copied too, if dst needs them.
+func copyCollection(ctx context.Context, src *sqlite, dst Store, batchSize int) ([]copyResult, error) {
+	users, err := src.users(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var results []copyResult
+	for _, user := range users {
+		from := &sqlite{db: src.db, user: user}
+		to, err := dst.ForUser(ctx, user)
+		if err != nil {
+			return results, err
+		}
+
+		res := copyResult{User: user}
+		var ids []int
+		for after := math.MinInt; ; {
+			rels, err := from.releases(ctx, after, batchSize)
+			if err != nil {
+				return results, err
+			}
+			if len(rels) == 0 {
+				break
+			}
+			changes, err := to.InsertBatch(ctx, rels)
+			if err != nil {
+				return results, fmt.Errorf("%s: %w", user, err)
+			}
+			for i, c := range changes {
+				switch c {
+				case albumAdded:
+					res.Added++
+				case albumChanged:
+					res.Changed++
+				}
+				ids = append(ids, rels[i].BasicInfo.Id)
+			}
+			res.Copied += len(rels)
+			after = rels[len(rels)-1].BasicInfo.Id
+		}
+
+		if p, ok := to.(pruner); ok {
+			if res.Removed, err = p.prune(ctx, ids); err != nil {
+				return results, fmt.Errorf("%s: %w", user, err)
+			}
+		}
+		if hc, ok := to.(historyCopier); ok {
+			h, err := from.history(ctx)
+			if err != nil {
+				return results, err
+			}
+			if err := hc.copyHistory(ctx, h); err != nil {
+				return results, fmt.Errorf("%s: %w", user, err)
+			}
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// syncCmd runs `disq sync` with the given args, copying the collections of
+// src to another backend.
+func syncCmd(ctx context.Context, src *sqlite, args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("sync", flag.ContinueOnError)
+	var (
+		to        = fs.String("to", "", "backend to copy to: clickhouse")
+		batchSize = fs.Int("batch", 10000, "number of releases per insert")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *to != "clickhouse" {
+		return errors.New("usage: disq sync --to clickhouse")
+	}
+	if *batchSize < 1 {
+		return fmt.Errorf("invalid batch size: %d", *batchSize)
+	}
+
+	dst, err := openClickhouse(*clickhouseAddr)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	results, err := copyCollection(ctx, src, dst, *batchSize)
+	for _, r := range results {
+		fmt.Fprintf(
+			w,
+			"%s: copied %d releases: added %d, changed %d, removed %d\n",
+			r.User,
+			r.Copied,
+			r.Added,
+			r.Changed,
+			r.Removed,
+		)
+	}
+	return err
+}
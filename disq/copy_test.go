@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// parityReleases covers what the backends store differently: several
+// artists (not in order of id), labels with several catnos, genres and
+// styles, and master releases.
+func parityReleases() []Release {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	rel := func(id int, title string, year int, rating int, artists ...Artist) Release {
+		r := newRelease(id, t0.AddDate(0, 0, id))
+		r.BasicInfo.Title = title
+		r.BasicInfo.Year = year
+		r.BasicInfo.Artists = artists
+		r.Rating = rating
+		return r
+	}
+	mbv := Artist{Id: 10, Name: "My Bloody Valentine"}
+	rels := []Release{
+		rel(1, "Loveless", 1991, 5, mbv),
+		rel(2, "Loveless (Remastered)", 2012, 4, mbv),
+		rel(3, "Isn't Anything", 1988, 4, mbv),
+		rel(4, "Spirit Of Talk Talk", 2012, 3,
+			Artist{Id: 30, Name: "Various"},
+			Artist{Id: 20, Name: "Talk Talk"},
+		),
+		rel(5, "Köln Concert", 1975, 5, Artist{Id: 40, Name: "Keith Jarrett"}),
+		rel(6, "Laughing Stock", 1991, 5, Artist{Id: 20, Name: "Talk Talk"}),
+	}
+	rels[0].BasicInfo.MasterId = 100
+	rels[1].BasicInfo.MasterId = 100
+	rels[0].BasicInfo.Labels = []Label{
+		{Id: 7, Name: "Creation Records", Catno: "CRE LP 060"},
+		{Id: 7, Name: "Creation Records", Catno: "CRE CD 060"},
+	}
+	rels[0].BasicInfo.Genres = []string{"Rock"}
+	rels[0].BasicInfo.Styles = []string{"Shoegaze", "Noise"}
+	rels[4].BasicInfo.Genres = []string{"Jazz"}
+	rels[4].BasicInfo.Labels = []Label{{Id: 8, Name: "ECM Records", Catno: "ECM 1064/65"}}
+	return rels
+}
+
+// parityQueries are run against both backends, which must agree
+var parityQueries = []struct {
+	filter Filter
+	page   Page
+}{
+	{Filter{}, Page{}},
+	{Filter{}, Page{Sort: "year", Desc: true}},
+	{Filter{}, Page{Sort: "rating", Offset: 2, Limit: 3}},
+	{Filter{Artist: "talk"}, Page{}},
+	{Filter{Artist: "Various Talk"}, Page{}}, // artists are matched one by one
+	{Filter{Title: "LESS"}, Page{}},
+	{Filter{Query: "koln"}, Page{}},
+	{Filter{Query: "valent lov"}, Page{}},
+	{Filter{Query: "alentine"}, Page{}},
+	{Filter{YearMin: 1990, YearMax: 2000, MinRating: 5}, Page{}},
+	{Filter{GroupMasters: true}, Page{Sort: "title"}},
+	{Filter{Genre: "rock"}, Page{}},
+	{Filter{Style: "noise", Label: "creation records"}, Page{}},
+	{Filter{Label: "ECM"}, Page{}},
+}
+
+// testParity checks that two stores holding the same collection answer the
+// same queries alike
+func testParity(t *testing.T, a Store, b Store) {
+	ctx := context.Background()
+	for _, q := range parityQueries {
+		assert.Equal(t, Must(a.Albums(ctx, q.filter, q.page)), Must(b.Albums(ctx, q.filter, q.page)), q)
+		assert.Equal(t, Must(a.CountAlbums(ctx, q.filter)), Must(b.CountAlbums(ctx, q.filter)), q)
+	}
+	for _, artist := range []string{"Talk Talk", "My Bloody Valentine", "Talk"} {
+		assert.Equal(t, Must(a.AlbumsByArtist(ctx, artist)), Must(b.AlbumsByArtist(ctx, artist)), artist)
+	}
+	for _, q := range []string{"talk", "", "!"} {
+		assert.Equal(t, Must(a.Search(ctx, q)), Must(b.Search(ctx, q)), q)
+	}
+	assert.Equal(t, Must(a.ArtistStats(ctx, 1)), Must(b.ArtistStats(ctx, 1)))
+	assert.Equal(t, Must(a.ArtistById(ctx, 20)), Must(b.ArtistById(ctx, 20)))
+}
+
+// historyT0 is when random picks are made after recordHistory
+var historyT0 = time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+// recordHistory plays and listens to the parityReleases of s, such that the
+// picks of testRandomParity depend on all of it
+func recordHistory(t *testing.T, s Store) {
+	ctx := context.Background()
+	defer func(f func() time.Time) { now = f }(now)
+	for _, p := range []struct{ id, daysAgo int }{{1, 2}, {3, 3}} {
+		now = func() time.Time { return historyT0.AddDate(0, 0, -p.daysAgo) }
+		assert.NoError(t, s.RecordPlay(ctx, p.id))
+	}
+	_, err := importListens(
+		ctx,
+		s,
+		strings.NewReader(fmt.Sprintf(
+			`[{"listened_at": %d, "track_metadata": {"artist_name": "Talk Talk", "track_name": "Myrrhman", "release_name": "Laughing Stock"}}]`,
+			historyT0.AddDate(0, 0, -1).Unix(),
+		)),
+		sourceListenBrainz,
+	)
+	assert.NoError(t, err)
+}
+
+// historyPicks are the random picks after recordHistory: My Bloody Valentine
+// was just played, and Laughing Stock (as rated) would be picked first, had it
+// not been listened to
+var historyPicks = []string{"Köln Concert", "Spirit Of Talk Talk"}
+
+// randomPicks picks albums of s by weight alone, at historyT0
+func randomPicks(s Store) []string {
+	defer func(f func() time.Time) { now = f }(now)
+	now = func() time.Time { return historyT0 }
+	defer func(f func() float64) { randFloat = f }(randFloat)
+	randFloat = func() float64 { return 0.5 }
+	return titles(Must(s.RandomAlbum(context.Background(), Filter{}, 10)))
+}
+
+// testRandomParity checks that two stores holding the same collection and
+// history (see recordHistory) weight random picks the same
+func testRandomParity(t *testing.T, a Store, b Store) {
+	assert.Equal(t, historyPicks, randomPicks(a))
+	assert.Equal(t, historyPicks, randomPicks(b))
+}
+
+// historyStore records the history that is copied to it
+type historyStore struct {
+	Store
+	user   string
+	copied map[string]history
+}
+
+func (h historyStore) ForUser(ctx context.Context, user string) (Store, error) {
+	s, err := h.Store.ForUser(ctx, user)
+	return historyStore{s, user, h.copied}, err
+}
+
+func (h historyStore) copyHistory(_ context.Context, hist history) error {
+	h.copied[h.user] = hist
+	return nil
+}
+
+func TestCopyHistory(t *testing.T) {
+	ctx := context.Background()
+	src := Must(openSqlite(":memory:"))
+	defer src.Close()
+	alice := Must(src.ForUser(ctx, "alice"))
+	Must(alice.InsertBatch(ctx, parityReleases()))
+	recordHistory(t, alice)
+
+	dst := Must(openSqlite(":memory:"))
+	defer dst.Close()
+	copied := map[string]history{}
+	_, err := copyCollection(ctx, src, historyStore{dst, "", copied}, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]history{"alice": {
+		Plays: []play{
+			{AlbumId: 1, PlayedAt: historyT0.AddDate(0, 0, -2).Unix(), Kind: playPlayed},
+			{AlbumId: 3, PlayedAt: historyT0.AddDate(0, 0, -3).Unix(), Kind: playPlayed},
+		},
+		Listens: []play{{AlbumId: 6, PlayedAt: historyT0.AddDate(0, 0, -1).Unix()}},
+	}}, copied)
+
+	assert.Equal(t, historyPicks, randomPicks(alice))
+}
+
+func TestSqliteReleases(t *testing.T) {
+	ctx := context.Background()
+	s := Must(openSqlite(":memory:"))
+	defer s.Close()
+	rels := parityReleases()
+	Must(s.InsertBatch(ctx, rels))
+
+	var got []Release
+	for after := 0; ; {
+		batch := Must(s.releases(ctx, after, 4))
+		if len(batch) == 0 {
+			break
+		}
+		got = append(got, batch...)
+		after = batch[len(batch)-1].BasicInfo.Id
+	}
+	assert.Equal(t, rels, got)
+}
+
+func TestCopyCollection(t *testing.T) {
+	ctx := context.Background()
+	src := Must(openSqlite(":memory:"))
+	defer src.Close()
+	Must(Must(src.ForUser(ctx, "alice")).InsertBatch(ctx, parityReleases()))
+	Must(Must(src.ForUser(ctx, "bob")).InsertBatch(ctx, parityReleases()[:2]))
+
+	dst := Must(openSqlite(":memory:"))
+	defer dst.Close()
+	res, err := copyCollection(ctx, src, dst, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, []copyResult{
+		{User: "alice", Copied: 6, Added: 6},
+		{User: "bob", Copied: 2, Added: 2},
+	}, res)
+
+	testParity(t, Must(src.ForUser(ctx, "alice")), Must(dst.ForUser(ctx, "alice")))
+
+	// copying again changes nothing
+	res, err = copyCollection(ctx, src, dst, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, copyResult{User: "alice", Copied: 6}, res[0])
+}
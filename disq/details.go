@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The collection endpoint only returns basic information. Everything else
+// (tracklist, credits, notes, images) requires one request per release, which
+// is done by a separate, resumable job.
+
+// releaseResp is the (relevant part of the) response of the release endpoint
+//
+// https://www.discogs.com/developers#page:database,header:database-release
+type releaseResp struct {
+	Id           int
+	Notes        string
+	Tracklist    []trackResp
+	ExtraArtists []creditResp `json:"extraartists"`
+	Images       []struct {
+		Type string // primary or secondary
+		Uri  string
+	}
+}
+
+type trackResp struct {
+	Position     string
+	Type         string `json:"type_"` // track, heading or index
+	Title        string
+	Duration     string       // 4:32, or empty
+	SubTracks    []trackResp  `json:"sub_tracks"`
+	ExtraArtists []creditResp `json:"extraartists"`
+}
+
+type creditResp struct {
+	Id     int
+	Name   string
+	Role   string
+	Tracks string
+}
+
+type (
+	// AlbumDetails is what is stored of a releaseResp
+	AlbumDetails struct {
+		Notes   string
+		Cover   string // file name in the cover cache; empty if none
+		Tracks  []Track
+		Credits []Credit
+	}
+
+	Track struct {
+		Number   string
+		Title    string
+		Duration int // seconds; 0 if unknown
+	}
+
+	Credit struct {
+		ArtistId int `db:"artist_id"`
+		Name     string
+		Role     string
+		Tracks   string // empty for the whole release
+	}
+)
+
+// enricher is implemented by stores that can store release details
+type enricher interface {
+	// unenriched lists the ids of albums whose details have not been
+	// fetched yet
+	unenriched(ctx context.Context) ([]int, error)
+	insertDetails(ctx context.Context, id int, d AlbumDetails) error
+	// insertFailure records that the album's details cannot be fetched, so
+	// that it is no longer unenriched
+	insertFailure(ctx context.Context, id int, reason error) error
+	// details returns nil if the details have not been fetched yet
+	details(ctx context.Context, id int) (*AlbumDetails, error)
+}
+
+// parseDuration parses a duration of the form [h:]m:s into seconds. Malformed
+// durations, which are not uncommon, are ignored.
+func parseDuration(s string) int {
+	if s == "" {
+		return 0
+	}
+	secs := 0
+	for _, part := range strings.Split(s, ":") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return 0
+		}
+		secs = secs*60 + n
+	}
+	return secs
+}
+
+// details converts the response. Headings are dropped, and the sub tracks of
+// an index track (e.g. the movements of a work) are flattened.
+func (r releaseResp) details(cover string) AlbumDetails {
+	d := AlbumDetails{Notes: strings.TrimSpace(r.Notes), Cover: cover}
+	for _, c := range r.ExtraArtists {
+		d.Credits = append(d.Credits, Credit{ArtistId: c.Id, Name: c.Name, Role: c.Role, Tracks: c.Tracks})
+	}
+
+	var addTracks func([]trackResp)
+	addTracks = func(tracks []trackResp) {
+		for _, t := range tracks {
+			switch t.Type {
+			case "heading":
+				continue
+			case "index":
+				addTracks(t.SubTracks)
+				continue
+			}
+			d.Tracks = append(d.Tracks, Track{
+				Number:   t.Position,
+				Title:    t.Title,
+				Duration: parseDuration(t.Duration),
+			})
+			for _, c := range t.ExtraArtists {
+				d.Credits = append(d.Credits, Credit{ArtistId: c.Id, Name: c.Name, Role: c.Role, Tracks: t.Position})
+			}
+		}
+	}
+	addTracks(r.Tracklist)
+	return d
+}
+
+// coverCache stores images by the hash of their content, so identical covers
+// (e.g. of reissues) are only stored once, and files never need to be
+// invalidated.
+type coverCache struct{ dir string }
+
+func defaultCoverCache() (coverCache, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return coverCache{}, err
+	}
+	return coverCache{dir: filepath.Join(dir, "disq", "covers")}, nil
+}
+
+func (c coverCache) path(name string) string { return filepath.Join(c.dir, name) }
+
+// put stores an image, returning its file name
+func (c coverCache) put(b []byte, ext string) (string, error) {
+	sum := sha256.Sum256(b)
+	name := hex.EncodeToString(sum[:]) + ext
+	if _, err := os.Stat(c.path(name)); err == nil {
+		return name, nil
+	}
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		return "", err
+	}
+	// written atomically, so that an interrupted write is not mistaken for
+	// a cached file
+	f, err := os.CreateTemp(c.dir, ".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return name, os.Rename(f.Name(), c.path(name))
+}
+
+// fetchRelease fetches the details of a release, and the uri of its primary
+// image (empty if none)
+func (c *discogsClient) fetchRelease(ctx context.Context, id int) (AlbumDetails, string, error) {
+	var r releaseResp
+	err := c.retry(ctx, func() error { return c.get(ctx, fmt.Sprintf("/releases/%d", id), nil, &r) })
+	if err != nil {
+		return AlbumDetails{}, "", fmt.Errorf("release %d: %w", id, err)
+	}
+	for _, img := range r.Images {
+		if img.Type == "primary" && img.Uri != "" {
+			return r.details(""), img.Uri, nil
+		}
+	}
+	return r.details(""), "", nil
+}
+
+// fetchCover downloads an image into the cache, returning its file name
+func (c *discogsClient) fetchCover(ctx context.Context, uri string, covers coverCache) (string, error) {
+	var b []byte
+	err := c.retry(ctx, func() (err error) {
+		b, err = c.fetch(ctx, uri)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return covers.put(b, path.Ext(strings.Split(uri, "?")[0]))
+}
+
+type enrichResult struct {
+	Fetched int
+	Failed  []error // of albums that Discogs refused, which are not retried
+	NoCover []error // of albums whose cover was refused; stored without one
+}
+
+// enrich fetches the details of up to n albums (all if n is 0) that do not
+// have any yet. Details are committed per album, so an interrupted run loses
+// nothing.
+//
+// An album that Discogs refuses (e.g. a deleted release) is recorded as failed,
+// and skipped; an album whose cover is refused is stored without one. Any
+// other error (e.g. the rate limit, or no connection) stops the run, which a
+// rerun resumes.
+func enrich(ctx context.Context, c *discogsClient, store Store, covers coverCache, n int) (enrichResult, error) {
+	var res enrichResult
+	e, ok := store.(enricher)
+	if !ok {
+		return res, fmt.Errorf("release details: %w", errUnsupported)
+	}
+	ids, err := e.unenriched(ctx)
+	if err != nil {
+		return res, err
+	}
+	if n > 0 && n < len(ids) {
+		ids = ids[:n]
+	}
+	for _, id := range ids {
+		d, uri, err := c.fetchRelease(ctx, id)
+		var se *statusError
+		if errors.As(err, &se) {
+			if err := e.insertFailure(ctx, id, err); err != nil {
+				return res, err
+			}
+			res.Failed = append(res.Failed, err)
+			continue
+		} else if err != nil {
+			return res, err
+		}
+		if uri != "" {
+			d.Cover, err = c.fetchCover(ctx, uri, covers)
+			if errors.As(err, &se) {
+				res.NoCover = append(res.NoCover, fmt.Errorf("release %d: cover: %w", id, err))
+			} else if err != nil {
+				return res, fmt.Errorf("release %d: cover: %w", id, err)
+			}
+		}
+		if err := e.insertDetails(ctx, id, d); err != nil {
+			return res, err
+		}
+		res.Fetched++
+	}
+	return res, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDuration(t *testing.T) {
+	for s, expected := range map[string]int{
+		"":        0,
+		"4:32":    272,
+		"0:05":    5,
+		"1:02:03": 3723,
+		"4'32":    0,
+	} {
+		assert.Equal(t, expected, parseDuration(s), s)
+	}
+}
+
+const releaseJSON = `{
+  "id": 1,
+  "notes": "Recorded live.\n",
+  "images": [
+    {"type": "secondary", "uri": "%[1]s/images/back.jpg"},
+    {"type": "primary", "uri": "%[1]s/images/front.jpeg?x=1"}
+  ],
+  "extraartists": [{"id": 7, "name": "Producer P", "role": "Producer", "tracks": ""}],
+  "tracklist": [
+    {"position": "", "type_": "heading", "title": "Side A"},
+    {"position": "A1", "type_": "track", "title": "Intro", "duration": "1:05"},
+    {"position": "A2", "type_": "index", "title": "Suite", "sub_tracks": [
+      {"position": "A2.a", "type_": "track", "title": "I", "duration": ""},
+      {"position": "A2.b", "type_": "track", "title": "II", "duration": "10:00",
+       "extraartists": [{"id": 8, "name": "Guest G", "role": "Vocals"}]}
+    ]}
+  ]
+}`
+
+func TestEnrich(t *testing.T) {
+	ctx := context.Background()
+	cover := []byte("not really a jpeg")
+	var requested []string
+	limited := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.Path)
+		switch r.URL.Path {
+		case "/releases/2", "/releases/3":
+			if limited {
+				limited = false
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			fmt.Fprintf(w, releaseJSON, "http://"+r.Host)
+		case "/images/front.jpeg":
+			_, _ = w.Write(cover)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	c := newDiscogsClient("secret")
+	c.base, _ = url.Parse(srv.URL)
+	var slept []time.Duration
+	c.sleep = func(_ context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		return nil
+	}
+
+	s := Must(openSqlite(":memory:"))
+	defer s.Close()
+	Must(s.InsertBatch(ctx, newReleases(3)))
+	covers := coverCache{dir: t.TempDir()}
+
+	res, err := enrich(ctx, c, s, covers, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, enrichResult{Fetched: 2}, res)
+	assert.Len(t, slept, 1)
+	assert.Equal(
+		t,
+		[]string{"/releases/3", "/releases/3", "/images/front.jpeg", "/releases/2", "/images/front.jpeg"},
+		requested,
+	)
+	assert.Equal(t, []int{1}, Must(s.unenriched(ctx)))
+
+	// the release that was not found is skipped, and not retried
+	res, err = enrich(ctx, c, s, covers, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, res.Fetched)
+	assert.Len(t, res.Failed, 1)
+	assert.ErrorContains(t, res.Failed[0], "release 1: "+srv.URL+"/releases/1: 404 Not Found")
+	assert.Nil(t, Must(s.details(ctx, 1)))
+	assert.Empty(t, Must(s.unenriched(ctx)))
+
+	// a missing cover only loses the cover
+	Must(s.InsertBatch(ctx, []Release{newRelease(5, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))}))
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/releases/5" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, releaseJSON, "http://"+r.Host+"/missing")
+	})
+	res, err = enrich(ctx, c, s, covers, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, res.Fetched)
+	assert.Empty(t, res.Failed)
+	assert.Len(t, res.NoCover, 1)
+	assert.ErrorContains(t, res.NoCover[0], "release 5: cover: "+srv.URL+"/missing/images/front.jpeg?x=1: 404 Not Found")
+	d5 := Must(s.details(ctx, 5))
+	assert.Empty(t, d5.Cover)
+	assert.Len(t, d5.Tracks, 3)
+	assert.Empty(t, Must(s.unenriched(ctx)))
+
+	// but other errors stop the run
+	Must(s.InsertBatch(ctx, []Release{newRelease(4, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))}))
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	_, err = enrich(ctx, c, s, covers, 0)
+	assert.ErrorIs(t, err, errUnavailable)
+	assert.Equal(t, []int{4}, Must(s.unenriched(ctx)))
+
+	sum := sha256.Sum256(cover)
+	d := Must(s.details(ctx, 2))
+	assert.Equal(
+		t,
+		&AlbumDetails{
+			Notes: "Recorded live.",
+			Cover: hex.EncodeToString(sum[:]) + ".jpeg",
+			Tracks: []Track{
+				{Number: "A1", Title: "Intro", Duration: 65},
+				{Number: "A2.a", Title: "I"},
+				{Number: "A2.b", Title: "II", Duration: 600},
+			},
+			Credits: []Credit{
+				{ArtistId: 7, Name: "Producer P", Role: "Producer"},
+				{ArtistId: 8, Name: "Guest G", Role: "Vocals", Tracks: "A2.b"},
+			},
+		},
+		d,
+	)
+	b, err := os.ReadFile(covers.path(d.Cover))
+	assert.NoError(t, err)
+	assert.Equal(t, cover, b)
+
+	// identical covers are stored once
+	entries, _ := os.ReadDir(covers.dir)
+	assert.Len(t, entries, 1)
+
+	// refetching replaces
+	assert.NoError(t, s.insertDetails(ctx, 2, AlbumDetails{Tracks: []Track{{Title: "Only"}}}))
+	assert.Equal(t, []Track{{Title: "Only"}}, Must(s.details(ctx, 2)).Tracks)
+	assert.Empty(t, Must(s.details(ctx, 2)).Credits)
+
+	// served to the web ui
+	web := httptest.NewServer(newMux(s, nil, covers))
+	defer web.Close()
+	for path, status := range map[string]int{
+		"/covers/3": http.StatusOK,
+		"/covers/2": http.StatusNotFound, // no cover
+		"/covers/1": http.StatusNotFound, // not fetched
+	} {
+		resp, err := http.Get(web.URL + path)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, status, resp.StatusCode, path)
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math"
@@ -16,6 +18,42 @@ import (
 
 const ApiPrefix = "https://api.discogs.com/"
 
+// Discogs allows 60 authenticated requests per minute, counted over a moving
+// window.
+//
+// https://www.discogs.com/developers/#page:home,header:home-rate-limiting
+const (
+	rateLimitWindow = time.Minute
+
+	// once fewer requests than this remain in the window, requests are
+	// spaced out
+	minRemaining = 5
+
+	// retries after hitting the rate limit; each wait is twice as long as
+	// the previous one
+	maxAttempts = 6
+
+	// attempts at syncing a page that fails with a transient error (e.g. a
+	// server error, or a busy db), waiting as after hitting the rate limit
+	pageAttempts = 3
+)
+
+var (
+	errRateLimited = errors.New("hit rate limit")
+
+	now = time.Now // replaced in tests
+)
+
+// statusError is an unexpected http status, i.e. a request that Discogs
+// refused (e.g. for a release that was deleted), and will refuse again. Rate
+// limits and server errors are errRateLimited and errUnavailable instead.
+type statusError struct {
+	url    string
+	status string // e.g. 404 Not Found
+}
+
+func (e *statusError) Error() string { return e.url + ": " + e.status }
+
 type Release struct {
 	DateAdded  string `json:"date_added"` // 2022-10-23T15:45:21-07:00
 	InstanceId int    `json:"instance_id"`
@@ -30,23 +68,56 @@ type Release struct {
 
 		Artists []Artist
 		Labels  []Label
-		// Formats []Format
+		Formats []Format
 	} `json:"basic_information"`
 }
 
-// Write to sqlite. Authorization is required.
-func dumpDB(user string) { // {{{
-	u, _ := url.Parse(ApiPrefix)
-	path := fmt.Sprintf("/users/%s/collection/folders/0/releases", user)
-	u = u.JoinPath(path) // note: url.JoinPath can error, but URL.JoinPath does not
+func (r Release) artistNames() string {
+	var names []string
+	for _, a := range r.BasicInfo.Artists {
+		names = append(names, a.Name)
+	}
+	return strings.Join(names, " ")
+}
 
-	v := url.Values{}
-	v.Set("per_page", "250")
+type discogsClient struct {
+	base   *url.URL
+	token  string
+	client *http.Client
+
+	backoff time.Duration                                    // first wait after hitting the rate limit
+	sleep   func(ctx context.Context, d time.Duration) error // replaced in tests
+}
 
+func newDiscogsClient(token string) *discogsClient {
+	base, _ := url.Parse(ApiPrefix)
+	return &discogsClient{
+		base:    base,
+		token:   token,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		backoff: 5 * time.Second,
+		sleep:   sleep,
+	}
+}
+
+// sleep waits for d, or until ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// readToken reads DISCOGS_TOKEN from the .env next to the binary.
+func readToken() (string, error) {
 	prog, _ := os.Executable()
 	b, err := os.ReadFile(filepath.Dir(prog) + "/.env")
 	if err != nil {
-		panic(err)
+		return "", fmt.Errorf("reading DISCOGS_TOKEN: %w", err)
 	}
 
 	var token string
@@ -57,81 +128,356 @@ func dumpDB(user string) { // {{{
 		}
 	}
 	if token == "" {
-		panic("DISCOGS_TOKEN not found")
+		return "", errors.New("DISCOGS_TOKEN not found in " + filepath.Dir(prog) + "/.env")
 	}
+	return token, nil
+}
 
-	maxPg := math.MaxUint16
-	ids := make(map[int]int)
+// get decodes the json response of an endpoint into dst. errRateLimited is
+// returned if Discogs refuses the request, and errUnavailable if it fails; the
+// caller decides whether to retry.
+func (c *discogsClient) get(ctx context.Context, path string, v url.Values, dst any) error {
+	u := c.base.JoinPath(path) // note: url.JoinPath can error, but URL.JoinPath does not
+	u.RawQuery = v.Encode()
 
-	for pg := 1; pg <= maxPg; pg++ {
-		v.Set("page", strconv.Itoa(pg))
-		u.RawQuery = v.Encode()
+	b, err := c.fetch(ctx, u.String())
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, dst)
+}
 
-		req, err := http.NewRequest("GET", u.String(), nil)
-		if err != nil {
-			panic(err)
+// fetch returns the body of any url served by Discogs (including images),
+// subject to the same rate limit as the API.
+func (c *discogsClient) fetch(ctx context.Context, u string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", "Discogs token="+c.token)
+	req.Header.Add("User-Agent", "disq")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
 		}
+		// e.g. a timeout, or no connection
+		return nil, fmt.Errorf("%w: %w", errUnavailable, err)
+	}
+	defer resp.Body.Close()
 
-		req.Header.Add("Authorization", "Discogs token="+token)
+	switch {
+	case resp.StatusCode == http.StatusOK:
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return nil, errRateLimited
+	case resp.StatusCode >= 500:
+		return nil, fmt.Errorf("%w: %s: %s", errUnavailable, u, resp.Status)
+	default:
+		return nil, &statusError{url: u, status: resp.Status}
+	}
 
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			panic(err)
-		}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errUnavailable, err)
+	}
+
+	c.throttle(ctx, resp.Header)
+	return b, nil
+}
 
-		var x struct {
-			Pagination struct{ Pages int }
-			Releases   []Release
+// retry calls f until it does not return errRateLimited, waiting twice as
+// long after each attempt.
+func (c *discogsClient) retry(ctx context.Context, f func() error) error {
+	wait := c.backoff
+	for range maxAttempts {
+		if err := f(); !errors.Is(err, errRateLimited) {
+			return err
 		}
-		if err := json.Unmarshal(Must(io.ReadAll(resp.Body)), &x); err != nil {
-			panic(err)
+		if err := c.sleep(ctx, wait); err != nil {
+			return err
 		}
-		_ = resp.Body.Close()
+		wait *= 2
+	}
+	return errRateLimited
+}
+
+// throttle waits before the next request if the rate limit is nearly
+// exhausted. Since the window moves, waiting for a few slots to free up is
+// enough; there is no need to wait for the whole window.
+func (c *discogsClient) throttle(ctx context.Context, h http.Header) {
+	remaining, err := strconv.Atoi(h.Get("X-Discogs-Ratelimit-Remaining"))
+	if err != nil || remaining >= minRemaining {
+		return
+	}
+	limit, err := strconv.Atoi(h.Get("X-Discogs-Ratelimit"))
+	if err != nil || limit == 0 {
+		limit = 60
+	}
+	// if ctx is done, the next request fails anyway
+	_ = c.sleep(ctx, rateLimitWindow/time.Duration(limit)*time.Duration(minRemaining-remaining))
+}
 
-		// on hitting rate limit, discogs returns a valid null-ish
-		// resp, which is actually an error
-		if x.Pagination.Pages == 0 {
-			panic("hit rate limit")
-			// pg--
+type collectionPage struct {
+	Pagination *pagination // nil in a null-ish response; see fetchCollection
+	Releases   []Release
+}
+
+type pagination struct {
+	Pages int
+	Items int // in the whole collection
+}
+
+// fetchCollection fetches one page of the user's collection, newest first.
+func (c *discogsClient) fetchCollection(ctx context.Context, user string, pg int) (*collectionPage, error) {
+	v := url.Values{}
+	v.Set("per_page", "250")
+	v.Set("page", strconv.Itoa(pg))
+	v.Set("sort", "added")
+	v.Set("sort_order", "desc")
+
+	var x collectionPage
+	err := c.retry(ctx, func() error {
+		x = collectionPage{}
+		err := c.get(ctx, fmt.Sprintf("/users/%s/collection/folders/0/releases", user), v, &x)
+		switch {
+		case err != nil:
+			return err
+		case x.Pagination == nil, x.Pagination.Pages == 0 && x.Pagination.Items > 0:
+			// on hitting rate limit, discogs may also return a valid
+			// null-ish resp, which is actually an error. an empty
+			// collection has no pages either, but says so
+			return errRateLimited
 		}
-		maxPg = x.Pagination.Pages
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("page %d: %w", pg, err)
+	}
+	return &x, nil
+}
 
-		sqliteTx := s.db.MustBegin()
-		// chTx, err := ch.db.PrepareBatch(context.Background(), "INSERT INTO albums")
-		// if err != nil {
-		// 	panic(err)
-		// }
+// syncState is the checkpoint of a collection sync, stored per user.
+type syncState struct {
+	User string
+
+	// The last page committed by an unfinished sync. Pages are sorted newest
+	// first, so releases added since the interruption only push older ones
+	// onto later pages; resuming after this page may refetch a few
+	// releases, but never skips any.
+	Page int
+
+	Started   int64 // start of the first run of this sync; reset with Page
+	Full      bool  // of the first run (or any resumed one); reset with Page
+	Newest    int64 // newest date_added seen by the current sync
+	LastAdded int64 `db:"last_added"` // newest date_added of the last finished sync
+}
 
-		// fmt.Println(pg)
-		for _, rel := range x.Releases {
-			s.InsertAlbum(sqliteTx, rel)
-			// ch.InsertAlbum(chTx, rel)
+type syncResult struct {
+	Pages    int
+	Inserted int
+	ids      map[int]int // release id -> number of instances
+
+	Added   []Album
+	Changed []Album
+	Removed []Album // only known after a full sync
+}
+
+// pageResult is what syncPage did
+type pageResult struct {
+	pages   int // of the whole collection
+	rels    []Release
+	changes []change // of each of rels
+	done    bool     // reached a release stored by a previous sync
+}
+
+// syncPage fetches a page of the collection, and writes its releases, and the
+// checkpoint st (which is updated), in a single transaction.
+func syncPage(
+	ctx context.Context,
+	c *discogsClient,
+	cp checkpointer,
+	user string,
+	pg int,
+	full bool,
+	st *syncState,
+) (pageResult, error) {
+	var res pageResult
+	x, err := c.fetchCollection(ctx, user, pg)
+	if err != nil {
+		return res, err
+	}
+	res.pages = x.Pagination.Pages // 0 if the collection is empty
 
-			ids[rel.BasicInfo.Id]++
+	for _, rel := range x.Releases {
+		if rel.Rating < 1 || rel.Rating > 5 {
+			return res, errors.New("got 0 rating; no discogs token supplied?")
+		}
 
-			// panic(rel)
-			if rel.Rating < 1 || rel.Rating > 5 {
-				panic("got 0 rating; no discogs token supplied?")
+		added, err := time.Parse(time.RFC3339, rel.DateAdded)
+		if err != nil {
+			return res, err
+		}
+		if !full && added.Unix() <= st.LastAdded {
+			stored, err := cp.hasInstance(ctx, rel.InstanceId)
+			if err != nil {
+				return res, err
 			}
+			if stored {
+				res.done = true
+				break
+			}
+		}
+		st.Newest = max(st.Newest, added.Unix())
+		res.rels = append(res.rels, rel)
+	}
+
+	st.Page = pg
+	res.changes, err = cp.insertPage(ctx, res.rels, *st)
+	if err != nil {
+		return res, fmt.Errorf("page %d: %w", pg, err)
+	}
+	return res, nil
+}
+
+// retryPage calls f until it succeeds, fails with an error that is not
+// transient (i.e. not errUnavailable), or has failed pageAttempts times.
+func (c *discogsClient) retryPage(ctx context.Context, f func() error) error {
+	wait := c.backoff
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || !errors.Is(err, errUnavailable) || attempt == pageAttempts {
+			return err
+		}
+		if err := c.sleep(ctx, wait); err != nil {
+			return err
+		}
+		wait *= 2
+	}
+}
 
+// syncCollection writes the user's collection to the store, one batch per
+// page. If the store supports checkpoints, an interrupted sync is resumed, and,
+// unless full is set, the sync stops at the first release that was already
+// stored by a previous sync.
+//
+// A full sync touches every release in the collection, so albums that were
+// not touched since it started have been removed from the collection, and are
+// tombstoned. This also holds if the sync was resumed, with or without full.
+//
+// Each page is committed with the checkpoint; a page that fails (including
+// one interrupted via ctx) is rolled back, and is where a rerun resumes.
+func syncCollection(
+	ctx context.Context,
+	c *discogsClient,
+	store Store,
+	user string,
+	full bool,
+) (*syncResult, error) {
+	cp, ok := store.(checkpointer)
+	if !ok {
+		cp = nopCheckpointer{store}
+	}
+
+	st, err := cp.syncState(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	res := syncResult{ids: make(map[int]int)}
+	if st.Page == 0 {
+		st.Started = now().Unix()
+	}
+	// resuming an incremental sync as a full one is fine, as every release
+	// of the pages that it committed was touched
+	full = full || st.Full
+	st.Full = full
+
+	maxPg := math.MaxUint16
+	for pg := st.Page + 1; pg <= maxPg; pg++ {
+		var pr pageResult
+		err := c.retryPage(ctx, func() (err error) {
+			// a failed attempt must not advance the checkpoint
+			next := st
+			if pr, err = syncPage(ctx, c, cp, user, pg, full, &next); err == nil {
+				st = next
+			}
+			return err
+		})
+		if err != nil {
+			return &res, err
 		}
+		maxPg = pr.pages
 
-		if err := sqliteTx.Commit(); err != nil {
-			panic(err)
+		for i, chg := range pr.changes {
+			rel := pr.rels[i]
+			alb := Album{
+				Id:     rel.BasicInfo.Id,
+				Title:  rel.BasicInfo.Title,
+				Artist: rel.artistNames(),
+				Year:   rel.BasicInfo.Year,
+				Rating: rel.Rating,
+			}
+			switch chg {
+			case albumAdded:
+				res.Added = append(res.Added, alb)
+			case albumChanged:
+				res.Changed = append(res.Changed, alb)
+			}
+			res.ids[rel.BasicInfo.Id]++
 		}
-		// if err := chTx.Send(); err != nil {
-		// 	panic(err)
-		// }
+		res.Inserted += len(pr.rels)
+		res.Pages++
 
 		// fmt.Printf("%d/%d ok\n", pg, x.Pagination.Pages)
-		time.Sleep(2 * time.Second)
+		if pr.done {
+			break
+		}
+	}
 
+	st.LastAdded = max(st.LastAdded, st.Newest)
+	if res.Removed, err = cp.finishSync(ctx, st, full); err != nil {
+		return &res, err
+	}
+	return &res, nil
+}
+
+// Write the collection to the store. Authorization is required.
+func dumpDB(ctx context.Context, store Store, user string, full bool) error {
+	token, err := readToken()
+	if err != nil {
+		return err
+	}
+	res, err := syncCollection(ctx, newDiscogsClient(token), store, user, full)
+	if err != nil {
+		// the checkpoint is committed with each page; rerunning
+		// resumes from the failed page
+		return err
+	}
+	fmt.Printf("%d releases from %d pages\n", res.Inserted, res.Pages)
+	fmt.Printf(
+		"added %d, changed %d, removed %d\n",
+		len(res.Added),
+		len(res.Changed),
+		len(res.Removed),
+	)
+	for _, x := range []struct {
+		prefix string
+		albums []Album
+	}{
+		{"+", res.Added},
+		{"~", res.Changed},
+		{"-", res.Removed},
+	} {
+		for _, alb := range x.albums {
+			fmt.Println(x.prefix, alb.Artist, "-", alb.Title)
+		}
 	}
 
 	// if slices.Max(slices.Collect(maps.Values(ids))) > 1 {
-	for k, v := range ids {
+	for k, v := range res.ids {
 		if v > 1 {
 			fmt.Println(k)
 		}
 	}
-} // }}}
+	return nil
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDiscogs serves a collection (newest first) in pages of pageSize.
+type fakeDiscogs struct {
+	mu        sync.Mutex
+	releases  []Release
+	pageSize  int
+	remaining string      // X-Discogs-Ratelimit-Remaining
+	fail      map[int]int // page -> status code returned once
+	requested []int       // pages, in order of request
+	onRequest func(pg int)
+	server    *httptest.Server
+}
+
+func newFakeDiscogs(t *testing.T, releases []Release) *fakeDiscogs {
+	f := &fakeDiscogs{
+		releases:  releases,
+		pageSize:  2,
+		remaining: "59",
+		fail:      map[int]int{},
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func (f *fakeDiscogs) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path != "/users/foo/collection/folders/0/releases" ||
+		r.Header.Get("Authorization") != "Discogs token=secret" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	pg, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	f.requested = append(f.requested, pg)
+	if f.onRequest != nil {
+		f.onRequest(pg)
+	}
+	if code, ok := f.fail[pg]; ok {
+		delete(f.fail, pg)
+		w.WriteHeader(code)
+		return
+	}
+
+	var x collectionPage
+	x.Pagination = &pagination{
+		Pages: (len(f.releases) + f.pageSize - 1) / f.pageSize,
+		Items: len(f.releases),
+	}
+	lo := min((pg-1)*f.pageSize, len(f.releases))
+	hi := min(pg*f.pageSize, len(f.releases))
+	x.Releases = f.releases[lo:hi]
+
+	w.Header().Set("X-Discogs-Ratelimit", "60")
+	w.Header().Set("X-Discogs-Ratelimit-Remaining", f.remaining)
+	_ = json.NewEncoder(w).Encode(x)
+}
+
+func (f *fakeDiscogs) client() (*discogsClient, *[]time.Duration) {
+	var slept []time.Duration
+	c := newDiscogsClient("secret")
+	c.base, _ = url.Parse(f.server.URL)
+	c.sleep = func(_ context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		return nil
+	}
+	return c, &slept
+}
+
+func newRelease(id int, added time.Time) Release {
+	var rel Release
+	rel.InstanceId = id * 10
+	rel.Rating = id%5 + 1
+	rel.DateAdded = added.Format(time.RFC3339)
+	rel.BasicInfo.Id = id
+	rel.BasicInfo.Title = "Album " + strconv.Itoa(id)
+	rel.BasicInfo.Artists = []Artist{{Id: id, Name: "Artist " + strconv.Itoa(id)}}
+	return rel
+}
+
+// n releases, newest first
+func newReleases(n int) []Release {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var rels []Release
+	for i := n; i > 0; i-- {
+		rels = append(rels, newRelease(i, t0.AddDate(0, 0, i)))
+	}
+	return rels
+}
+
+func titles(albums []Album) []string {
+	var ts []string
+	for _, alb := range albums {
+		ts = append(ts, alb.Title)
+	}
+	return ts
+}
+
+func countAlbums(t *testing.T, s *sqlite) int {
+	var n int
+	assert.NoError(t, s.db.Get(&n, "SELECT count(*) FROM albums"))
+	return n
+}
+
+func TestSyncCollection(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeDiscogs(t, newReleases(5))
+	c, _ := f.client()
+	s := Must(openSqlite(":memory:"))
+
+	res, err := syncCollection(ctx, c, s, "foo", false)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, res.Inserted)
+	assert.Equal(t, 3, res.Pages)
+	assert.Equal(t, []int{1, 2, 3}, f.requested)
+	assert.Equal(t, 5, countAlbums(t, s))
+
+	st := Must(s.syncState(ctx, "foo"))
+	assert.Equal(t, 0, st.Page)
+	assert.Equal(t, time.Date(2024, 1, 6, 0, 0, 0, 0, time.UTC).Unix(), st.LastAdded)
+
+	// nothing new: stop at the first release
+	f.requested = nil
+	res, err = syncCollection(ctx, c, s, "foo", false)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, res.Inserted)
+	assert.Equal(t, []int{1}, f.requested)
+
+	// two new releases; page 2 starts with an old one
+	f.releases = append(newReleases(7)[:2], f.releases...)
+	f.requested = nil
+	res, err = syncCollection(ctx, c, s, "foo", false)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, res.Inserted)
+	assert.Equal(t, []int{1, 2}, f.requested)
+	assert.Equal(t, 7, countAlbums(t, s))
+
+	// full sync ignores what is stored
+	f.requested = nil
+	res, err = syncCollection(ctx, c, s, "foo", true)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, res.Inserted)
+	assert.Equal(t, []int{1, 2, 3, 4}, f.requested)
+}
+
+func TestSyncCollectionResume(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeDiscogs(t, newReleases(5))
+	f.fail[2] = http.StatusForbidden
+	c, _ := f.client()
+	s := Must(openSqlite(":memory:"))
+
+	_, err := syncCollection(ctx, c, s, "foo", false)
+	assert.Error(t, err)
+	assert.Equal(t, 1, Must(s.syncState(ctx, "foo")).Page)
+	assert.Equal(t, 2, countAlbums(t, s))
+
+	f.requested = nil
+	res, err := syncCollection(ctx, c, s, "foo", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{2, 3}, f.requested)
+	assert.Equal(t, 3, res.Inserted)
+	assert.Equal(t, 5, countAlbums(t, s))
+	assert.Equal(t, 0, Must(s.syncState(ctx, "foo")).Page)
+}
+
+func TestSyncCollectionResumeFull(t *testing.T) {
+	ctx := context.Background()
+	t0 := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return t0 }
+	t.Cleanup(func() { now = time.Now })
+
+	f := newFakeDiscogs(t, newReleases(5))
+	c, _ := f.client()
+	s := Must(openSqlite(":memory:"))
+	Must(syncCollection(ctx, c, s, "foo", true))
+
+	// sell 1, then interrupt a full sync
+	f.releases = f.releases[:4]
+	t0 = t0.Add(time.Hour)
+	f.fail[2] = http.StatusForbidden
+	_, err := syncCollection(ctx, c, s, "foo", true)
+	assert.Error(t, err)
+	st := Must(s.syncState(ctx, "foo"))
+	assert.Equal(t, 1, st.Page)
+	assert.True(t, st.Full)
+
+	// resumed without -full, but as the full sync it was: the releases that
+	// are already stored are synced, and the sold one is removed
+	f.requested = nil
+	res, err := syncCollection(ctx, c, s, "foo", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{2}, f.requested)
+	assert.Equal(t, 2, res.Inserted)
+	assert.Equal(t, []string{"Album 1"}, titles(res.Removed))
+	assert.False(t, Must(s.syncState(ctx, "foo")).Full)
+}
+
+func TestSyncCollectionRetry(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeDiscogs(t, newReleases(5))
+	f.fail[2] = http.StatusServiceUnavailable
+	c, slept := f.client()
+	s := Must(openSqlite(":memory:"))
+
+	res, err := syncCollection(ctx, c, s, "foo", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 2, 3}, f.requested)
+	assert.Equal(t, []time.Duration{c.backoff}, *slept)
+	assert.Equal(t, 5, res.Inserted)
+	assert.Equal(t, 5, countAlbums(t, s))
+	assert.Equal(t, 0, Must(s.syncState(ctx, "foo")).Page)
+
+	// a page that keeps failing is given up on
+	f.requested = nil
+	f.onRequest = func(pg int) { f.fail[pg] = http.StatusBadGateway }
+	_, err = syncCollection(ctx, c, s, "foo", true)
+	assert.ErrorIs(t, err, errUnavailable)
+	assert.Equal(t, []int{1, 1, 1}, f.requested)
+}
+
+func TestSyncCollectionCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	f := newFakeDiscogs(t, newReleases(5))
+	f.onRequest = func(pg int) {
+		if pg == 2 {
+			cancel()
+		}
+	}
+	c, _ := f.client()
+	s := Must(openSqlite(":memory:"))
+
+	_, err := syncCollection(ctx, c, s, "foo", false)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, []int{1, 2}, f.requested) // not retried
+
+	// page 2 was rolled back
+	st := Must(s.syncState(context.Background(), "foo"))
+	assert.Equal(t, 1, st.Page)
+	assert.Equal(t, 2, countAlbums(t, s))
+}
+
+func TestSyncCollectionRateLimit(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeDiscogs(t, newReleases(2))
+	f.fail[1] = http.StatusTooManyRequests
+	f.remaining = "2"
+	c, slept := f.client()
+	s := Must(openSqlite(":memory:"))
+
+	_, err := syncCollection(ctx, c, s, "foo", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 1}, f.requested)
+	assert.Equal(t, []time.Duration{
+		c.backoff,       // 429
+		3 * time.Second, // 2 of 60 remaining
+	}, *slept)
+
+	// a missing pagination is also treated as hitting the limit
+	requests := 0
+	nullish := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		_, _ = w.Write([]byte(`{"releases": []}`))
+	}))
+	defer nullish.Close()
+	c.base, _ = url.Parse(nullish.URL)
+	_, err = c.fetchCollection(ctx, "foo", 1)
+	assert.ErrorIs(t, err, errRateLimited)
+	assert.Equal(t, maxAttempts, requests)
+}
+
+func TestSyncCollectionEmpty(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeDiscogs(t, nil)
+	c, slept := f.client()
+	s := Must(openSqlite(":memory:"))
+
+	// is not mistaken for hitting the limit
+	res, err := syncCollection(ctx, c, s, "foo", true)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1}, f.requested)
+	assert.Empty(t, *slept)
+	assert.Equal(t, 0, res.Inserted)
+}
+
+func TestSyncCollectionReconcile(t *testing.T) {
+	ctx := context.Background()
+	t0 := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return t0 }
+	t.Cleanup(func() { now = time.Now })
+
+	f := newFakeDiscogs(t, newReleases(5))
+	c, _ := f.client()
+	s := Must(openSqlite(":memory:"))
+
+	res, err := syncCollection(ctx, c, s, "foo", true)
+	assert.NoError(t, err)
+	assert.Len(t, res.Added, 5)
+	assert.Empty(t, res.Removed)
+
+	// sell 4 and 2, rerate 3
+	f.releases = []Release{f.releases[0], f.releases[2], f.releases[4]}
+	f.releases[1].Rating = 1
+	t0 = t0.Add(time.Hour)
+
+	// incremental syncs cannot know what was removed
+	res, err = syncCollection(ctx, c, s, "foo", false)
+	assert.NoError(t, err)
+	assert.Empty(t, res.Removed)
+
+	res, err = syncCollection(ctx, c, s, "foo", true)
+	assert.NoError(t, err)
+	assert.Empty(t, res.Added)
+	assert.Equal(t, []string{"Album 3"}, titles(res.Changed))
+	assert.ElementsMatch(t, []string{"Album 4", "Album 2"}, titles(res.Removed))
+
+	var deleted int
+	assert.NoError(t, s.db.Get(&deleted, "SELECT count(*) FROM collection WHERE deleted_at = ?", t0.Unix()))
+	assert.Equal(t, 2, deleted)
+	assert.Empty(t, Must(s.AlbumsByArtist(ctx, "Artist 4")))
+	assert.Len(t, Must(s.AlbumsByArtist(ctx, "Artist 3")), 1)
+
+	// bought again
+	f.releases = newReleases(5)
+	t0 = t0.Add(time.Hour)
+	res, err = syncCollection(ctx, c, s, "foo", true)
+	assert.NoError(t, err)
+	assert.Len(t, res.Added, 2)
+	assert.Len(t, res.Changed, 1)
+	assert.Empty(t, res.Removed)
+}
+
+func TestSyncCollectionWithoutCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeDiscogs(t, newReleases(3))
+	c, _ := f.client()
+	store := struct{ Store }{Must(openSqlite(":memory:"))} // hides the checkpointer
+
+	for range 2 {
+		f.requested = nil
+		res, err := syncCollection(ctx, c, store, "foo", false)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, res.Inserted)
+		assert.Equal(t, []int{1, 2}, f.requested)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Files that are listed in an m3u playlist, by extension
+var audioExts = []string{".flac", ".mp3", ".ogg", ".opus", ".m4a", ".aac", ".wav", ".wv", ".ape"}
+
+// filterFlags registers the filters of /api/albums (see parseFilter) as flags
+// of fs, so that both take the same values (e.g. -year 1990-). The returned
+// func builds the Filter, once fs has been parsed.
+func filterFlags(fs *flag.FlagSet) func() (Filter, error) {
+	q := url.Values{}
+	for _, fl := range []struct{ name, usage string }{
+		{"q", "full-text search"},
+		{"artist", "substring of any artist"},
+		{"title", "substring of the title"},
+		{"genre", "only albums of <genre>"},
+		{"style", "only albums of <style>"},
+		{"label", "only albums released on <label>"},
+		{"rating", "minimum rating"},
+		{"year", "year, or range of years (e.g. 1990-1999, 2000-)"},
+	} {
+		fs.Func(fl.name, fl.usage, func(s string) error {
+			q.Set(fl.name, s)
+			return nil
+		})
+	}
+	fs.BoolFunc("masters", "only the highest-rated pressing of each master release", func(s string) error {
+		q.Set("masters", s)
+		return nil
+	})
+	return func() (Filter, error) { return parseFilter(q) }
+}
+
+// m3u writes an extended m3u playlist of the albums' files in the library,
+// album by album. Albums that are not in the library are skipped, and
+// returned.
+func m3u(w io.Writer, library string, albums []Album) ([]Album, error) {
+	var missing []Album
+	fmt.Fprintln(w, "#EXTM3U")
+	for _, alb := range albums {
+		var files []string
+		for _, dir := range localDirs(library, alb.Artist, alb.Title) {
+			// discs may be in subdirectories
+			err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+				if err == nil && !d.IsDir() &&
+					slices.Contains(audioExts, strings.ToLower(filepath.Ext(path))) {
+					files = append(files, path)
+				}
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		if files == nil {
+			missing = append(missing, alb)
+			continue
+		}
+		// WalkDir is lexical, so tracks are in order if named as usual
+		// (e.g. "01 Title.flac")
+		fmt.Fprintf(w, "#EXTALB:%s\n#EXTART:%s\n", alb.Title, alb.Artist)
+		for _, f := range files {
+			track := strings.TrimSuffix(filepath.Base(f), filepath.Ext(f))
+			fmt.Fprintf(w, "#EXTINF:-1,%s - %s\n%s\n", alb.Artist, track, f)
+		}
+	}
+	return missing, nil
+}
+
+// export runs `disq export` with the given args, writing the selected albums
+// to w. With -format m3u, albums are resolved in the library (i.e. $MU), and
+// those that could not be are returned.
+func export(ctx context.Context, store Store, library string, args []string, w io.Writer) ([]Album, error) {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", "csv", "output format: csv, jsonl or m3u")
+	sort := fs.String("sort", "artist", "sort by "+strings.Join(sortColumns, ", ")+" (or relevance, with -q); prefix with - to reverse")
+	filter := filterFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	f, err := filter()
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains([]string{"csv", "jsonl", "m3u"}, *format) {
+		return nil, fmt.Errorf("unknown format: %s", *format)
+	}
+
+	var p Page
+	p.Sort, p.Desc = strings.CutPrefix(*sort, "-")
+	albums, err := store.Albums(ctx, f, p)
+	if err != nil {
+		return nil, err
+	}
+
+	switch *format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		_ = cw.Write([]string{"id", "artist", "title", "year", "rating"})
+		for _, alb := range albums {
+			_ = cw.Write([]string{
+				strconv.Itoa(alb.Id),
+				alb.Artist,
+				alb.Title,
+				strconv.Itoa(alb.Year),
+				strconv.Itoa(alb.Rating),
+			})
+		}
+		cw.Flush()
+		return nil, cw.Error()
+
+	case "jsonl":
+		enc := json.NewEncoder(w)
+		for _, alb := range albums {
+			if err := enc.Encode(alb); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+
+	default:
+		if library == "" {
+			return nil, errors.New("m3u requires a library; set $MU")
+		}
+		return m3u(w, library, albums)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExport(t *testing.T) {
+	ctx := context.Background()
+	s := Must(openSqlite(":memory:"))
+	defer s.Close()
+	rels := newReleases(3)
+	for i := range rels {
+		rels[i].BasicInfo.Year = 1990 + rels[i].BasicInfo.Id
+	}
+	rels[0].BasicInfo.Title = "Album 3, Live"
+	Must(s.InsertBatch(ctx, rels))
+
+	lib := t.TempDir()
+	for _, f := range []string{
+		"Artist 1/Album 1 (1991)/02 Second.flac",
+		"Artist 1/Album 1 (1991)/01 First.flac",
+		"Artist 1/Album 1 (1991)/cover.jpg",
+		"Artist 2/Album 2 (1992)/CD2/01 Third.MP3",
+	} {
+		path := filepath.Join(lib, f)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		assert.NoError(t, os.WriteFile(path, nil, 0o644))
+	}
+
+	for _, test := range []struct {
+		args     []string
+		expected string
+		missing  []string
+	}{
+		{
+			[]string{"-sort", "-year"},
+			"id,artist,title,year,rating\n3,Artist 3,\"Album 3, Live\",1993,4\n2,Artist 2,Album 2,1992,3\n1,Artist 1,Album 1,1991,2\n",
+			nil,
+		},
+		{
+			[]string{"-format", "jsonl", "-year", "1992-", "-rating", "4"},
+			`{"id":3,"title":"Album 3, Live","artist":"Artist 3","year":1993,"rating":4}` + "\n",
+			nil,
+		},
+		{
+			[]string{"-format", "m3u", "-sort", "title"},
+			"#EXTM3U\n" +
+				"#EXTALB:Album 1\n#EXTART:Artist 1\n" +
+				"#EXTINF:-1,Artist 1 - 01 First\n" + filepath.Join(lib, "Artist 1/Album 1 (1991)/01 First.flac") + "\n" +
+				"#EXTINF:-1,Artist 1 - 02 Second\n" + filepath.Join(lib, "Artist 1/Album 1 (1991)/02 Second.flac") + "\n" +
+				"#EXTALB:Album 2\n#EXTART:Artist 2\n" +
+				"#EXTINF:-1,Artist 2 - 01 Third\n" + filepath.Join(lib, "Artist 2/Album 2 (1992)/CD2/01 Third.MP3") + "\n",
+			[]string{"Album 3, Live"},
+		},
+	} {
+		var b strings.Builder
+		missing, err := export(ctx, s, lib, test.args, &b)
+		assert.NoError(t, err, test.args)
+		assert.Equal(t, test.expected, b.String(), test.args)
+		assert.Equal(t, test.missing, titles(missing), test.args)
+	}
+
+	var b strings.Builder
+	for _, args := range [][]string{
+		{"-format", "xml"},
+		{"-year", "x"},
+		{"-masters=maybe"},
+	} {
+		_, err := export(ctx, s, lib, args, &b)
+		assert.Error(t, err, args)
+	}
+	_, err := export(ctx, s, "", []string{"-format", "m3u"}, &b)
+	assert.Error(t, err)
+}
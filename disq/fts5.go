@@ -0,0 +1,11 @@
+//go:build !sqlite_fts5
+
+package main
+
+// The search index (see search.go) needs sqlite's fts5, which go-sqlite3 only
+// compiles with a build tag. Without it, every sqlite store would fail to
+// open, so the build fails instead:
+//
+//	go build -tags sqlite_fts5
+//	go test -tags sqlite_fts5 ./...
+const _ = disq_must_be_built_with_tags_sqlite_fts5
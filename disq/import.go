@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A collection can be exported as csv (https://www.discogs.com/users/export),
+// which does not require an API token. The export lacks artist and label ids
+// (which are synthesised), genres, styles and instance ids. Multiple artists
+// or labels are joined into a single one, since their names cannot be split
+// reliably.
+
+// Columns of the export that are used; any others (e.g. CollectionFolder,
+// Collection Notes) are ignored
+var csvColumns = []string{
+	"Catalog#",
+	"Artist",
+	"Title",
+	"Label",
+	"Format",
+	"Rating",
+	"Released",
+	"release_id",
+	"Date Added",
+}
+
+// Releases are inserted in batches of this size, i.e. the size of a page of
+// the API
+const importBatchSize = 250
+
+// syntheticId derives a stable id from a name. Ids are negative, and thus
+// never collide with those of Discogs.
+func syntheticId(kind string, name string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(kind + "\x00" + name))
+	return -int(h.Sum32()>>1) - 1
+}
+
+// e.g. 2xLP
+var formatQty = regexp.MustCompile(`^(\d+)x(.+)$`)
+
+// parseFormats parses a Format column, e.g. "2xLP, Album, RE". Multiple
+// formats are joined with " + ".
+func parseFormats(s string) []Format {
+	var formats []Format
+	for _, f := range strings.Split(s, " + ") {
+		parts := strings.Split(f, ", ")
+		if parts[0] == "" {
+			continue
+		}
+		format := Format{Name: parts[0], Qty: "1", Descriptions: parts[1:]}
+		if m := formatQty.FindStringSubmatch(parts[0]); m != nil {
+			format.Qty, format.Name = m[1], m[2]
+		}
+		formats = append(formats, format)
+	}
+	return formats
+}
+
+// parseLabels pairs labels with catalog numbers, which are both ", "-joined
+func parseLabels(labels string, catnos string) []Label {
+	if labels == "" {
+		return nil
+	}
+	names := strings.Split(labels, ", ")
+	nums := strings.Split(catnos, ", ")
+	var ls []Label
+	for i, name := range names {
+		l := Label{Id: syntheticId("label", name), Name: name}
+		if i < len(nums) {
+			l.Catno = nums[i]
+		}
+		ls = append(ls, l)
+	}
+	return ls
+}
+
+// parseCSVRow converts a row of the export, keyed by column
+func parseCSVRow(row map[string]string) (Release, error) {
+	var rel Release
+
+	id, err := strconv.Atoi(row["release_id"])
+	if err != nil {
+		return rel, fmt.Errorf("invalid release_id: %q", row["release_id"])
+	}
+	rel.BasicInfo.Id = id
+
+	if r := row["Rating"]; r != "" {
+		if rel.Rating, err = strconv.Atoi(r); err != nil {
+			return rel, fmt.Errorf("invalid rating: %q", r)
+		}
+	}
+
+	// 1990, 1990-05-00, or empty
+	if len(row["Released"]) >= 4 {
+		rel.BasicInfo.Year, _ = strconv.Atoi(row["Released"][:4])
+	}
+
+	added, err := time.Parse(time.DateTime, row["Date Added"])
+	if err != nil {
+		return rel, fmt.Errorf("invalid date added: %q", row["Date Added"])
+	}
+	rel.DateAdded = added.Format(time.RFC3339)
+
+	rel.BasicInfo.Title = row["Title"]
+	rel.BasicInfo.Artists = []Artist{{
+		Id:   syntheticId("artist", row["Artist"]),
+		Name: row["Artist"],
+	}}
+	rel.BasicInfo.Labels = parseLabels(row["Label"], row["Catalog#"])
+	rel.BasicInfo.Formats = parseFormats(row["Format"])
+
+	return rel, nil
+}
+
+// importCSV writes all releases of an export to the store, and reports what
+// changed. Releases that are not in the export are not removed.
+func importCSV(ctx context.Context, store Store, r io.Reader) ([]change, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+	cols := map[string]int{}
+	for i, h := range header {
+		cols[h] = i
+	}
+	for _, c := range csvColumns {
+		if _, ok := cols[c]; !ok {
+			return nil, fmt.Errorf("missing column: %s", c)
+		}
+	}
+
+	var rels []Release
+	for {
+		rec, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		row := map[string]string{}
+		for _, c := range csvColumns {
+			row[c] = strings.TrimSpace(rec[cols[c]])
+		}
+		rel, err := parseCSVRow(row)
+		if err != nil {
+			line, _ := cr.FieldPos(0)
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		rels = append(rels, rel)
+	}
+
+	// rows are only written once the whole file has been parsed. batches
+	// that were written before a failure are kept; reimporting is
+	// harmless.
+	var changes []change
+	for i := 0; i < len(rels); i += importBatchSize {
+		c, err := store.InsertBatch(ctx, rels[i:min(i+importBatchSize, len(rels))])
+		if err != nil {
+			return changes, err
+		}
+		changes = append(changes, c...)
+	}
+	return changes, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// a few rows of a real export, abridged
+const exportCSV = `Catalog#,Artist,Title,Label,Format,Rating,Released,release_id,CollectionFolder,Date Added,Collection Media Condition,Collection Sleeve Condition,Collection Notes
+CRE LP 094,My Bloody Valentine,Loveless,Creation Records,"LP, Album",5,1991-11-04,341826,Uncategorized,2022-10-11 12:41:04,,,
+"WARP 31, WARPCD 31",Boards Of Canada,"Music Has The Right To Children","Warp Records, Skam","2xLP, Album + CD, Album",4,1998,2138,Uncategorized,2023-01-02 03:04:05,,,
+none,Various,Untitled,Not On Label,,,,99,Uncategorized,2024-05-06 07:08:09,,,"bought twice"
+`
+
+func TestImportCSV(t *testing.T) {
+	ctx := context.Background()
+	s := Must(openSqlite(":memory:"))
+	defer s.Close()
+
+	changes, err := importCSV(ctx, s, strings.NewReader(exportCSV))
+	assert.NoError(t, err)
+	assert.Equal(t, []change{albumAdded, albumAdded, albumAdded}, changes)
+
+	assert.Equal(
+		t,
+		[]Album{{Id: 2138, Title: "Music Has The Right To Children", Artist: "Boards Of Canada", Year: 1998, Rating: 4}},
+		Must(s.AlbumsByArtist(ctx, "Boards Of Canada")),
+	)
+	assert.Equal(t, []string{"Untitled"}, titles(Must(s.Albums(ctx, Filter{Label: "not on label"}, Page{}))))
+	assert.Equal(t, []string{"Music Has The Right To Children"}, titles(Must(s.Albums(ctx, Filter{Label: "Skam"}, Page{}))))
+
+	var labels []Label
+	assert.NoError(t, s.db.Select(&labels, `
+		SELECT labels.id, labels.name, albums_labels.catno
+		FROM albums_labels INNER JOIN labels ON labels.id = albums_labels.label_id
+		WHERE album_id = 2138 ORDER BY catno`))
+	assert.Equal(
+		t,
+		[]Label{
+			{Id: syntheticId("label", "Warp Records"), Name: "Warp Records", Catno: "WARP 31"},
+			{Id: syntheticId("label", "Skam"), Name: "Skam", Catno: "WARPCD 31"},
+		},
+		labels,
+	)
+	assert.Less(t, labels[0].Id, 0)
+
+	var formats []string
+	assert.NoError(t, s.db.Select(&formats, "SELECT qty || name || ':' || descriptions FROM formats WHERE album_id = 2138 ORDER BY position"))
+	assert.Equal(t, []string{"2LP:Album", "1CD:Album"}, formats)
+
+	var added int64
+	assert.NoError(t, s.db.Get(&added, "SELECT date_added FROM collection WHERE album_id = 341826"))
+	assert.Equal(t, int64(1665492064), added)
+
+	// reimporting changes nothing
+	changes, err = importCSV(ctx, s, strings.NewReader(exportCSV))
+	assert.NoError(t, err)
+	assert.Equal(t, []change{albumUnchanged, albumUnchanged, albumUnchanged}, changes)
+
+	// a sync replaces the synthetic artist with that of Discogs
+	rel := newRelease(2138, time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC))
+	rel.BasicInfo.Title = "Music Has The Right To Children"
+	rel.BasicInfo.Year = 1998
+	rel.BasicInfo.Artists = []Artist{{Id: 3010, Name: "Boards Of Canada"}}
+	rel.Rating = 4
+	Must(s.InsertBatch(ctx, []Release{rel}))
+	assert.Equal(
+		t,
+		[]Album{{Id: 2138, Title: "Music Has The Right To Children", Artist: "Boards Of Canada", Year: 1998, Rating: 4}},
+		Must(s.AlbumsByArtist(ctx, "Boards Of Canada")),
+	)
+	var artists []int
+	assert.NoError(t, s.db.Select(&artists, "SELECT artist_id FROM albums_artists WHERE album_id = 2138"))
+	assert.Equal(t, []int{3010}, artists)
+	stats := Must(s.ArtistStats(ctx, 1))
+	assert.Len(t, stats, 3)
+
+	for _, test := range []struct {
+		csv string
+		err string
+	}{
+		{"Artist,Title\n", "missing column: Catalog#"},
+		{strings.Replace(exportCSV, ",2138,", ",x,", 1), `line 3: invalid release_id: "x"`},
+		{strings.Replace(exportCSV, "2022-10-11", "11/10/2022", 1), `line 2: invalid date added: "11/10/2022 12:41:04"`},
+	} {
+		_, err := importCSV(ctx, s, strings.NewReader(test.csv))
+		assert.EqualError(t, err, test.err)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// The local library ($MU) is laid out by mover, i.e.
+// <artist>/<title> (<year>)/NN <track>.<ext>. An album may also be split over
+// several directories (e.g. "<title> (<year>) [disc 2]"). Directories are
+// matched to the collection like scrobbles (see albumMatcher), so that albums
+// that are owned but not stored locally (or vice versa) can be found.
+
+type (
+	// libraryDir is an album directory of the library
+	libraryDir struct {
+		Path    string `json:"path" db:"path"`
+		Artist  string `json:"artist" db:"artist"`
+		Title   string `json:"title" db:"title"`
+		Year    int    `json:"year" db:"year"`         // 0 if not in the name
+		AlbumId int    `json:"album_id" db:"album_id"` // 0 if not matched
+	}
+
+	// yearMismatch is an album whose directory names another year than
+	// Discogs does. Discogs has the year of the pressing, so reissues are
+	// expected here.
+	yearMismatch struct {
+		Album
+		Path      string `json:"path"`
+		LocalYear int    `json:"local_year"`
+	}
+
+	libraryScan struct {
+		Dirs    int
+		Matched int // albums of the collection
+		Missing []Album
+		Unowned []libraryDir // not in the collection
+		Years   []yearMismatch
+	}
+)
+
+// librarian is implemented by stores that can keep the library of their user
+type librarian interface {
+	// replaceLibrary replaces the stored library with dirs
+	replaceLibrary(ctx context.Context, dirs []libraryDir) error
+}
+
+func (a Album) record() []string {
+	return []string{a.Artist, a.Title, strconv.Itoa(a.Year), strconv.Itoa(a.Rating)}
+}
+
+func (d libraryDir) record() []string {
+	return []string{d.Artist, d.Title, strconv.Itoa(d.Year), d.Path}
+}
+
+func (y yearMismatch) record() []string {
+	return []string{y.Artist, y.Title, strconv.Itoa(y.Year), strconv.Itoa(y.LocalYear), y.Path}
+}
+
+// e.g. "Loveless (1991)", "Loveless (1991) [disc 2]"
+var albumDirName = regexp.MustCompile(`^(.+) \((\d{4})\)(?:\s.*)?$`)
+
+// parseAlbumDir returns the title and year named by an album directory. Names
+// without a year are taken as the title.
+func parseAlbumDir(name string) (string, int) {
+	m := albumDirName.FindStringSubmatch(name)
+	if m == nil {
+		return name, 0
+	}
+	year, _ := strconv.Atoi(m[2])
+	return m[1], year
+}
+
+// scanLibrary lists the album directories of the library at root, i.e. the
+// directories two levels below it. Hidden directories are skipped.
+func scanLibrary(root string) ([]libraryDir, error) {
+	artists, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []libraryDir
+	for _, a := range artists {
+		if !a.IsDir() || strings.HasPrefix(a.Name(), ".") {
+			continue
+		}
+		albums, err := os.ReadDir(filepath.Join(root, a.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, alb := range albums {
+			if !alb.IsDir() || strings.HasPrefix(alb.Name(), ".") {
+				continue
+			}
+			title, year := parseAlbumDir(alb.Name())
+			dirs = append(dirs, libraryDir{
+				Path:   filepath.Join(root, a.Name(), alb.Name()),
+				Artist: a.Name(),
+				Title:  title,
+				Year:   year,
+			})
+		}
+	}
+	return dirs, nil
+}
+
+// reconcile scans the library at root, matches its directories to the
+// collection, and stores them.
+func reconcile(ctx context.Context, store Store, root string) (libraryScan, error) {
+	var res libraryScan
+	lib, ok := store.(librarian)
+	if !ok {
+		return res, fmt.Errorf("library: %w", errUnsupported)
+	}
+
+	dirs, err := scanLibrary(root)
+	if err != nil {
+		return res, err
+	}
+	albums, err := store.Albums(ctx, Filter{}, Page{})
+	if err != nil {
+		return res, err
+	}
+
+	byId := map[int]Album{}
+	for _, alb := range albums {
+		byId[alb.Id] = alb
+	}
+	m := newAlbumMatcher(albums)
+	found := map[int]bool{}
+	for i, d := range dirs {
+		id, ok := m.match(d.Artist, d.Title)
+		if !ok {
+			res.Unowned = append(res.Unowned, d)
+			continue
+		}
+		dirs[i].AlbumId = id
+		alb := byId[id]
+		// a split album is only reported once
+		if !found[id] && d.Year != 0 && alb.Year != 0 && d.Year != alb.Year {
+			res.Years = append(res.Years, yearMismatch{Album: alb, Path: d.Path, LocalYear: d.Year})
+		}
+		found[id] = true
+	}
+	for _, alb := range albums {
+		if !found[alb.Id] {
+			res.Missing = append(res.Missing, alb)
+		}
+	}
+	res.Dirs = len(dirs)
+	res.Matched = len(found)
+
+	if err := lib.replaceLibrary(ctx, dirs); err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// libraryReports are the reports of `disq library scan`
+var libraryReports = []string{"missing", "unowned", "year"}
+
+// libraryCmd runs `disq library` with the given args. The library is at
+// root (i.e. $MU).
+func libraryCmd(ctx context.Context, store Store, root string, args []string, w io.Writer) error {
+	if len(args) == 0 || args[0] != "scan" {
+		return errors.New("usage: disq library scan [flags]")
+	}
+	fs := flag.NewFlagSet("library scan", flag.ContinueOnError)
+	var (
+		which  = fs.String("report", "", "only print one report: "+strings.Join(libraryReports, ", "))
+		format = fs.String("format", "table", "output format: table, csv or json")
+	)
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *which != "" && !slices.Contains(libraryReports, *which) {
+		return fmt.Errorf("unknown report: %s", *which)
+	}
+	if *format == "csv" && *which == "" {
+		return errors.New("csv output requires -report")
+	}
+	if root == "" {
+		return errors.New("no library; set $MU")
+	}
+
+	res, err := reconcile(ctx, store, root)
+	if err != nil {
+		return err
+	}
+
+	var reports []report
+	for _, name := range libraryReports {
+		if *which != "" && name != *which {
+			continue
+		}
+		switch name {
+		case "missing":
+			// owned, but not stored locally
+			reports = append(reports, newReport(name, []string{"artist", "title", "year", "rating"}, res.Missing))
+		case "unowned":
+			// stored locally, but not owned
+			reports = append(reports, newReport(name, []string{"artist", "title", "year", "path"}, res.Unowned))
+		case "year":
+			reports = append(reports, newReport(name, []string{"artist", "title", "year", "local_year", "path"}, res.Years))
+		}
+	}
+	if *format == "table" {
+		fmt.Fprintf(w, "%d directories, %d albums matched\n\n", res.Dirs, res.Matched)
+	}
+	return writeReports(w, *format, reports)
+}
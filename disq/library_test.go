@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAlbumDir(t *testing.T) {
+	for name, expected := range map[string]struct {
+		title string
+		year  int
+	}{
+		"Loveless (1991)":                {"Loveless", 1991},
+		"Loveless (1991) [disc 2]":       {"Loveless", 1991},
+		"Live (Remastered) (2003)":       {"Live (Remastered)", 2003},
+		"Untitled":                       {"Untitled", 0},
+		"Music For 18 Musicians (Live)":  {"Music For 18 Musicians (Live)", 0},
+		"Symphony No. 9 (1824) (1963)":   {"Symphony No. 9 (1824)", 1963},
+		"The Köln Concert (1975) (Live)": {"The Köln Concert", 1975},
+	} {
+		title, year := parseAlbumDir(name)
+		assert.Equal(t, expected.title, title, name)
+		assert.Equal(t, expected.year, year, name)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	ctx := context.Background()
+	s := Must(openSqlite(":memory:"))
+	defer s.Close()
+
+	rel := func(id int, artist, title string, year int) Release {
+		r := newRelease(id, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+		r.BasicInfo.Artists = []Artist{{Id: id, Name: artist}}
+		r.BasicInfo.Title = title
+		r.BasicInfo.Year = year
+		return r
+	}
+	Must(s.InsertBatch(ctx, []Release{
+		rel(1, "My Bloody Valentine", "Loveless", 1991),
+		rel(2, "Keith Jarrett", "The Köln Concert", 1975),
+		rel(3, "Steve Reich", "Music For 18 Musicians", 1978),
+		rel(4, "Boards Of Canada", "Geogaddi", 2002),
+	}))
+
+	lib := t.TempDir()
+	for _, d := range []string{
+		"My Bloody Valentine/Loveless (1991)",
+		"My Bloody Valentine/Loveless (1991) [disc 2]",
+		"My Bloody Valentine/.stfolder",
+		"Keith Jarrett/The Koln Concert (1975)",
+		"Steve Reich/Music for 18 Musicians (1997)",
+		"Aphex Twin/Drukqs (2001)",
+	} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(lib, d), 0o755))
+	}
+	assert.NoError(t, os.WriteFile(filepath.Join(lib, "Steve Reich", "cover.jpg"), nil, 0o644))
+
+	res, err := reconcile(ctx, s, lib)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, res.Dirs)
+	assert.Equal(t, 3, res.Matched)
+	assert.Equal(t, []string{"Geogaddi"}, titles(res.Missing))
+	assert.Equal(
+		t,
+		[]libraryDir{{Path: filepath.Join(lib, "Aphex Twin/Drukqs (2001)"), Artist: "Aphex Twin", Title: "Drukqs", Year: 2001}},
+		res.Unowned,
+	)
+	assert.Len(t, res.Years, 1)
+	assert.Equal(t, 1978, res.Years[0].Year)
+	assert.Equal(t, 1997, res.Years[0].LocalYear)
+
+	var paths []string
+	assert.NoError(t, s.db.Select(&paths, "SELECT path FROM library WHERE album_id = 1 ORDER BY path"))
+	assert.Equal(t, []string{
+		filepath.Join(lib, "My Bloody Valentine/Loveless (1991)"),
+		filepath.Join(lib, "My Bloody Valentine/Loveless (1991) [disc 2]"),
+	}, paths)
+
+	// rescanning replaces
+	assert.NoError(t, os.RemoveAll(filepath.Join(lib, "Aphex Twin")))
+	_, err = reconcile(ctx, s, lib)
+	assert.NoError(t, err)
+	var n int
+	assert.NoError(t, s.db.Get(&n, "SELECT count(*) FROM library"))
+	assert.Equal(t, 4, n)
+
+	var b strings.Builder
+	assert.NoError(t, libraryCmd(ctx, s, lib, []string{"scan", "-report", "year", "-format", "csv"}, &b))
+	assert.Equal(
+		t,
+		"artist,title,year,local_year,path\nSteve Reich,Music For 18 Musicians,1978,1997,"+filepath.Join(lib, "Steve Reich/Music for 18 Musicians (1997)")+"\n",
+		b.String(),
+	)
+	assert.Error(t, libraryCmd(ctx, s, lib, []string{"scan", "-format", "csv"}, &b))
+	assert.Error(t, libraryCmd(ctx, s, "", []string{"scan"}, &b))
+	assert.Error(t, libraryCmd(ctx, s, lib, nil, &b))
+
+	// a user without a collection is added by their library
+	other := Must(s.ForUser(ctx, "other"))
+	_, err = reconcile(ctx, other, lib)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"", "other"}, Must(s.users(ctx)))
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Listening history can be imported from ListenBrainz or Last.fm exports. A
+// scrobble only names its album, which is matched to an album of the
+// collection as loosely as is safe (see albumMatcher). Unmatched listens are
+// kept, and matched again on every import.
+//
+// ListenBrainz: https://listenbrainz.org/settings/export/ (a json array, or
+// jsonl, of listens)
+//
+// Last.fm has no export of its own; user.getRecentTracks pages (as saved by
+// most export tools) are read, either one page or an array of them.
+// https://www.last.fm/api/show/user.getRecentTracks
+
+type (
+	// scrobble is a listen of a single track
+	scrobble struct {
+		ListenedAt int64  `db:"listened_at"` // unix seconds
+		Artist     string `db:"artist"`
+		Album      string `db:"album"` // empty if unknown
+		Track      string `db:"track"`
+		Source     string `db:"source"`
+	}
+
+	// listenedAlbum is an album, as named by scrobbles
+	listenedAlbum struct {
+		Artist string `db:"artist"`
+		Album  string `db:"album"`
+	}
+
+	// unmatchedAlbum is a listenedAlbum that is not in the collection
+	unmatchedAlbum struct {
+		listenedAlbum
+		Listens int `db:"listens"`
+	}
+
+	// ListenCount is an album of the collection, and how often it was listened
+	// to
+	ListenCount struct {
+		Id           int    `json:"id"`
+		Artist       string `json:"artist"`
+		Title        string `json:"title"`
+		Rating       int    `json:"rating"`
+		Listens      int    `json:"listens"`
+		LastListened int64  `json:"last_listened" db:"last_listened"` // unix seconds; 0 if never
+	}
+)
+
+const (
+	sourceListenBrainz = "listenbrainz"
+	sourceLastfm       = "lastfm"
+)
+
+// listener is implemented by stores that keep the listening history of their
+// user.
+type listener interface {
+	// insertListens stores listens, skipping those that are already stored,
+	// and returns the number of new ones
+	insertListens(ctx context.Context, ls []scrobble) (int, error)
+
+	// unmatchedListens lists the albums of listens that are not matched to
+	// an album of the collection, most listened first
+	unmatchedListens(ctx context.Context) ([]unmatchedAlbum, error)
+
+	// matchListens assigns listens of each listenedAlbum to an album id
+	matchListens(ctx context.Context, matches map[listenedAlbum]int) error
+
+	// albumListens counts the listens of each album of the collection that
+	// matches f, most listened first
+	albumListens(ctx context.Context, f Filter) ([]ListenCount, error)
+}
+
+func (l ListenCount) record() []string {
+	last := ""
+	if l.LastListened > 0 {
+		last = time.Unix(l.LastListened, 0).Format(time.DateOnly)
+	}
+	return []string{
+		l.Artist,
+		l.Title,
+		strconv.Itoa(l.Rating),
+		strconv.Itoa(l.Listens),
+		last,
+	}
+}
+
+// lbListen is a listen of a ListenBrainz export; fields that are not used are
+// omitted
+type lbListen struct {
+	ListenedAt    int64 `json:"listened_at"`
+	TrackMetadata struct {
+		ArtistName  string `json:"artist_name"`
+		TrackName   string `json:"track_name"`
+		ReleaseName string `json:"release_name"`
+	} `json:"track_metadata"`
+}
+
+// parseListenBrainz parses a json array of listens, or one listen per line
+func parseListenBrainz(b []byte) ([]scrobble, error) {
+	var lbs []lbListen
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("[")) {
+		if err := json.Unmarshal(b, &lbs); err != nil {
+			return nil, err
+		}
+	} else {
+		sc := bufio.NewScanner(bytes.NewReader(b))
+		sc.Buffer(nil, 1<<20) // listens may carry lots of metadata
+		for i := 1; sc.Scan(); i++ {
+			if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+				continue
+			}
+			var lb lbListen
+			if err := json.Unmarshal(sc.Bytes(), &lb); err != nil {
+				return nil, fmt.Errorf("line %d: %w", i, err)
+			}
+			lbs = append(lbs, lb)
+		}
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	var ls []scrobble
+	for _, lb := range lbs {
+		ls = append(ls, scrobble{
+			ListenedAt: lb.ListenedAt,
+			Artist:     lb.TrackMetadata.ArtistName,
+			Album:      lb.TrackMetadata.ReleaseName,
+			Track:      lb.TrackMetadata.TrackName,
+			Source:     sourceListenBrainz,
+		})
+	}
+	return ls, nil
+}
+
+type (
+	// lastfmText is a name, which is either #text, or name (with
+	// extended=1)
+	lastfmText struct {
+		Text string `json:"#text"`
+		Name string `json:"name"`
+	}
+
+	lastfmPage struct {
+		RecentTracks *lastfmPage `json:"recenttracks"`
+		Track        []struct {
+			Artist lastfmText `json:"artist"`
+			Album  lastfmText `json:"album"`
+			Name   string     `json:"name"`
+			Date   *struct {
+				Uts string `json:"uts"`
+			} `json:"date"` // nil if now playing
+		} `json:"track"`
+	}
+)
+
+func (t lastfmText) String() string {
+	if t.Text != "" {
+		return t.Text
+	}
+	return t.Name
+}
+
+// parseLastfm parses a page of recent tracks, or an array of pages. Pages may
+// be wrapped in {"recenttracks": ...}, as returned by the api. The track that
+// is playing (which has no date) is skipped.
+func parseLastfm(b []byte) ([]scrobble, error) {
+	var pages []lastfmPage
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("[")) {
+		if err := json.Unmarshal(b, &pages); err != nil {
+			return nil, err
+		}
+	} else {
+		var p lastfmPage
+		if err := json.Unmarshal(b, &p); err != nil {
+			return nil, err
+		}
+		pages = []lastfmPage{p}
+	}
+
+	var ls []scrobble
+	for _, p := range pages {
+		if p.RecentTracks != nil {
+			p = *p.RecentTracks
+		}
+		for _, t := range p.Track {
+			if t.Date == nil {
+				continue
+			}
+			uts, err := strconv.ParseInt(t.Date.Uts, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid date: %q", t.Date.Uts)
+			}
+			ls = append(ls, scrobble{
+				ListenedAt: uts,
+				Artist:     t.Artist.String(),
+				Album:      t.Album.String(),
+				Track:      t.Name,
+				Source:     sourceLastfm,
+			})
+		}
+	}
+	return ls, nil
+}
+
+// parseListens parses an export of the given format (listenbrainz or lastfm).
+// If format is empty, it is guessed from the export's keys.
+func parseListens(b []byte, format string) ([]scrobble, error) {
+	if format == "" {
+		switch {
+		case bytes.Contains(b, []byte(`"track_metadata"`)):
+			format = sourceListenBrainz
+		case bytes.Contains(b, []byte(`"track"`)):
+			format = sourceLastfm
+		default:
+			return nil, errors.New("unknown export format; set -format")
+		}
+	}
+	switch format {
+	case sourceListenBrainz:
+		return parseListenBrainz(b)
+	case sourceLastfm:
+		return parseLastfm(b)
+	default:
+		return nil, fmt.Errorf("unknown format: %s", format)
+	}
+}
+
+var (
+	// e.g. "(2)" (Discogs' disambiguation of artists), "(Remastered)",
+	// "[Deluxe Edition]"
+	bracketed = regexp.MustCompile(`\s*(\([^)]*\)|\[[^\]]*\])`)
+
+	// e.g. "Abbey Road - Remastered 2009", as named by streaming services
+	editionSuffix = regexp.MustCompile(`\s+-\s+[^-]*\b(remaster|remastered|edition|version|deluxe|expanded|anniversary|mono|stereo)\b[^-]*$`)
+
+	// Latin letters with diacritics are folded to their base letters, so
+	// that e.g. "Handel" matches "Händel". Scrobblers are inconsistent
+	// about diacritics (and so is Discogs).
+	foldDiacritics = func() *strings.Replacer {
+		var pairs []string
+		for base, letters := range map[string]string{
+			"a":  "àáâãäåāăą",
+			"c":  "çćĉċč",
+			"d":  "ďđð",
+			"e":  "èéêëēĕėęě",
+			"g":  "ĝğġģ",
+			"h":  "ĥħ",
+			"i":  "ìíîïĩīĭįı",
+			"j":  "ĵ",
+			"k":  "ķ",
+			"l":  "ĺļľŀł",
+			"n":  "ñńņňŉ",
+			"o":  "òóôõöøōŏő",
+			"r":  "ŕŗř",
+			"s":  "śŝşšș",
+			"t":  "ţťŧț",
+			"u":  "ùúûüũūŭůűų",
+			"w":  "ŵ",
+			"y":  "ýÿŷ",
+			"z":  "źżž",
+			"ae": "æ",
+			"oe": "œ",
+			"ss": "ß",
+			"th": "þ",
+		} {
+			for _, r := range letters {
+				pairs = append(pairs, string(r), base)
+			}
+		}
+		return strings.NewReplacer(pairs...)
+	}()
+)
+
+// matchWords normalises a name for matching, and splits it into words.
+// Bracketed parts and edition suffixes are dropped, unless nothing else is
+// left; so is a leading "the".
+func matchWords(s string) []string {
+	s = strings.ToLower(s)
+	if t := editionSuffix.ReplaceAllString(bracketed.ReplaceAllString(s, ""), ""); strings.TrimSpace(t) != "" {
+		s = t
+	}
+	s = foldDiacritics.Replace(s)
+	s = strings.ReplaceAll(s, "&", " and ")
+	words := strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	if len(words) > 1 && words[0] == "the" {
+		words = words[1:]
+	}
+	return words
+}
+
+// similarity is the share of words that a and b have in common, from 0 to 1
+// (Sørensen–Dice).
+func similarity(a []string, b []string) float64 {
+	if len(a)+len(b) == 0 {
+		return 0
+	}
+	seen := map[string]int{}
+	for _, w := range a {
+		seen[w]++
+	}
+	common := 0
+	for _, w := range b {
+		if seen[w] > 0 {
+			seen[w]--
+			common++
+		}
+	}
+	return 2 * float64(common) / float64(len(a)+len(b))
+}
+
+// contains reports whether all words of sub are in words
+func contains(words []string, sub []string) bool {
+	for _, w := range sub {
+		if !slices.Contains(words, w) {
+			return false
+		}
+	}
+	return true
+}
+
+// Minimum similarity of titles (and of artists that do not contain each
+// other) for a match. Titles that differ by one word in four still match.
+const minSimilarity = 0.75
+
+type (
+	matchAlbum struct {
+		id     int
+		artist []string
+		title  []string
+	}
+
+	// albumMatcher matches albums named elsewhere (e.g. by scrobbles, or
+	// by directories of the library) to albums of a collection
+	albumMatcher struct {
+		albums []matchAlbum
+		byWord map[string][]int // artist word -> indices into albums
+	}
+)
+
+func newAlbumMatcher(albums []Album) *albumMatcher {
+	m := &albumMatcher{byWord: map[string][]int{}}
+	for i, alb := range albums {
+		ma := matchAlbum{id: alb.Id, artist: matchWords(alb.Artist), title: matchWords(alb.Title)}
+		m.albums = append(m.albums, ma)
+		for _, w := range ma.artist {
+			if idx := m.byWord[w]; len(idx) == 0 || idx[len(idx)-1] != i {
+				m.byWord[w] = append(idx, i)
+			}
+		}
+	}
+	return m
+}
+
+// match returns the id of the album with the most similar title, among those
+// whose artist is similar (or contains, or is contained by, the given artist;
+// Album.Artist joins all artists, and scrobblers often name only one).
+func (m *albumMatcher) match(artist string, title string) (int, bool) {
+	aw, tw := matchWords(artist), matchWords(title)
+	if len(aw) == 0 || len(tw) == 0 {
+		return 0, false
+	}
+
+	var candidates []int
+	for _, w := range aw {
+		candidates = append(candidates, m.byWord[w]...)
+	}
+	sort.Ints(candidates) // ties go to the first album
+
+	best, bestScore := 0, 0.0
+	for i, c := range candidates {
+		if i > 0 && c == candidates[i-1] {
+			continue
+		}
+		alb := m.albums[c]
+		if !contains(alb.artist, aw) && !contains(aw, alb.artist) &&
+			similarity(alb.artist, aw) < minSimilarity {
+			continue
+		}
+		if score := similarity(alb.title, tw); score > bestScore {
+			best, bestScore = alb.id, score
+		}
+	}
+	return best, bestScore >= minSimilarity
+}
+
+type listenImport struct {
+	Listens   int // in the export
+	New       int // not already stored
+	Matched   int // albums newly matched to the collection
+	Unmatched []unmatchedAlbum
+}
+
+// importListens stores the listens of an export, then matches all unmatched
+// listens (including those of earlier imports) to the collection.
+func importListens(ctx context.Context, store Store, r io.Reader, format string) (listenImport, error) {
+	var res listenImport
+	l, ok := store.(listener)
+	if !ok {
+		return res, fmt.Errorf("listens: %w", errUnsupported)
+	}
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return res, err
+	}
+	ls, err := parseListens(b, format)
+	if err != nil {
+		return res, err
+	}
+	res.Listens = len(ls)
+	if res.New, err = l.insertListens(ctx, ls); err != nil {
+		return res, err
+	}
+
+	albums, err := store.Albums(ctx, Filter{}, Page{})
+	if err != nil {
+		return res, err
+	}
+	unmatched, err := l.unmatchedListens(ctx)
+	if err != nil {
+		return res, err
+	}
+	m := newAlbumMatcher(albums)
+	matches := map[listenedAlbum]int{}
+	for _, u := range unmatched {
+		if id, ok := m.match(u.Artist, u.Album); ok {
+			matches[u.listenedAlbum] = id
+		} else if u.Album != "" {
+			res.Unmatched = append(res.Unmatched, u)
+		}
+	}
+	if err := l.matchListens(ctx, matches); err != nil {
+		return res, err
+	}
+	res.Matched = len(matches)
+	return res, nil
+}
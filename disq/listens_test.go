@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// abridged exports
+const (
+	listenBrainzJSONL = `{"listened_at": 1700000000, "track_metadata": {"artist_name": "Georg Friedrich Handel", "track_name": "Hallelujah", "release_name": "Messiah (Remastered)", "additional_info": {"duration_ms": 230000}}}
+
+{"listened_at": 1700000300, "track_metadata": {"artist_name": "The Beatles", "track_name": "Come Together", "release_name": "Abbey Road - Remastered 2009"}}
+{"listened_at": 1700000600, "track_metadata": {"artist_name": "Unknown", "track_name": "Untitled"}}
+`
+
+	lastfmPages = `[{"recenttracks": {"track": [
+		{"artist": {"#text": "The Beatles"}, "album": {"#text": "Abbey Road"}, "name": "Something", "@attr": {"nowplaying": "true"}},
+		{"artist": {"#text": "The Beatles"}, "album": {"#text": "Abbey Road"}, "name": "Come Together", "date": {"uts": "1700000300"}},
+		{"artist": {"#text": "The Beatles"}, "album": {"#text": "Abbey Road"}, "name": "Here Comes The Sun", "date": {"uts": "1700000500"}},
+		{"artist": {"#text": "Boards of Canada"}, "album": {"#text": "Geogaddi"}, "name": "Julie and Candy", "date": {"uts": "1700000900"}}
+	]}}, {"track": [
+		{"artist": {"name": "The Beatles"}, "album": {"#text": "Let It Be"}, "name": "Let It Be", "date": {"uts": "1700001200"}}
+	]}]`
+)
+
+func TestParseListens(t *testing.T) {
+	ls, err := parseListens([]byte(listenBrainzJSONL), "")
+	assert.NoError(t, err)
+	assert.Equal(
+		t,
+		scrobble{ListenedAt: 1700000000, Artist: "Georg Friedrich Handel", Album: "Messiah (Remastered)", Track: "Hallelujah", Source: sourceListenBrainz},
+		ls[0],
+	)
+	assert.Len(t, ls, 3)
+
+	ls, err = parseListens([]byte(`[{"listened_at": 1, "track_metadata": {}}, {"listened_at": 2, "track_metadata": {}}]`), "")
+	assert.NoError(t, err)
+	assert.Len(t, ls, 2)
+
+	ls, err = parseListens([]byte(lastfmPages), "")
+	assert.NoError(t, err)
+	assert.Equal(
+		t,
+		[]scrobble{
+			{ListenedAt: 1700000300, Artist: "The Beatles", Album: "Abbey Road", Track: "Come Together", Source: sourceLastfm},
+			{ListenedAt: 1700000500, Artist: "The Beatles", Album: "Abbey Road", Track: "Here Comes The Sun", Source: sourceLastfm},
+			{ListenedAt: 1700000900, Artist: "Boards of Canada", Album: "Geogaddi", Track: "Julie and Candy", Source: sourceLastfm},
+			{ListenedAt: 1700001200, Artist: "The Beatles", Album: "Let It Be", Track: "Let It Be", Source: sourceLastfm},
+		},
+		ls,
+	)
+
+	_, err = parseListens([]byte(`{"foo": 1}`), "")
+	assert.Error(t, err)
+	_, err = parseListens([]byte(lastfmPages), "spotify")
+	assert.Error(t, err)
+}
+
+func TestMatchWords(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		expected []string
+	}{
+		{"The Beatles", []string{"beatles"}},
+		{"The The", []string{"the"}},
+		{"Händel", []string{"handel"}},
+		{"Dvořák", []string{"dvorak"}},
+		{"Simon & Garfunkel", []string{"simon", "and", "garfunkel"}},
+		{"Prince (2)", []string{"prince"}},
+		{"Abbey Road - Remastered 2009", []string{"abbey", "road"}},
+		{"Loveless [Deluxe Edition]", []string{"loveless"}},
+		{"Help! - Live", []string{"help", "live"}},
+		// lossy, but the same on both sides
+		{"(What's The Story) Morning Glory?", []string{"morning", "glory"}},
+		{"(I)", []string{"i"}},
+	} {
+		assert.Equal(t, test.expected, matchWords(test.name), test.name)
+	}
+}
+
+func TestAlbumMatcher(t *testing.T) {
+	m := newAlbumMatcher([]Album{
+		{Id: 1, Artist: "Georg Friedrich Händel", Title: "Messiah"},
+		{Id: 2, Artist: "The Beatles", Title: "Abbey Road"},
+		{Id: 3, Artist: "The Beatles", Title: "Let It Be"},
+		{Id: 4, Artist: "The Beatles", Title: "Let It Be... Naked"},
+		{Id: 5, Artist: "Simon & Garfunkel", Title: "Bookends"},
+		{Id: 6, Artist: "Boards Of Canada", Title: "Music Has The Right To Children"},
+	})
+	for _, test := range []struct {
+		artist   string
+		album    string
+		expected int // 0 if unmatched
+	}{
+		{"Handel", "Messiah (Remastered)", 1},
+		{"Georg Friedrich Handel", "MESSIAH", 1},
+		{"Beatles", "Abbey Road - Remastered 2009", 2},
+		{"The Beatles", "Let It Be", 3},
+		{"The Beatles", "Let It Be... Naked (Remastered)", 4},
+		{"Simon and Garfunkel", "Bookends", 5},
+		{"Boards of Canada", "Music Has the Right to Children", 6},
+		{"Boards of Canada", "Geogaddi", 0},
+		{"The Rolling Stones", "Let It Bleed", 0},
+		{"Bach", "Messiah", 0},
+		{"The Beatles", "", 0},
+	} {
+		id, ok := m.match(test.artist, test.album)
+		assert.Equal(t, test.expected != 0, ok, test.album)
+		if ok {
+			assert.Equal(t, test.expected, id, test.album)
+		}
+	}
+}
+
+func TestImportListens(t *testing.T) {
+	ctx := context.Background()
+	s := Must(openSqlite(":memory:"))
+	defer s.Close()
+
+	rel := func(id int, artist string, title string, rating int) Release {
+		r := newRelease(id, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+		r.BasicInfo.Artists = []Artist{{Id: int(artist[0]), Name: artist}}
+		r.BasicInfo.Title = title
+		r.Rating = rating
+		return r
+	}
+	Must(s.InsertBatch(ctx, []Release{
+		rel(1, "Georg Friedrich Händel", "Messiah", 4),
+		rel(2, "The Beatles", "Abbey Road", 5),
+		rel(3, "The Beatles", "Let It Be", 3),
+		rel(4, "Boards Of Canada", "Geogaddi", 5),
+	}))
+
+	res, err := importListens(ctx, s, strings.NewReader(listenBrainzJSONL), "")
+	assert.NoError(t, err)
+	assert.Equal(t, listenImport{Listens: 3, New: 3, Matched: 2}, res)
+
+	// listens of both services overlap (Come Together); Abbey Road is
+	// named differently, and thus matched again
+	res, err = importListens(ctx, s, strings.NewReader(lastfmPages), sourceLastfm)
+	assert.NoError(t, err)
+	assert.Equal(t, listenImport{Listens: 4, New: 3, Matched: 3}, res)
+
+	// duplicates, by the same track at the same time
+	res, err = importListens(ctx, s, strings.NewReader(lastfmPages), "")
+	assert.NoError(t, err)
+	assert.Equal(t, listenImport{Listens: 4}, res)
+
+	counts := map[string]int{}
+	for _, l := range Must(s.albumListens(ctx, Filter{})) {
+		counts[l.Title] = l.Listens
+	}
+	assert.Equal(t, map[string]int{"Abbey Road": 2, "Messiah": 1, "Let It Be": 1, "Geogaddi": 1}, counts)
+
+	// unmatched listens are matched once the album is added
+	_, err = importListens(ctx, s, strings.NewReader(`[{"listened_at": 1700002000, "track_metadata": {"artist_name": "Stereolab", "track_name": "Metronomic Underground", "release_name": "Emperor Tomato Ketchup"}}]`), "")
+	assert.NoError(t, err)
+	assert.Equal(t, []unmatchedAlbum{{listenedAlbum{"Stereolab", "Emperor Tomato Ketchup"}, 1}}, Must(s.unmatchedListens(ctx))[:1])
+	Must(s.InsertBatch(ctx, []Release{rel(5, "Stereolab", "Emperor Tomato Ketchup", 0)}))
+	res, err = importListens(ctx, s, strings.NewReader("[]"), sourceListenBrainz)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, res.Matched)
+
+	// without an album, a listen can never be matched, and is not reported
+	assert.Nil(t, res.Unmatched)
+	assert.Len(t, Must(s.unmatchedListens(ctx)), 1)
+
+	// listens count as plays for random picks
+	cands := Must(query[candidate](ctx, s, withFilter(_select_random), s.filterArgs(Filter{})...))
+	for _, c := range cands {
+		if c.Id == 2 {
+			assert.Equal(t, int64(1700000500), c.LastPlayed)
+		}
+		if c.Id == 1 {
+			assert.Equal(t, int64(1700000000), c.LastPlayed)
+		}
+	}
+
+	var b strings.Builder
+	assert.NoError(t, stats(ctx, s, []string{"-report", "listens", "-format", "csv"}, &b))
+	lines := strings.Split(b.String(), "\n")
+	assert.Equal(t, "artist,title,rating,listens,last_listened", lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], "The Beatles,Abbey Road,5,2,"), lines[1])
+	assert.Len(t, lines, 7) // header, 5 albums, trailing newline
+
+	// listens are per user
+	other := Must(s.ForUser(ctx, "other"))
+	assert.Empty(t, Must(other.(listener).unmatchedListens(ctx)))
+
+	// a user without a collection is added by their listens
+	_, err = importListens(ctx, other, strings.NewReader(listenBrainzJSONL), "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"", "other"}, Must(s.users(ctx)))
+}
@@ -7,13 +7,25 @@
 //
 // A more sophisticated program would enable interactive browsing and filtering
 // of the collection, abstracting away complex logic with sql queries.
+//
+// Search needs sqlite's fts5, which go-sqlite3 only compiles with a build tag
+// (see fts5.go):
+//
+//	go build -tags sqlite_fts5
+//	go test -tags sqlite_fts5 ./...
 
 package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
 )
 
 // an exercise to work with data via:
@@ -30,74 +42,300 @@ import (
 // 3. https://github.com/ywelsch/duckdb-prql?tab=readme-ov-file#running-the-extension
 // 4. https://gorm.io/docs/connecting_to_the_database.html#SQLite
 
-// TODO: integrate with youtube, mpv
-
 var (
-	useSqlite     = flag.Bool("sqlite", false, "use sqlite")
-	useClickhouse = flag.Bool("clickhouse", false, "use clickhouse")
-	user          = flag.String("dump", "", "dump collection of <user>")
+	_              = flag.Bool("sqlite", true, "use sqlite (default)")
+	useClickhouse  = flag.Bool("clickhouse", false, "use clickhouse instead of sqlite (needs running server instance)")
+	clickhouseAddr = flag.String("clickhouse-addr", "localhost:9000", "address of the clickhouse server")
+	user           = flag.String("dump", "", "dump collection of <user>")
+	selectUser     = flag.String("user", "", "use the collection of <user> (default: the only one stored)")
+	random         = flag.Int("random", 0, "print <n> random albums")
+	genre          = flag.String("genre", "", "only pick albums of <genre>")
+	style          = flag.String("style", "", "only pick albums of <style>")
+	label          = flag.String("label", "", "only pick albums released on <label>")
+	fullSync       = flag.Bool("full", false, "with -dump, refetch the entire collection, and remove sold releases")
+	masters        = flag.Bool("masters", false, "only pick the highest-rated pressing of each master release")
 )
 
+// play skips albums that cannot be played, but gives up after this many in a
+// row, as every album is recorded as a pick
+const maxSkipped = 5
+
 func init() {
+	flag.IntVar(&artistCooldown, "cooldown", artistCooldown, "random picks: do not pick an artist again within <n> picks")
+}
+
+func openStore() (Store, error) {
+	if *useClickhouse {
+		return openClickhouse(*clickhouseAddr)
+	}
+	return openDefaultSqlite() // TODO: wrap in Once
+}
+
+// connectStore connects to the backend without migrating it
+func connectStore() (migrator, error) {
+	if *useClickhouse {
+		return connectClickhouse(*clickhouseAddr)
+	}
+	return connectSqlite(defaultSqlitePath())
+}
+
+// fail reports an error, and exits
+func fail(err error) {
+	if errors.Is(err, context.Canceled) {
+		// all committed work is kept; e.g. a sync resumes from the
+		// interrupted page
+		err = errors.New("interrupted")
+	}
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
 }
 
 func main() {
 	flag.Parse()
 
-	switch {
-	case *user != "":
+	// Ctrl-C cancels whatever is running, rolling back its current
+	// transaction. A second Ctrl-C kills the program.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	err := run(ctx)
+	stop()
+	if err != nil {
+		fail(err)
+	}
+}
+
+// run runs the command given by the args and flags. Whatever it opens (e.g.
+// the store) is closed before it returns, as fail exits without running
+// deferred calls.
+func run(ctx context.Context) error {
+	if flag.Arg(0) == "migrate" {
+		// opening the store would apply any pending migrations, which
+		// --status must only list
+		m, err := connectStore()
+		if err != nil {
+			return err
+		}
+		defer m.Close()
+		return migrateCmd(ctx, m, flag.Args()[1:], os.Stdout)
+	}
+
+	if flag.Arg(0) == "sync" {
+		// e.g. disq sync --to clickhouse
+		if *useClickhouse {
+			return errors.New("sync copies from sqlite; omit -clickhouse")
+		}
+		src, err := openDefaultSqlite()
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		return syncCmd(ctx, src, flag.Args()[1:], os.Stdout)
+	}
+
+	opened, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer opened.Close()
+
+	if flag.Arg(0) == "" && *user != "" {
+		// the stored user need not (and, once there are several,
+		// cannot) be chosen with -user
 		fmt.Println("dumping", *user)
-		init_sqlite() // TODO: wrap in Once
-		defer s.db.Close()
-		// init_clickhouse() // needs running server instance
-		// defer ch.db.Close()
-		dumpDB(*user)
+		if a, ok := opened.(adopter); ok {
+			adopted, err := a.adoptUser(ctx, *user)
+			if err != nil {
+				return err
+			}
+			if adopted {
+				fmt.Println("adopted the existing collection")
+			}
+		}
+		store, err := opened.ForUser(ctx, *user)
+		if err != nil {
+			return err
+		}
+		if err := dumpDB(ctx, store, *user, *fullSync); err != nil {
+			return err
+		}
 		fmt.Println("done")
-		return
-
-	case *useSqlite:
-		init_sqlite()
-		defer s.db.Close()
+		return nil
+	}
 
-		// fmt.Println(s.RandomAlbum())
-		// fmt.Println(s.RandomAlbumFromArtist("Metallica"))
-		fmt.Println(s.AllAlbumsFromArtist("aespa"))
+	store, err := opened.ForUser(ctx, *selectUser)
+	if err != nil {
+		return err
+	}
 
-	case *useClickhouse:
-		init_clickhouse()
-		defer ch.db.Close()
+	switch {
+	case flag.Arg(0) == "tui":
+		// all filtering shall be done via sql
+		if _, err := tea.NewProgram(newModel(ctx, store, newDefaultPlayer()), tea.WithAltScreen()).Run(); err != nil {
+			return err
+		}
 
-		var row []SimpleRow
-		err := ch.db.Select(
-			context.Background(),
-			&row,
-			"SELECT title, artist_name FROM albums ORDER BY rand() LIMIT 1",
+	case flag.Arg(0) == "import":
+		// no token needed. the export does not say whose collection it
+		// is
+		if *selectUser == "" {
+			return errors.New("import requires -user")
+		}
+		f, err := os.Open(flag.Arg(1))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		changes, err := importCSV(ctx, store, f)
+		counts := map[change]int{}
+		for _, c := range changes {
+			counts[c]++
+		}
+		fmt.Printf(
+			"imported %d releases: added %d, changed %d\n",
+			len(changes),
+			counts[albumAdded],
+			counts[albumChanged],
 		)
 		if err != nil {
-			panic(err)
+			return err
 		}
-		fmt.Println(row)
 
-		err = ch.db.Select(
-			context.Background(),
-			&row,
-			"SELECT title, artist_name FROM albums WHERE artist_name = ? ORDER BY rand() LIMIT 1",
-			"Metallica",
+	case flag.Arg(0) == "listens":
+		// e.g. disq listens -format lastfm recenttracks.json
+		fs := flag.NewFlagSet("listens", flag.ContinueOnError)
+		format := fs.String("format", "", "format of the export: listenbrainz or lastfm (default: guessed)")
+		if err := fs.Parse(flag.Args()[1:]); err != nil {
+			return err
+		}
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		res, err := importListens(ctx, store, f, *format)
+		if err != nil {
+			return err
+		}
+		fmt.Printf(
+			"imported %d listens (%d new), matched %d albums\n",
+			res.Listens,
+			res.New,
+			res.Matched,
 		)
+		// the most listened are the most worth fixing (or buying)
+		for _, u := range res.Unmatched[:min(10, len(res.Unmatched))] {
+			fmt.Printf("unmatched: %s - %s (%d listens)\n", u.Artist, u.Album, u.Listens)
+		}
+
+	case flag.Arg(0) == "enrich":
+		fs := flag.NewFlagSet("enrich", flag.ContinueOnError)
+		n := fs.Int("n", 0, "only fetch details of <n> albums (default all)")
+		if err := fs.Parse(flag.Args()[1:]); err != nil {
+			return err
+		}
+		token, err := readToken()
 		if err != nil {
-			panic(err)
+			return err
+		}
+		covers, err := defaultCoverCache()
+		if err != nil {
+			return err
+		}
+		res, err := enrich(ctx, newDiscogsClient(token), store, covers, *n)
+		fmt.Printf("fetched details of %d albums\n", res.Fetched)
+		for _, err := range res.Failed {
+			fmt.Fprintln(os.Stderr, "skipped:", err)
+		}
+		for _, err := range res.NoCover {
+			fmt.Fprintln(os.Stderr, "no cover:", err)
+		}
+		if err != nil {
+			// rerunning resumes with the failed album
+			return err
+		}
+
+	case flag.Arg(0) == "search":
+		// e.g. disq search handel messiah
+		albums, err := store.Search(ctx, strings.Join(flag.Args()[1:], " "))
+		if err != nil {
+			return err
+		}
+		for _, alb := range albums {
+			fmt.Printf("%s - %s (%d)\n", alb.Artist, alb.Title, alb.Year)
+		}
+
+	case flag.Arg(0) == "stats":
+		if err := stats(ctx, store, flag.Args()[1:], os.Stdout); err != nil {
+			return err
+		}
+
+	case flag.Arg(0) == "export":
+		// e.g. disq export -format m3u -year 1990-1999 -rating 5 > 90s.m3u
+		missing, err := export(ctx, store, os.Getenv("MU"), flag.Args()[1:], os.Stdout)
+		if err != nil {
+			return err
+		}
+		for _, alb := range missing {
+			fmt.Fprintf(os.Stderr, "not in library: %s - %s\n", alb.Artist, alb.Title)
+		}
+
+	case flag.Arg(0) == "library":
+		if err := libraryCmd(ctx, store, os.Getenv("MU"), flag.Args()[1:], os.Stdout); err != nil {
+			return err
+		}
+
+	case flag.Arg(0) == "play":
+		// play random albums until interrupted
+		f := Filter{Genre: *genre, Style: *style, Label: *label, GroupMasters: *masters}
+		player := newDefaultPlayer()
+		skipped := 0
+		for ctx.Err() == nil {
+			alb, err := store.RandomAlbum(ctx, f, 1)
+			if err != nil {
+				return err
+			}
+			if len(alb) == 0 {
+				return errors.New("no albums to play")
+			}
+			fmt.Println(alb[0].Artist, "-", alb[0].Title)
+			err = player.Play(alb[0].Artist, alb[0].Title)
+			if errors.Is(err, errUnplayable) && skipped < maxSkipped {
+				// e.g. not in the library, and not on youtube
+				fmt.Println(err)
+				skipped++
+				continue
+			} else if err != nil {
+				// e.g. mpv is missing, or nothing was found for
+				// several albums (probably because we are offline)
+				return err
+			}
+			skipped = 0
+			if err := store.RecordPlay(ctx, alb[0].Id); err != nil {
+				return err
+			}
+			player.Wait()
+		}
+
+	case *random > 0:
+		f := Filter{Genre: *genre, Style: *style, Label: *label, GroupMasters: *masters}
+		albums, err := store.RandomAlbum(ctx, f, *random)
+		if err != nil {
+			return err
+		}
+		for _, alb := range albums {
+			fmt.Println(alb.Artist, "-", alb.Title)
 		}
-		fmt.Println(row)
 
 	default:
-		listen()
+		if err := listen(ctx, store, newDefaultPlayer()); err != nil {
+			return err
+		}
 	}
 
-	// m := model{table: sqlToTable(`SELECT * FROM collection`)}
-	// // all filtering shall be done via sql
-	// if _, err := tea.NewProgram(&m).Run(); err != nil {
-	// 	panic(err)
-	// }
+	return nil
 
 	// s.aggArtistRating()
 	// // TODO: https://github.com/rodaine/table?tab=readme-ov-file#usage
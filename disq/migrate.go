@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"flag"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Schemas are changed by numbered migrations (queries/migrations/<backend>/),
+// which are applied in order whenever a store is opened. Each db records the
+// migrations it has had applied in its schema_version table. Released
+// migrations must never be edited; any change requires a new one.
+
+//go:embed queries/migrations
+var migrationFiles embed.FS
+
+type (
+	migration struct {
+		Version int
+		Name    string
+		sql     string
+	}
+
+	migrationStatus struct {
+		migration
+		AppliedAt time.Time // zero if pending
+	}
+)
+
+var (
+	sqliteMigrations     = loadMigrations("sqlite")
+	clickhouseMigrations = loadMigrations("clickhouse")
+)
+
+// e.g. 0001_init.sql
+var migrationFile = regexp.MustCompile(`^(\d+)_(\w+)\.sql$`)
+
+// loadMigrations reads the migrations of a backend, oldest first. Versions
+// must be consecutive, starting at 1.
+func loadMigrations(backend string) []migration {
+	dir := path.Join("queries/migrations", backend)
+	entries, err := migrationFiles.ReadDir(dir) // sorted by name
+	if err != nil {
+		panic(err)
+	}
+	var ms []migration
+	for _, e := range entries {
+		m := migrationFile.FindStringSubmatch(e.Name())
+		if m == nil {
+			panic("invalid migration file name: " + e.Name())
+		}
+		if v, _ := strconv.Atoi(m[1]); v != len(ms)+1 {
+			panic(fmt.Sprintf("migration %s: expected version %d", e.Name(), len(ms)+1))
+		}
+		b, err := migrationFiles.ReadFile(path.Join(dir, e.Name()))
+		if err != nil {
+			panic(err)
+		}
+		ms = append(ms, migration{Version: len(ms) + 1, Name: m[2], sql: string(b)})
+	}
+	return ms
+}
+
+// a ; at the end of a line
+var statementEnd = regexp.MustCompile(`;[ \t]*(\n|$)`)
+
+func (m migration) String() string { return fmt.Sprintf("%04d_%s", m.Version, m.Name) }
+
+// statements splits a migration into single statements, for drivers that can
+// only execute one at a time. A statement ends with a ; at the end of a line.
+func (m migration) statements() []string {
+	var stmts []string
+	for _, s := range statementEnd.Split(m.sql, -1) {
+		// skip pieces that are only comments
+		for _, line := range strings.Split(s, "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "--") {
+				stmts = append(stmts, strings.TrimSpace(s))
+				break
+			}
+		}
+	}
+	return stmts
+}
+
+// migrationStatuses pairs migrations with the time they were applied
+func migrationStatuses(ms []migration, applied map[int]time.Time) []migrationStatus {
+	var st []migrationStatus
+	for _, m := range ms {
+		st = append(st, migrationStatus{migration: m, AppliedAt: applied[m.Version]})
+	}
+	return st
+}
+
+// checkVersions fails if the db was migrated by a newer version of disq, whose
+// schema is unknown
+func checkVersions(ms []migration, applied map[int]time.Time) error {
+	for v := range applied {
+		if v > len(ms) {
+			return fmt.Errorf("db is at schema version %d, but only %d is known; update disq", v, len(ms))
+		}
+	}
+	return nil
+}
+
+// migrator is implemented by stores whose schema is versioned. A db created
+// before migrations existed is assumed to have the initial schema.
+type migrator interface {
+	migrationStatus(ctx context.Context) ([]migrationStatus, error)
+
+	// migrate applies all pending migrations, in order, and returns those
+	// that were applied, even if a later one failed
+	migrate(ctx context.Context) ([]migration, error)
+
+	Close() error
+}
+
+// migrateCmd runs `disq migrate` with the given args.
+func migrateCmd(ctx context.Context, m migrator, args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	status := fs.Bool("status", false, "list migrations, and when they were applied, without applying any")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *status {
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		sts, err := m.migrationStatus(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(tw, "version\tname\tapplied")
+		for _, st := range sts {
+			applied := "pending"
+			if !st.AppliedAt.IsZero() {
+				applied = st.AppliedAt.Local().Format(time.DateTime)
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\n", st.Version, st.Name, applied)
+		}
+		return tw.Flush()
+	}
+
+	applied, err := m.migrate(ctx)
+	for _, a := range applied {
+		fmt.Fprintln(w, "applied", a)
+	}
+	if err == nil && len(applied) == 0 {
+		fmt.Fprintln(w, "up to date")
+	}
+	return err
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrationStatements(t *testing.T) {
+	m := migration{sql: `-- comment; not a statement
+CREATE TABLE a (
+    x UInt8 -- 0 to 5
+);
+
+INSERT INTO a VALUES (';');
+-- trailing comment
+`}
+	assert.Equal(
+		t,
+		[]string{
+			"-- comment; not a statement\nCREATE TABLE a (\n    x UInt8 -- 0 to 5\n)",
+			"INSERT INTO a VALUES (';')",
+		},
+		m.statements(),
+	)
+
+	for _, ms := range [][]migration{sqliteMigrations, clickhouseMigrations} {
+		for i, m := range ms {
+			assert.Equal(t, i+1, m.Version)
+			assert.NotEmpty(t, m.statements(), m)
+		}
+	}
+}
+
+func TestSqliteMigrate(t *testing.T) {
+	ctx := context.Background()
+	// a db created before migrations existed
+	s := Must(connectSqlite(":memory:"))
+	defer s.Close()
+	s.db.MustExec(sqliteMigrations[0].sql)
+	s.db.MustExec("INSERT INTO albums (id, title, year, rating, date_added) VALUES (1, 'Alpha', 1990, 4, 0)")
+	s.db.MustExec("INSERT INTO artists (id, name) VALUES (1, 'Artist A')")
+	s.db.MustExec("INSERT INTO albums_artists (album_id, artist_id) VALUES (1, 1)")
+
+	var b strings.Builder
+	assert.NoError(t, migrateCmd(ctx, s, []string{"--status"}, &b))
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	assert.Len(t, lines, len(sqliteMigrations)+1)
+	assert.NotContains(t, lines[1], "pending")
+	assert.Contains(t, lines[2], "pending")
+
+	b.Reset()
+	assert.NoError(t, migrateCmd(ctx, s, nil, &b))
+	assert.Equal(t, len(sqliteMigrations)-1, strings.Count(b.String(), "applied"))
+	assert.False(t, Must(s.migrationStatus(ctx))[len(sqliteMigrations)-1].AppliedAt.IsZero())
+
+	// existing albums belong to the only user
+	assert.Equal(
+		t,
+		[]Album{{Id: 1, Title: "Alpha", Artist: "Artist A", Year: 1990, Rating: 4}},
+		Must(Must(s.ForUser(ctx, "")).Albums(ctx, Filter{}, Page{})),
+	)
+
+	// which, having never been synced, is '', until a user is synced
+	assert.Equal(t, []string{""}, Must(s.users(ctx)))
+	assert.True(t, Must(s.adoptUser(ctx, "hejops")))
+	assert.Equal(t, []string{"hejops"}, Must(s.users(ctx)))
+	assert.Equal(t, 1, Must(Must(s.ForUser(ctx, "")).CountAlbums(ctx, Filter{})))
+	assert.Equal(t, 1, Must(Must(s.ForUser(ctx, "hejops")).CountAlbums(ctx, Filter{})))
+	assert.False(t, Must(s.adoptUser(ctx, "alice")))
+
+	b.Reset()
+	assert.NoError(t, migrateCmd(ctx, s, nil, &b))
+	assert.Equal(t, "up to date\n", b.String())
+
+	s.db.MustExec("INSERT INTO schema_version VALUES (?, 'future', 0)", len(sqliteMigrations)+1)
+	_, err := s.migrate(ctx)
+	assert.Error(t, err)
+
+	// reported, rather than panicking
+	_, err = openSqlite(filepath.Join(t.TempDir(), "missing", "collection2.db"))
+	assert.Error(t, err)
+}
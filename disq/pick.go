@@ -0,0 +1,98 @@
+package main
+
+import (
+	"cmp"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"time"
+)
+
+// Random picks are weighted, so that they favour albums that are rated highly,
+// and that have not been suggested (or played) recently. Every pick is
+// recorded in the plays table.
+
+// Albums suggested or played within this period are less likely to be
+// picked; the weight recovers linearly over the period.
+const recoveryPeriod = 30 * 24 * time.Hour
+
+// An artist is not picked again until this many other albums have been
+// suggested or played (including by previous calls), unless no other artist
+// can be picked (e.g. with -artist). Set by -cooldown.
+var artistCooldown = 10
+
+// stubbed in tests
+var randFloat = rand.Float64
+
+const (
+	playSuggested = "suggested"
+	playPlayed    = "played"
+)
+
+// candidate is an album that may be picked
+type candidate struct {
+	Album
+	LastPlayed int64 `db:"last_played"` // played, suggested or scrobbled; unix seconds; 0 if never
+
+	// all credited artists, so that a collaboration is cooled down with
+	// each of its artists
+	ArtistIds    []int  `db:"-"`
+	ArtistIdsStr string `db:"artist_ids"` // ","-delimited
+}
+
+// weight is proportional to the chance of an album being picked. A 5 is
+// about 3 times as likely as a 3.
+func (c candidate) weight(t time.Time) float64 {
+	w := float64(c.Rating * c.Rating)
+	if c.LastPlayed > 0 {
+		since := t.Sub(time.Unix(c.LastPlayed, 0))
+		w *= min(1, max(since, time.Minute).Seconds()/recoveryPeriod.Seconds())
+	}
+	return w
+}
+
+// pickWeighted picks up to n candidates without replacement, skipping the
+// artists (by id) in recent, and those already picked. If recent would leave
+// nothing to pick, it is ignored.
+//
+// Each candidate is assigned the key u^(1/w), where u is uniformly random; the
+// candidates with the largest keys are a weighted sample.
+//
+// https://en.wikipedia.org/wiki/Reservoir_sampling#Algorithm_A-Res
+func pickWeighted(cands []candidate, n int, recent []int) []Album {
+	t := now()
+	keys := make(map[int]float64, len(cands))
+	for _, c := range cands {
+		keys[c.Id] = math.Pow(randFloat(), 1/c.weight(t))
+	}
+	cands = slices.Clone(cands)
+	slices.SortFunc(cands, func(a, b candidate) int {
+		return cmp.Compare(keys[b.Id], keys[a.Id])
+	})
+
+	pick := func(recent []int) []Album {
+		seen := map[int]bool{}
+		for _, a := range recent {
+			seen[a] = true
+		}
+		var picked []Album
+		for _, c := range cands {
+			if len(picked) == n {
+				break
+			}
+			if slices.ContainsFunc(c.ArtistIds, func(a int) bool { return seen[a] }) {
+				continue
+			}
+			for _, a := range c.ArtistIds {
+				seen[a] = true
+			}
+			picked = append(picked, c.Album)
+		}
+		return picked
+	}
+	picked := pick(recent)
+	if len(picked) == 0 {
+		picked = pick(nil)
+	}
+	return picked
+}
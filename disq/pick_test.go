@@ -0,0 +1,64 @@
+package main
+
+import (
+	"math/rand/v2"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPickWeighted(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	defer func(f func() time.Time) { now = f }(now)
+	now = func() time.Time { return t0 }
+	defer func(f func() float64) { randFloat = f }(randFloat)
+	randFloat = rand.New(rand.NewPCG(1, 2)).Float64
+
+	// artists are named by letter, and identified by it
+	cand := func(id int, artist string, rating int, lastPlayed time.Duration) candidate {
+		c := candidate{Album: Album{Id: id, Title: artist, Artist: artist, Rating: rating}}
+		for _, a := range strings.Split(artist, ", ") {
+			c.ArtistIds = append(c.ArtistIds, int(a[0]))
+		}
+		if lastPlayed > 0 {
+			c.LastPlayed = t0.Add(-lastPlayed).Unix()
+		}
+		return c
+	}
+
+	assert.Equal(t, 25.0, cand(1, "A", 5, 0).weight(t0))
+	assert.Equal(t, 25.0, cand(1, "A", 5, 2*recoveryPeriod).weight(t0))
+	assert.Equal(t, 12.5, cand(1, "A", 5, recoveryPeriod/2).weight(t0))
+	assert.Greater(t, cand(1, "A", 5, time.Second).weight(t0), 0.0)
+
+	cands := []candidate{
+		cand(1, "A", 5, 0),
+		cand(2, "B", 3, 0),
+		cand(3, "C", 5, recoveryPeriod/10),
+	}
+	counts := map[string]int{}
+	for range 10000 {
+		for _, alb := range pickWeighted(cands, 1, nil) {
+			counts[alb.Artist]++
+		}
+	}
+	// 25 : 9 : 2.5
+	assert.InDelta(t, 6600, counts["A"], 300)
+	assert.InDelta(t, 2400, counts["B"], 300)
+	assert.InDelta(t, 660, counts["C"], 300)
+
+	assert.Len(t, pickWeighted(cands, 10, nil), 3)
+	assert.Equal(t, []string{"B"}, titles(pickWeighted(cands, 10, []int{'A', 'C'})))
+	// rather than nothing, e.g. when filtered by artist
+	assert.Len(t, pickWeighted(cands, 10, []int{'A', 'B', 'C'}), 3)
+
+	// one album per artist, including collaborations
+	cands = append(cands, cand(4, "A", 5, 0), cand(5, "A", 5, 0), cand(6, "C, D", 5, 0))
+	assert.Len(t, pickWeighted(cands, 10, nil), 3)
+	for range 100 {
+		assert.ElementsMatch(t, []string{"B", "C"}, titles(pickWeighted(cands, 10, []int{'A', 'D'})))
+	}
+	assert.Empty(t, pickWeighted(nil, 1, nil))
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resolver finds an online source (e.g. a playlist url) that mpv can play for
+// an album.
+type Resolver interface {
+	Resolve(artist, title string) (string, error)
+}
+
+// errUnplayable is returned by Play if the album is neither in the library nor
+// found by the resolver. Unlike e.g. a missing mpv, this is specific to the
+// album, so the next album may well be playable.
+var errUnplayable = errors.New("cannot be played")
+
+// Player plays albums with mpv, preferring the local library over the
+// resolver. Only one album is played at a time; mpv is controlled via its
+// JSON IPC socket.
+//
+// https://mpv.io/manual/stable/#json-ipc
+type Player struct {
+	library  string // root of the local library ($MU); may be empty
+	resolver Resolver
+	socket   string
+	mpv      string // executable
+
+	mu   sync.Mutex
+	cmd  *exec.Cmd
+	done chan struct{} // closed when cmd exits
+}
+
+func newPlayer(library string, resolver Resolver) *Player {
+	return &Player{
+		library:  library,
+		resolver: resolver,
+		socket:   filepath.Join(os.TempDir(), fmt.Sprintf("disq-mpv-%d.sock", os.Getpid())),
+		mpv:      "mpv",
+	}
+}
+
+// newDefaultPlayer plays from the library at $MU, falling back to YouTube Music
+func newDefaultPlayer() *Player {
+	return newPlayer(os.Getenv("MU"), newYtmResolver())
+}
+
+// localDirs returns the album's directories in the library, i.e.
+// $MU/<artist>/<title>*. The suffix is usually the year, but an album may also
+// be split over several directories (e.g. per disc).
+//
+// artist is all of the album's artists (see Album), but an album with several
+// is usually filed under the first, i.e. a directory whose name is followed by
+// a space in artist.
+func localDirs(library, artist, title string) []string {
+	if library == "" {
+		return nil
+	}
+	artists, err := os.ReadDir(library)
+	if err != nil {
+		return nil
+	}
+	var dirs []string
+	for _, a := range artists {
+		if !a.IsDir() || (a.Name() != artist && !strings.HasPrefix(artist, a.Name()+" ")) {
+			continue
+		}
+		dir := filepath.Join(library, a.Name())
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			if e.IsDir() && strings.HasPrefix(e.Name(), title) {
+				dirs = append(dirs, filepath.Join(dir, e.Name()))
+			}
+		}
+	}
+	return dirs
+}
+
+// source returns the args that make mpv play the album.
+func (p *Player) source(artist, title string) ([]string, error) {
+	if dirs := localDirs(p.library, artist, title); len(dirs) > 0 {
+		return dirs, nil
+	}
+	if p.resolver == nil {
+		return nil, fmt.Errorf("%s - %s: %w: not in library", artist, title, errUnplayable)
+	}
+	url, err := p.resolver.Resolve(artist, title)
+	if err != nil {
+		return nil, fmt.Errorf("%s - %s: %w: %w", artist, title, errUnplayable, err)
+	}
+	return []string{url}, nil
+}
+
+// Play stops whatever is playing, and starts playing the album in the
+// background.
+func (p *Player) Play(artist, title string) error {
+	src, err := p.source(artist, title)
+	if err != nil {
+		return err
+	}
+
+	_ = p.Stop()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	args := append([]string{
+		"--no-video",
+		"--no-audio-display",
+		"--mute=no",
+		"--pause=no",
+		"--start=0%",
+		"--input-ipc-server=" + p.socket,
+	}, src...)
+	cmd := exec.Command(p.mpv, args...)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	p.cmd, p.done = cmd, done
+	go func() {
+		_ = cmd.Wait()
+		p.mu.Lock()
+		if p.cmd == cmd {
+			p.cmd = nil
+		}
+		p.mu.Unlock()
+		close(done)
+	}()
+	return nil
+}
+
+// Wait blocks until mpv exits, i.e. the album has finished or was stopped.
+func (p *Player) Wait() {
+	p.mu.Lock()
+	done := p.done
+	p.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// command sends a command to mpv, and waits for its reply.
+func (p *Player) command(args ...any) error {
+	conn, err := net.DialTimeout("unix", p.socket, time.Second)
+	if err != nil {
+		return fmt.Errorf("mpv not running: %w", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	if err := json.NewEncoder(conn).Encode(map[string]any{"command": args}); err != nil {
+		return err
+	}
+
+	sc := bufio.NewScanner(conn)
+	for sc.Scan() {
+		var resp struct {
+			Error string
+			Event string
+		}
+		if err := json.Unmarshal(sc.Bytes(), &resp); err != nil {
+			return err
+		}
+		if resp.Event != "" { // events are sent to every client
+			continue
+		}
+		if resp.Error != "success" {
+			return fmt.Errorf("mpv: %s", resp.Error)
+		}
+		return nil
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return io.ErrUnexpectedEOF
+}
+
+func (p *Player) Next() error { return p.command("playlist-next") }
+
+func (p *Player) Prev() error { return p.command("playlist-prev") }
+
+func (p *Player) TogglePause() error { return p.command("cycle", "pause") }
+
+// Stop quits mpv, killing it if it does not respond (or take too long), and
+// waits for it to exit. An exiting mpv removes its socket, so the next one must
+// not be started before then, or its socket would be removed.
+func (p *Player) Stop() error {
+	err := p.command("quit")
+
+	p.mu.Lock()
+	cmd, done := p.cmd, p.done
+	p.mu.Unlock()
+	if cmd == nil {
+		return err
+	}
+	if err != nil {
+		err = cmd.Process.Kill()
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		err = cmd.Process.Kill()
+		<-done
+	}
+	return err
+}
+
+// ytmResolver finds the playlist of an album on YouTube Music, via the
+// (undocumented) api of the web client.
+type ytmResolver struct {
+	base   string
+	client *http.Client
+}
+
+func newYtmResolver() ytmResolver {
+	return ytmResolver{
+		base:   "https://music.youtube.com",
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+var (
+	// album ids start with MPREb_
+	ytmBrowseId   = regexp.MustCompile(`"(MP[^"]+)"`)
+	ytmPlaylistId = regexp.MustCompile(`"playlistId":\s*"([^"]+)"`)
+)
+
+func (y ytmResolver) post(endpoint string, body map[string]any) ([]byte, error) {
+	body["context"] = map[string]any{
+		"client": map[string]string{
+			"clientName":    "WEB_REMIX",
+			"clientVersion": "1.20240904.01.01",
+		},
+	}
+	// restricts search results to albums
+	body["params"] = "EgWKAQIIAWoSEAMQBBAJEA4QChAFEBEQEBAV"
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := y.client.Post(y.base+endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", endpoint, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (y ytmResolver) Resolve(artist, title string) (string, error) {
+	b, err := y.post("/youtubei/v1/search", map[string]any{"query": artist + " " + title})
+	if err != nil {
+		return "", err
+	}
+	m := ytmBrowseId.FindSubmatch(b)
+	if m == nil {
+		return "", errors.New("not found on youtube music")
+	}
+
+	b, err = y.post("/youtubei/v1/browse", map[string]any{"browseId": string(m[1])})
+	if err != nil {
+		return "", err
+	}
+	m = ytmPlaylistId.FindSubmatch(b)
+	if m == nil {
+		return "", errors.New("no playlist on youtube music")
+	}
+
+	return y.base + "/watch?list=" + string(m[1]), nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeResolver map[string]string
+
+func (f fakeResolver) Resolve(artist, title string) (string, error) {
+	if url, ok := f[artist+" - "+title]; ok {
+		return url, nil
+	}
+	return "", fmt.Errorf("not found")
+}
+
+func TestPlayerSource(t *testing.T) {
+	lib := t.TempDir()
+	for _, d := range []string{
+		"Artist A/Alpha (1990)",
+		"Artist A/Alpha (1990) [disc 2]",
+		"Artist A/Alphabet (2000)",
+		"Artist A/Beta (1985)",
+		"Artist D/Epsilon (2001)",
+	} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(lib, d), 0o755))
+	}
+	assert.NoError(t, os.WriteFile(filepath.Join(lib, "Artist A", "Beta.txt"), nil, 0o644))
+
+	p := newPlayer(lib, fakeResolver{"Artist B - Gamma": "https://example.com/gamma"})
+
+	for _, test := range []struct {
+		artist, title string
+		expected      []string
+	}{
+		{"Artist A", "Alpha (", []string{
+			filepath.Join(lib, "Artist A/Alpha (1990)"),
+			filepath.Join(lib, "Artist A/Alpha (1990) [disc 2]"),
+		}},
+		{"Artist A", "Beta", []string{filepath.Join(lib, "Artist A/Beta (1985)")}},
+		{"Artist B", "Gamma", []string{"https://example.com/gamma"}},
+		{"Artist C", "Delta", nil},
+		// filed under the first of several artists
+		{"Artist D Artist E", "Epsilon", []string{filepath.Join(lib, "Artist D/Epsilon (2001)")}},
+		{"Artist", "Epsilon", nil},
+	} {
+		src, err := p.source(test.artist, test.title)
+		assert.Equal(t, test.expected, src, test)
+		assert.Equal(t, test.expected == nil, errors.Is(err, errUnplayable), test)
+	}
+
+	p = newPlayer("", nil)
+	_, err := p.source("Artist A", "Beta")
+	assert.ErrorIs(t, err, errUnplayable)
+
+	// unlike a missing mpv
+	p = newPlayer(lib, nil)
+	p.mpv = filepath.Join(lib, "mpv")
+	err = p.Play("Artist A", "Beta")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, errUnplayable)
+}
+
+// fakeMpv listens on a socket like mpv does, recording the commands it
+// receives. Every reply is preceded by an event, which must be skipped.
+func fakeMpv(t *testing.T, socket string) *[][]any {
+	l, err := net.Listen("unix", socket)
+	assert.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	var received [][]any
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			var req struct{ Command []any }
+			if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&req); err == nil {
+				received = append(received, req.Command)
+				reply := "success"
+				if req.Command[0] == "playlist-prev" {
+					reply = "error running command"
+				}
+				fmt.Fprintln(conn, `{"event":"pause"}`)
+				fmt.Fprintf(conn, `{"data":null,"request_id":0,"error":%q}`+"\n", reply)
+			}
+			conn.Close()
+		}
+	}()
+	return &received
+}
+
+func TestPlayerCommand(t *testing.T) {
+	p := newPlayer("", nil)
+	p.socket = filepath.Join(t.TempDir(), "mpv.sock")
+
+	assert.Error(t, p.Next()) // not running
+
+	received := fakeMpv(t, p.socket)
+	assert.NoError(t, p.TogglePause())
+	assert.NoError(t, p.Next())
+	assert.EqualError(t, p.Prev(), "mpv: error running command")
+	assert.NoError(t, p.Stop())
+	assert.Equal(
+		t,
+		[][]any{{"cycle", "pause"}, {"playlist-next"}, {"playlist-prev"}, {"quit"}},
+		*received,
+	)
+}
+
+func TestPlayerStop(t *testing.T) {
+	lib := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(lib, "Artist A/Alpha (1990)"), 0o755))
+	p := newPlayer(lib, nil)
+	p.socket = filepath.Join(lib, "mpv.sock")
+	// an mpv that does not listen on the socket
+	p.mpv = filepath.Join(lib, "mpv")
+	assert.NoError(t, os.WriteFile(p.mpv, []byte("#!/bin/sh\nexec sleep 10\n"), 0o755))
+
+	assert.NoError(t, p.Play("Artist A", "Alpha"))
+	assert.NoError(t, p.Stop())
+	select {
+	case <-p.done:
+	default:
+		t.Error("mpv still running")
+	}
+	assert.Nil(t, p.cmd)
+}
+
+func TestYtmResolver(t *testing.T) {
+	var queries []map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		queries = append(queries, body)
+		switch r.URL.Path {
+		case "/youtubei/v1/search":
+			if body["query"] == "Artist A Alpha" {
+				fmt.Fprintln(w, `{"contents": {"browseEndpoint": {"browseId": "MPREb_alpha"}}}`)
+			} else {
+				fmt.Fprintln(w, `{"contents": {}}`)
+			}
+		case "/youtubei/v1/browse":
+			fmt.Fprintln(w, `{"watchEndpoint": {"playlistId": "OLAK5uy_alpha"}}`)
+		}
+	}))
+	defer srv.Close()
+
+	y := ytmResolver{base: srv.URL, client: srv.Client()}
+
+	url, err := y.Resolve("Artist A", "Alpha")
+	assert.NoError(t, err)
+	assert.Equal(t, srv.URL+"/watch?list=OLAK5uy_alpha", url)
+	assert.Equal(t, "MPREb_alpha", queries[1]["browseId"])
+
+	_, err = y.Resolve("Artist B", "Gamma")
+	assert.Error(t, err)
+}
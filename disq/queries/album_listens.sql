@@ -0,0 +1,21 @@
+-- number of listens of each album of :user, most listened first
+SELECT
+    albums.id,
+    (
+        SELECT group_concat(artists.name, ' ')
+        FROM albums_artists
+        INNER JOIN artists ON albums_artists.artist_id = artists.id
+        WHERE albums_artists.album_id = albums.id
+    ) AS artist,
+    albums.title,
+    collection.rating,
+    count(listens.album_id) AS listens,
+    ifnull(max(listens.listened_at), 0) AS last_listened
+FROM albums
+INNER JOIN collection
+    ON albums.id = collection.album_id AND collection.user = :user
+LEFT JOIN listens
+    ON albums.id = listens.album_id AND listens.user = :user
+WHERE albums.id IN (SELECT filtered.id FROM filtered)
+GROUP BY albums.id
+ORDER BY listens DESC, collection.rating DESC, artist ASC, albums.title ASC
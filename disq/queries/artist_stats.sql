@@ -0,0 +1,15 @@
+SELECT
+    artists.name AS artist,
+    count(*) AS albums,
+    avg(collection.rating) AS avg_rating
+FROM artists
+INNER JOIN albums_artists
+    ON artists.id = albums_artists.artist_id
+INNER JOIN albums
+    ON albums_artists.album_id = albums.id
+INNER JOIN collection
+    ON albums.id = collection.album_id AND collection.user = :user
+WHERE collection.deleted_at IS NULL
+GROUP BY artists.id
+HAVING count(*) >= :min_albums
+ORDER BY avg_rating DESC, artist ASC
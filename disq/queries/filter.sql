@@ -0,0 +1,54 @@
+-- ids of the albums of :user that match a Filter, for use as a CTE. Empty
+-- params ('' or 0) match everything.
+SELECT albums.id
+FROM albums
+INNER JOIN collection
+    ON albums.id = collection.album_id AND collection.user = :user
+WHERE
+    collection.deleted_at IS NULL
+    AND collection.rating >= :min_rating
+    AND (:year_min = 0 OR albums.year >= :year_min)
+    AND (:year_max = 0 OR albums.year <= :year_max)
+    -- one album per master release: the highest-rated pressing (the oldest
+    -- one, by id, if tied). albums without a master represent themselves.
+    AND (:group_masters = 0 OR albums.id IN (
+        SELECT ranked.id
+        FROM (
+            SELECT
+                a.id,
+                row_number() OVER (
+                    PARTITION BY
+                        CASE WHEN a.master_id > 0 THEN a.master_id ELSE -a.id END
+                    ORDER BY c.rating DESC, a.id ASC
+                ) AS rn
+            FROM albums AS a
+            INNER JOIN collection AS c
+                ON a.id = c.album_id AND c.user = :user
+            WHERE c.deleted_at IS NULL
+        ) AS ranked
+        WHERE ranked.rn = 1
+    ))
+    AND (:title = '' OR albums.title LIKE '%' || :title || '%')
+    -- full-text search (see ftsQuery)
+    AND (:query = '' OR albums.id IN (
+        SELECT album_search.rowid FROM album_search
+        WHERE album_search MATCH :query
+    ))
+    AND (:artist = '' OR albums.id IN (
+        SELECT albums_artists.album_id FROM albums_artists
+        INNER JOIN artists ON albums_artists.artist_id = artists.id
+        WHERE artists.name LIKE '%' || :artist || '%'
+    ))
+    AND (:genre = '' OR albums.id IN (
+        SELECT genres.album_id FROM genres
+        WHERE genres.name = :genre COLLATE NOCASE
+    ))
+    AND (:style = '' OR albums.id IN (
+        SELECT styles.album_id FROM styles
+        WHERE styles.name = :style COLLATE NOCASE
+    ))
+    AND (:label = '' OR albums.id IN (
+        SELECT albums_labels.album_id FROM albums_labels
+        INNER JOIN labels ON albums_labels.label_id = labels.id
+        WHERE labels.name = :label COLLATE NOCASE
+    ))
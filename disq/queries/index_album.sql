@@ -0,0 +1,26 @@
+-- (re)indexes album :id for full-text search; the old row must be deleted
+-- first
+INSERT INTO album_search (rowid, artist, title, label, notes)
+SELECT
+    albums.id,
+    (
+        SELECT group_concat(artists.name, ' ')
+        FROM albums_artists
+        INNER JOIN artists ON albums_artists.artist_id = artists.id
+        WHERE albums_artists.album_id = albums.id
+    ),
+    albums.title,
+    (
+        -- a label appears once per catalog number
+        SELECT group_concat(labels.name, ' ')
+        FROM albums_labels
+        INNER JOIN labels ON albums_labels.label_id = labels.id
+        WHERE albums_labels.album_id = albums.id
+    ),
+    (
+        SELECT release_details.notes
+        FROM release_details
+        WHERE release_details.album_id = albums.id
+    )
+FROM albums
+WHERE albums.id = :id
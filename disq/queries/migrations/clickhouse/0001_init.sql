@@ -0,0 +1,32 @@
+-- the schema from before migrations existed
+
+-- Select columns which align with your common filters. If a column is used
+-- frequently in WHERE clauses, prioritize including these in your key over
+-- those which are used less frequently. Prefer columns which help exclude a
+-- large percentage of the total rows when filtered, thus reducing the amount
+-- of data which needs to be read.
+--
+-- Prefer columns which are likely to be highly correlated with other columns
+-- in the table. This will help ensure these values are also stored
+-- contiguously, improving compression. GROUP BY and ORDER BY operations for
+-- columns in the ordering key can be made more memory efficient.
+--
+-- https://clickhouse.com/docs/en/data-modeling/schema-design#choosing-an-ordering-key
+
+-- clickhouse does not support foreign keys at all. it also discourages
+-- normalised tables and joins
+--
+-- https://clickhouse.com/docs/en/migrations/bigquery#primary-and-foreign-keys-and-primary-index
+CREATE TABLE albums (
+    album_id UInt32 NOT NULL,
+    artist_id UInt32 NOT NULL,
+    artist_name String NOT NULL,
+    title String NOT NULL,
+    date_added DateTime NOT NULL,
+    year UInt32,
+    rating UInt8 -- 0 to 5
+)
+-- https://clickhouse.com/docs/en/guides/developer/deduplication#using-replacingmergetree-for-upserts
+ENGINE = ReplacingMergeTree
+-- TODO: investigate query speed with different primary key(s)
+PRIMARY KEY (artist_name, rating, album_id);
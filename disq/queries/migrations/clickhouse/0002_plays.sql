@@ -0,0 +1,8 @@
+-- append-only, so a plain MergeTree suffices
+CREATE TABLE plays (
+    album_id UInt32 NOT NULL,
+    played_at DateTime64(3) NOT NULL,
+    kind LowCardinality(String) NOT NULL -- suggested or played
+)
+ENGINE = MergeTree
+ORDER BY played_at;
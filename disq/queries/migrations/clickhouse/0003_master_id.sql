@@ -0,0 +1,2 @@
+-- shared by pressings; 0 if none
+ALTER TABLE albums ADD COLUMN master_id UInt32 DEFAULT 0;
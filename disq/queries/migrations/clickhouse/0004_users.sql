@@ -0,0 +1,36 @@
+-- rows are denormalised, so albums owned by several users are stored once per
+-- user. existing rows are owned by the user ''.
+--
+-- columns cannot be prepended to the primary key, so the table is rebuilt
+CREATE TABLE albums_users (
+    user LowCardinality(String) NOT NULL, -- whose collection
+    album_id UInt32 NOT NULL,
+    artist_id UInt32 NOT NULL,
+    artist_name String NOT NULL,
+    title String NOT NULL,
+    date_added DateTime NOT NULL,
+    year UInt32,
+    rating UInt8, -- 0 to 5
+    master_id UInt32 DEFAULT 0 -- shared by pressings; 0 if none
+)
+ENGINE = ReplacingMergeTree
+PRIMARY KEY (user, artist_name, rating, album_id);
+
+INSERT INTO albums_users
+SELECT
+    '' AS user,
+    album_id,
+    artist_id,
+    artist_name,
+    title,
+    date_added,
+    year,
+    rating,
+    master_id
+FROM albums FINAL;
+
+RENAME TABLE albums TO albums_old, albums_users TO albums;
+
+DROP TABLE albums_old;
+
+ALTER TABLE plays ADD COLUMN user LowCardinality(String) DEFAULT '' FIRST;
@@ -0,0 +1,46 @@
+-- all artists of an album, rather than only the first, so that e.g. V/A
+-- releases are not mangled; artist_name joins them, like Album.Artist does.
+-- genres, styles and labels are stored too, so that every Filter is
+-- supported.
+--
+-- rows are deduplicated by the sorting key, which included the rating, so a
+-- rerated album was stored twice. the table is rebuilt with a key of only the
+-- user and album.
+CREATE TABLE albums_arrays (
+    user LowCardinality(String) NOT NULL, -- whose collection
+    album_id UInt32 NOT NULL,
+    artist_ids Array(UInt32),
+    artists Array(String),
+    artist_name String NOT NULL, -- artists, " "-delimited
+    title String NOT NULL,
+    date_added DateTime NOT NULL,
+    year UInt32,
+    rating UInt8, -- 0 to 5
+    master_id UInt32 DEFAULT 0, -- shared by pressings; 0 if none
+    genres Array(String),
+    styles Array(String),
+    labels Array(String)
+)
+ENGINE = ReplacingMergeTree
+ORDER BY (user, album_id);
+
+INSERT INTO albums_arrays
+SELECT
+    user,
+    album_id,
+    [artist_id] AS artist_ids,
+    [artist_name] AS artists,
+    artist_name,
+    title,
+    date_added,
+    year,
+    rating,
+    master_id,
+    [] AS genres,
+    [] AS styles,
+    [] AS labels
+FROM albums FINAL;
+
+RENAME TABLE albums TO albums_old, albums_arrays TO albums;
+
+DROP TABLE albums_old;
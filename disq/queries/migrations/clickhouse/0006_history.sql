@@ -0,0 +1,33 @@
+-- plays and listens are copied from sqlite (see copyCollection), so that
+-- random picks are weighted as they are there. plays may be copied more than
+-- once, so identical plays are deduplicated; the engine of a table cannot be
+-- changed, so it is rebuilt.
+CREATE TABLE plays_dedup (
+    user LowCardinality(String) NOT NULL,
+    album_id UInt32 NOT NULL,
+    played_at DateTime64(3) NOT NULL,
+    kind LowCardinality(String) NOT NULL -- suggested or played
+)
+ENGINE = ReplacingMergeTree
+ORDER BY (user, played_at, album_id, kind);
+
+INSERT INTO plays_dedup
+SELECT
+    user,
+    album_id,
+    played_at,
+    kind
+FROM plays;
+
+RENAME TABLE plays TO plays_old, plays_dedup TO plays;
+
+DROP TABLE plays_old;
+
+-- the last listen of each album. listens are only imported into sqlite.
+CREATE TABLE listens (
+    user LowCardinality(String) NOT NULL,
+    album_id UInt32 NOT NULL,
+    listened_at DateTime NOT NULL
+)
+ENGINE = ReplacingMergeTree(listened_at)
+ORDER BY (user, album_id);
@@ -1,4 +1,5 @@
-CREATE TABLE IF NOT EXISTS albums (
+-- the schema from before migrations existed
+CREATE TABLE albums (
     id INTEGER,
     title TEXT NOT NULL,
     year INTEGER,
@@ -7,19 +8,17 @@ CREATE TABLE IF NOT EXISTS albums (
     PRIMARY KEY (id)
 );
 
-CREATE TABLE IF NOT EXISTS artists (
+CREATE TABLE artists (
     id INTEGER,
     name TEXT NOT NULL,
     PRIMARY KEY (id)
 );
 
 -- M:M
-CREATE TABLE IF NOT EXISTS albums_artists (
+CREATE TABLE albums_artists (
     album_id INTEGER,
     artist_id INTEGER,
     PRIMARY KEY (album_id, artist_id),
     FOREIGN KEY (album_id) REFERENCES albums (id),
     FOREIGN KEY (artist_id) REFERENCES artists (id)
 );
-
--- album <- genre (weak?)
@@ -0,0 +1,14 @@
+ALTER TABLE albums ADD COLUMN instance_id INTEGER; -- collection item
+ALTER TABLE albums ADD COLUMN synced_at INTEGER; -- unix seconds
+-- unix seconds; set once removed from the collection
+ALTER TABLE albums ADD COLUMN deleted_at INTEGER;
+
+-- checkpoint of a collection sync, so that an interrupted sync can be resumed
+CREATE TABLE sync_state (
+    user TEXT,
+    page INTEGER NOT NULL DEFAULT 0, -- last committed page; 0 when idle
+    started INTEGER NOT NULL DEFAULT 0, -- start of this run, or the resumed one
+    newest INTEGER NOT NULL DEFAULT 0, -- max date_added seen in this run
+    last_added INTEGER NOT NULL DEFAULT 0, -- max date_added of last full run
+    PRIMARY KEY (user)
+);
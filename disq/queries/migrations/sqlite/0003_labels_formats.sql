@@ -0,0 +1,44 @@
+CREATE TABLE labels (
+    id INTEGER,
+    name TEXT NOT NULL,
+    PRIMARY KEY (id)
+);
+
+-- M:M; a release may have several catalog numbers on one label
+CREATE TABLE albums_labels (
+    album_id INTEGER,
+    label_id INTEGER,
+    catno TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (album_id, label_id, catno),
+    FOREIGN KEY (album_id) REFERENCES albums (id),
+    FOREIGN KEY (label_id) REFERENCES labels (id)
+);
+
+-- album <- genre (weak); Discogs has a fixed, small set of genres and styles,
+-- and no ids for them
+CREATE TABLE genres (
+    album_id INTEGER,
+    name TEXT NOT NULL,
+    PRIMARY KEY (album_id, name),
+    FOREIGN KEY (album_id) REFERENCES albums (id)
+);
+
+CREATE TABLE styles (
+    album_id INTEGER,
+    name TEXT NOT NULL,
+    PRIMARY KEY (album_id, name),
+    FOREIGN KEY (album_id) REFERENCES albums (id)
+);
+
+-- album <- format (weak); e.g. 2 x Vinyl (LP, Album) + 1 x CD (Album)
+CREATE TABLE formats (
+    album_id INTEGER,
+    position INTEGER, -- order within the release
+    name TEXT NOT NULL, -- Vinyl, CD, File, ...
+    qty INTEGER NOT NULL DEFAULT 1,
+    descriptions TEXT NOT NULL DEFAULT '', -- ", "-delimited
+    text TEXT NOT NULL DEFAULT '', -- free text, e.g. colour of vinyl
+    PRIMARY KEY (album_id, position),
+    FOREIGN KEY (album_id) REFERENCES albums (id)
+);
+
@@ -0,0 +1,11 @@
+-- history of random picks, used to weight (and exclude) albums that were
+-- picked recently
+CREATE TABLE plays (
+    id INTEGER PRIMARY KEY, -- order of insertion
+    album_id INTEGER NOT NULL,
+    played_at INTEGER NOT NULL, -- unix seconds
+    kind TEXT NOT NULL, -- suggested or played
+    FOREIGN KEY (album_id) REFERENCES albums (id)
+);
+
+CREATE INDEX plays_album_id ON plays (album_id);
@@ -0,0 +1,31 @@
+-- from the release endpoint, which is fetched separately (see enrich)
+CREATE TABLE release_details (
+    album_id INTEGER,
+    notes TEXT NOT NULL DEFAULT '',
+    cover TEXT NOT NULL DEFAULT '', -- file name in the cover cache; '' if none
+    fetched_at INTEGER NOT NULL, -- unix seconds
+    PRIMARY KEY (album_id),
+    FOREIGN KEY (album_id) REFERENCES albums (id)
+);
+
+CREATE TABLE tracks (
+    album_id INTEGER,
+    position INTEGER, -- order within the release
+    number TEXT NOT NULL DEFAULT '', -- as printed, e.g. A1
+    title TEXT NOT NULL,
+    duration INTEGER NOT NULL DEFAULT 0, -- seconds; 0 if unknown
+    PRIMARY KEY (album_id, position),
+    FOREIGN KEY (album_id) REFERENCES albums (id)
+);
+
+CREATE TABLE credits (
+    album_id INTEGER,
+    position INTEGER, -- order within the release
+    artist_id INTEGER,
+    name TEXT NOT NULL,
+    role TEXT NOT NULL DEFAULT '',
+    tracks TEXT NOT NULL DEFAULT '', -- e.g. A1 to A3; '' for the whole release
+    PRIMARY KEY (album_id, position),
+    FOREIGN KEY (album_id) REFERENCES albums (id)
+);
+
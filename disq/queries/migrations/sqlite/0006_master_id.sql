@@ -0,0 +1,2 @@
+-- shared by pressings; 0 if none
+ALTER TABLE albums ADD COLUMN master_id INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,48 @@
+-- collections of several users. albums keeps the data of the release; what
+-- differs between users moves to collection. existing rows are owned by the
+-- user that was synced, if only one was, and by the user '' otherwise.
+
+CREATE TABLE users (
+    name TEXT,
+    added_at INTEGER NOT NULL, -- unix seconds
+    PRIMARY KEY (name)
+);
+
+-- M:M; which user owns which album
+CREATE TABLE collection (
+    user TEXT,
+    album_id INTEGER,
+    rating INTEGER, -- 0 to 5
+    date_added INTEGER NOT NULL, -- unix seconds
+    instance_id INTEGER, -- collection item; a release may be owned twice
+    synced_at INTEGER, -- unix seconds
+    deleted_at INTEGER, -- unix seconds; set once removed from the collection
+    PRIMARY KEY (user, album_id),
+    FOREIGN KEY (user) REFERENCES users (name),
+    FOREIGN KEY (album_id) REFERENCES albums (id)
+);
+
+CREATE TEMP TABLE owner AS
+SELECT CASE WHEN count(*) = 1 THEN max(user) ELSE '' END AS name
+FROM sync_state;
+
+INSERT INTO users (name, added_at)
+SELECT owner.name, min(albums.date_added)
+FROM albums, owner
+HAVING count(*) > 0;
+
+INSERT INTO collection
+    (user, album_id, rating, date_added, instance_id, synced_at, deleted_at)
+SELECT owner.name, id, rating, date_added, instance_id, synced_at, deleted_at
+FROM albums, owner;
+
+ALTER TABLE albums DROP COLUMN rating;
+ALTER TABLE albums DROP COLUMN date_added;
+ALTER TABLE albums DROP COLUMN instance_id;
+ALTER TABLE albums DROP COLUMN synced_at;
+ALTER TABLE albums DROP COLUMN deleted_at;
+
+ALTER TABLE plays ADD COLUMN user TEXT NOT NULL DEFAULT '';
+UPDATE plays SET user = (SELECT owner.name FROM owner);
+
+DROP TABLE owner;
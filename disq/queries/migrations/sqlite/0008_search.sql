@@ -0,0 +1,34 @@
+-- full-text index of albums (rowid = albums.id), shared by all users.
+-- diacritics are removed, so that e.g. handel matches Händel. rows are
+-- replaced whenever an album or its details are written. go-sqlite3 only
+-- includes fts5 with a build tag: go build -tags sqlite_fts5
+CREATE VIRTUAL TABLE album_search USING fts5(
+    artist,
+    title,
+    label,
+    notes,
+    tokenize = "unicode61 remove_diacritics 2"
+);
+
+INSERT INTO album_search (rowid, artist, title, label, notes)
+SELECT
+    albums.id,
+    (
+        SELECT group_concat(artists.name, ' ')
+        FROM albums_artists
+        INNER JOIN artists ON albums_artists.artist_id = artists.id
+        WHERE albums_artists.album_id = albums.id
+    ),
+    albums.title,
+    (
+        SELECT group_concat(labels.name, ' ')
+        FROM albums_labels
+        INNER JOIN labels ON albums_labels.label_id = labels.id
+        WHERE albums_labels.album_id = albums.id
+    ),
+    (
+        SELECT release_details.notes
+        FROM release_details
+        WHERE release_details.album_id = albums.id
+    )
+FROM albums;
@@ -0,0 +1,17 @@
+-- scrobbles, from ListenBrainz or Last.fm exports. listens are matched to
+-- albums of the user's collection by name, which may fail; unmatched listens
+-- are kept, so that they can be matched once the album is added.
+CREATE TABLE listens (
+    user TEXT,
+    listened_at INTEGER, -- unix seconds
+    artist TEXT NOT NULL,
+    track TEXT NOT NULL,
+    album TEXT NOT NULL DEFAULT '', -- as scrobbled; '' if unknown
+    source TEXT NOT NULL, -- listenbrainz or lastfm
+    album_id INTEGER, -- NULL until matched
+    PRIMARY KEY (user, listened_at, artist, track),
+    FOREIGN KEY (user) REFERENCES users (name),
+    FOREIGN KEY (album_id) REFERENCES albums (id)
+);
+
+CREATE INDEX listens_album_id ON listens (album_id);
@@ -0,0 +1,16 @@
+-- album directories of the local library ($MU), as of the last scan by each
+-- user. directories are matched to albums of the user's collection by name,
+-- like listens; a scan replaces all rows of the user.
+CREATE TABLE library (
+    user TEXT,
+    path TEXT, -- absolute
+    artist TEXT NOT NULL,
+    title TEXT NOT NULL,
+    year INTEGER NOT NULL DEFAULT 0, -- 0 if not in the name
+    album_id INTEGER, -- NULL if not matched
+    PRIMARY KEY (user, path),
+    FOREIGN KEY (user) REFERENCES users (name),
+    FOREIGN KEY (album_id) REFERENCES albums (id)
+);
+
+CREATE INDEX library_album_id ON library (album_id);
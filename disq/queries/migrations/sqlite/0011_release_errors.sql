@@ -0,0 +1,3 @@
+-- releases that could not be fetched (e.g. deleted from Discogs) are recorded,
+-- so that enrich does not retry them on every run. such rows have no details.
+ALTER TABLE release_details ADD COLUMN error TEXT NOT NULL DEFAULT '';
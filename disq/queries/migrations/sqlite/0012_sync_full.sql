@@ -0,0 +1,3 @@
+-- whether the unfinished sync is full, so that resuming it (even without
+-- -full) still touches every release, and tombstones those that were not
+ALTER TABLE sync_state ADD COLUMN full INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,46 @@
+-- albums owned by at least :min_owners users, with the rating of each owner
+-- ("user:rating", delimited by char(31)), and the difference between the
+-- highest and lowest rating (unrated copies are not compared). with
+-- :group_masters, pressings of the same master release count as one album.
+SELECT
+    albums.id,
+    albums.title,
+    (
+        SELECT group_concat(artists.name, ' ')
+        FROM albums_artists
+        INNER JOIN artists ON albums_artists.artist_id = artists.id
+        WHERE albums_artists.album_id = albums.id
+    ) AS artist,
+    shared.owners,
+    shared.spread,
+    shared.ratings_str
+FROM
+    (
+        SELECT
+            min(owned.album_id) AS album_id,
+            count(*) AS owners,
+            ifnull(max(nullif(owned.rating, 0)) - min(nullif(owned.rating, 0)), 0) AS spread,
+            group_concat(owned.user || ':' || owned.rating, char(31)) AS ratings_str
+        FROM
+            (
+                -- one row per user and album (or master)
+                SELECT
+                    CASE
+                        WHEN :group_masters != 0 AND albums.master_id > 0
+                            THEN 'm' || albums.master_id
+                        ELSE 'r' || albums.id
+                    END AS key,
+                    collection.user,
+                    min(albums.id) AS album_id,
+                    max(collection.rating) AS rating
+                FROM albums
+                INNER JOIN collection ON albums.id = collection.album_id
+                WHERE collection.deleted_at IS NULL
+                GROUP BY key, collection.user
+                ORDER BY collection.user
+            ) AS owned
+        GROUP BY owned.key
+        HAVING count(*) >= :min_owners
+    ) AS shared
+INNER JOIN albums ON shared.album_id = albums.id
+ORDER BY shared.spread DESC, shared.owners DESC, artist ASC, albums.title ASC
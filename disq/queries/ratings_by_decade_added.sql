@@ -0,0 +1,18 @@
+-- rating distribution per decade in which albums were added to the
+-- collection. unrated albums are counted, but not averaged.
+SELECT
+    cast(strftime('%Y', collection.date_added, 'unixepoch') AS INTEGER) / 10 * 10 AS period,
+    count(*) AS albums,
+    ifnull(avg(nullif(collection.rating, 0)), 0) AS avg_rating,
+    sum(collection.rating = 0) AS unrated,
+    sum(collection.rating = 1) AS r1,
+    sum(collection.rating = 2) AS r2,
+    sum(collection.rating = 3) AS r3,
+    sum(collection.rating = 4) AS r4,
+    sum(collection.rating = 5) AS r5
+FROM albums
+INNER JOIN collection
+    ON albums.id = collection.album_id AND collection.user = :user
+WHERE albums.id IN (SELECT filtered.id FROM filtered)
+GROUP BY period
+ORDER BY period
@@ -0,0 +1,18 @@
+-- rating distribution per year of release. unrated albums are counted, but
+-- not averaged.
+SELECT
+    albums.year AS period,
+    count(*) AS albums,
+    ifnull(avg(nullif(collection.rating, 0)), 0) AS avg_rating,
+    sum(collection.rating = 0) AS unrated,
+    sum(collection.rating = 1) AS r1,
+    sum(collection.rating = 2) AS r2,
+    sum(collection.rating = 3) AS r3,
+    sum(collection.rating = 4) AS r4,
+    sum(collection.rating = 5) AS r5
+FROM albums
+INNER JOIN collection
+    ON albums.id = collection.album_id AND collection.user = :user
+WHERE albums.id IN (SELECT filtered.id FROM filtered) AND albums.year > 0
+GROUP BY period
+ORDER BY period
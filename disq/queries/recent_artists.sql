@@ -0,0 +1,12 @@
+-- ids of the artists of the last :n albums suggested to or played by :user
+SELECT DISTINCT albums_artists.artist_id
+FROM
+    (
+        SELECT plays.album_id
+        FROM plays
+        WHERE plays.user = :user
+        ORDER BY plays.id DESC
+        LIMIT :n
+    ) AS recent
+INNER JOIN albums_artists
+    ON recent.album_id = albums_artists.album_id
@@ -0,0 +1,17 @@
+-- the albums of :user that match the filter (see filter.sql). wrapped by
+-- Albums, which sorts and paginates them (see Page.orderBy)
+SELECT
+    albums.id,
+    albums.title,
+    group_concat(artists.name, ' ') AS artist,
+    albums.year,
+    collection.rating
+FROM albums
+INNER JOIN collection
+    ON albums.id = collection.album_id AND collection.user = :user
+INNER JOIN albums_artists
+    ON albums.id = albums_artists.album_id
+INNER JOIN artists
+    ON albums_artists.artist_id = artists.id
+WHERE albums.id IN (SELECT filtered.id FROM filtered)
+GROUP BY albums.id
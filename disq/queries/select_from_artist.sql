@@ -0,0 +1,21 @@
+SELECT
+    albums.id,
+    albums.title,
+    -- all artists of the album, not just the one searched for
+    (
+        SELECT group_concat(a.name, ' ')
+        FROM albums_artists AS aa
+        INNER JOIN artists AS a ON aa.artist_id = a.id
+        WHERE aa.album_id = albums.id
+    ) AS artist,
+    albums.year,
+    collection.rating
+FROM artists
+INNER JOIN albums_artists
+    ON artists.id = albums_artists.artist_id
+INNER JOIN albums
+    ON albums_artists.album_id = albums.id
+INNER JOIN collection
+    ON albums.id = collection.album_id AND collection.user = :user
+WHERE artists.name = :artist AND collection.deleted_at IS NULL
+ORDER BY albums.year
@@ -1,10 +1,17 @@
+-- candidates for a random pick, which is weighted (by rating and by
+-- last_played) in go
 SELECT
-    rand.title AS album,
+    cand.id,
+    cand.title,
     -- Usage notes: concat() and concat_ws() are appropriate for concatenating
     -- the values of multiple columns within the same row, while group_concat()
     -- joins together values from different rows.
     -- https://impala.apache.org/docs/build/asf-site-html/topics/impala_group_concat.html
-    group_concat(artists.name, ' ') AS artist
+    group_concat(artists.name, ' ') AS artist,
+    group_concat(artists.id) AS artist_ids,
+    cand.year,
+    cand.rating,
+    cand.last_played
 FROM
     (
         -- note: to satisfy sqlfluff, columns are qualified with their table name
@@ -12,16 +19,31 @@ FROM
         -- this be applied to functions as well. however, sqlite does not support
         -- this 'method'-ish syntax
         -- https://docs.sqlfluff.com/en/stable/reference/rules.html#column-references-should-be-qualified-consistently-in-single-table-statements
-        -- https://www.sqlite.org/lang_corefunc.html#random
         SELECT
             albums.id,
-            albums.title
+            albums.title,
+            albums.year,
+            collection.rating,
+            -- suggested, played or scrobbled by this user
+            max(
+                (
+                    SELECT ifnull(max(plays.played_at), 0)
+                    FROM plays
+                    WHERE plays.album_id = albums.id AND plays.user = :user
+                ),
+                (
+                    SELECT ifnull(max(listens.listened_at), 0)
+                    FROM listens
+                    WHERE listens.album_id = albums.id AND listens.user = :user
+                )
+            ) AS last_played
         FROM albums
-        WHERE albums.rating >= 3
-        ORDER BY random() LIMIT 1
-    ) AS rand
+        INNER JOIN collection
+            ON albums.id = collection.album_id AND collection.user = :user
+        WHERE albums.id IN (SELECT filtered.id FROM filtered)
+    ) AS cand
 INNER JOIN albums_artists
-    ON rand.id = albums_artists.album_id
+    ON cand.id = albums_artists.album_id
 INNER JOIN artists
     ON albums_artists.artist_id = artists.id
-GROUP BY album
+GROUP BY cand.id
@@ -4,6 +4,8 @@ INNER JOIN albums_artists
     ON artists.id = albums_artists.artist_id
 INNER JOIN albums
     ON albums_artists.album_id = albums.id
--- ? will be substituted in go; https://go.dev/doc/database/sql-injection
-WHERE name = ?
+INNER JOIN collection
+    ON albums.id = collection.album_id AND collection.user = :user
+-- :artist will be substituted in go; https://go.dev/doc/database/sql-injection
+WHERE name = :artist AND deleted_at IS NULL
 ORDER BY random() LIMIT 1
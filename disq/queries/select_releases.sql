@@ -0,0 +1,46 @@
+-- albums of :user as releases (see Release), in order of id, starting after
+-- :after; for copying the collection to another store. formats are omitted.
+-- artists and labels are char(30)-delimited lists of char(31)-delimited
+-- fields, in the order of the release.
+SELECT
+    albums.id,
+    albums.title,
+    albums.year,
+    ifnull(albums.master_id, 0) AS master_id,
+    ifnull(collection.instance_id, 0) AS instance_id,
+    collection.rating,
+    collection.date_added,
+    (
+        SELECT group_concat(
+            artists.id || char(31) || artists.name,
+            char(30) ORDER BY albums_artists.rowid
+        )
+        FROM albums_artists
+        INNER JOIN artists ON albums_artists.artist_id = artists.id
+        WHERE albums_artists.album_id = albums.id
+    ) AS artists_str,
+    (
+        SELECT group_concat(
+            labels.id || char(31) || labels.name || char(31) || albums_labels.catno,
+            char(30) ORDER BY albums_labels.rowid
+        )
+        FROM albums_labels
+        INNER JOIN labels ON albums_labels.label_id = labels.id
+        WHERE albums_labels.album_id = albums.id
+    ) AS labels_str,
+    (
+        SELECT group_concat(genres.name, char(30) ORDER BY genres.rowid)
+        FROM genres
+        WHERE genres.album_id = albums.id
+    ) AS genres_str,
+    (
+        SELECT group_concat(styles.name, char(30) ORDER BY styles.rowid)
+        FROM styles
+        WHERE styles.album_id = albums.id
+    ) AS styles_str
+FROM albums
+INNER JOIN collection
+    ON albums.id = collection.album_id AND collection.user = :user
+WHERE collection.deleted_at IS NULL AND albums.id > :after
+ORDER BY albums.id
+LIMIT :n
@@ -1,37 +1,29 @@
--- artists with more than 3 ratings, and with average rating 2.7 (out of 5)
-
--- assign query result to table
--- https://www.postgresql.org/docs/current/queries-with.html#QUERIES-WITH-SELECT
-WITH joined AS (
-    SELECT *
-    FROM albums
-    INNER JOIN albums_artists ON albums.id = albums_artists.album_id
-    INNER JOIN artists ON albums_artists.artist_id = artists.id
-    -- WHERE albums.rating >= 3
-    -- note: not sorting makes the query at least 25x slower!
-    ORDER BY albums.rating DESC
-),
-
-at_least_three_ratings AS (
-    SELECT
-        name,
-        title,
-        rating
-    FROM joined
-    WHERE
-        (
-            -- 'group'
-            -- https://www.machinelearningplus.com/sql/how-to-get-top-n-results-in-each-group-by-group-in-sql/
-            SELECT count(*) FROM joined AS j
-            WHERE joined.name = j.name
-        )
-        >= 3
-    ORDER BY joined.name ASC, joined.rating DESC
-)
+-- artists with at least :min_albums ratings, and with average rating of at
+-- least :min_avg (out of 5), e.g. 3 and 2.7 (jsb ~ 2.77)
 
+-- no WITH clause of its own, since the filtered CTE is prepended in go
 SELECT
-    name,
-    avg(rating) AS rs
-FROM at_least_three_ratings
-GROUP BY name
-HAVING avg(rating) >= 2.7 -- jsb ~ 2.77
+    joined.name AS artist,
+    count(*) AS n,
+    avg(joined.rating) AS avg_rating,
+    group_concat(joined.title, char(31)) AS albums_str
+FROM
+    (
+        SELECT
+            artists.id AS artist_id,
+            artists.name,
+            albums.title,
+            collection.rating
+        FROM albums
+        INNER JOIN collection
+            ON albums.id = collection.album_id AND collection.user = :user
+        INNER JOIN albums_artists ON albums.id = albums_artists.album_id
+        INNER JOIN artists ON albums_artists.artist_id = artists.id
+        WHERE albums.id IN (SELECT filtered.id FROM filtered)
+        -- AND albums.rating >= 3
+        -- best first, so that group_concat lists the best albums first
+        ORDER BY collection.rating DESC, albums.title ASC
+    ) AS joined
+GROUP BY joined.artist_id
+HAVING count(*) >= :min_albums AND avg(joined.rating) >= :min_avg
+ORDER BY avg_rating DESC, artist ASC
@@ -1,34 +1,34 @@
--- artists whose top 3 ratings (out of 5) add up to 11 or more (out of 15)
-
-WITH
-
-joined AS (
-    SELECT *
-    FROM albums
-    INNER JOIN albums_artists ON albums.id = albums_artists.album_id
-    INNER JOIN artists ON albums_artists.artist_id = artists.id
-),
-
-
--- https://www.machinelearningplus.com/sql/how-to-get-top-n-results-in-each-group-by-group-in-sql/
-top_three AS (
-    SELECT
-        name,
-        title,
-        rating,
-        row_number() OVER (
-            PARTITION BY name
-            ORDER BY rating DESC
-        ) AS rn
-    FROM joined
-    -- WHERE rn <= 3 -- not available in this scope
-)
+-- artists whose top :n ratings (out of 5) add up to :min_sum or more (out of
+-- 5 * :n), e.g. 3 and 11
 
+-- no WITH clause of its own, since the filtered CTE is prepended in go
 SELECT
-    name,
-    sum(rating) AS sum
-FROM top_three
-WHERE rn <= 3
-GROUP BY name
-HAVING sum(rating) >= 11
-ORDER BY sum DESC, name ASC
+    top_n.name AS artist,
+    sum(top_n.rating) AS sum,
+    group_concat(top_n.title, char(31)) AS albums_str
+FROM
+    (
+        -- best first, so that group_concat lists the best albums first
+        -- https://www.machinelearningplus.com/sql/how-to-get-top-n-results-in-each-group-by-group-in-sql/
+        SELECT
+            artists.id AS artist_id,
+            artists.name,
+            albums.title,
+            collection.rating,
+            row_number() OVER (
+                PARTITION BY artists.id
+                ORDER BY collection.rating DESC, albums.title ASC
+            ) AS rn
+        FROM albums
+        INNER JOIN collection
+            ON albums.id = collection.album_id AND collection.user = :user
+        INNER JOIN albums_artists ON albums.id = albums_artists.album_id
+        INNER JOIN artists ON albums_artists.artist_id = artists.id
+        WHERE albums.id IN (SELECT filtered.id FROM filtered)
+        -- WHERE rn <= 3 -- not available in this scope
+        ORDER BY rn
+    ) AS top_n
+WHERE top_n.rn <= :n
+GROUP BY top_n.artist_id
+HAVING sum(top_n.rating) >= :min_sum
+ORDER BY sum DESC, artist ASC
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Full-text search uses the album_search index (see
+// queries/migrations/sqlite/0008_search.sql).
+
+// ftsQuery converts a user's query into an fts MATCH expression, in which
+// every word is a prefix, and all words must match (in any column). Words are
+// split like the tokenizer splits them, so punctuation (including fts
+// operators) is dropped. An empty expression matches everything.
+func ftsQuery(q string) string {
+	words := strings.FieldsFunc(strings.ToLower(q), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	for i, w := range words {
+		words[i] = w + "*"
+	}
+	return strings.Join(words, " ")
+}
+
+// ftsRank is the relevance of a match of album_search; the lower, the better.
+// Columns are weighted in order (artist, title, label, notes), so that a match
+// on the artist counts for more than a mention in the notes.
+//
+// https://www.sqlite.org/fts5.html#the_bm25_function
+const ftsRank = "bm25(album_search, 4, 2, 1, 0.5)"
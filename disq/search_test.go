@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFtsQuery(t *testing.T) {
+	for _, test := range []struct {
+		query    string
+		expected string
+	}{
+		{"Händel", "händel*"},
+		{"  hand   mess ", "hand* mess*"},
+		{"AC/DC", "ac* dc*"},
+		{`"NOT" OR -x*`, "not* or* x*"},
+		{"!!!", ""},
+	} {
+		assert.Equal(t, test.expected, ftsQuery(test.query), test.query)
+	}
+}
+
+func TestSqliteSearch(t *testing.T) {
+	ctx := context.Background()
+	s := Must(openSqlite(":memory:"))
+	defer s.Close()
+
+	rel := func(id int, artist string, title string) Release {
+		r := newRelease(id, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+		r.BasicInfo.Artists = []Artist{{Id: id, Name: artist}}
+		r.BasicInfo.Title = title
+		return r
+	}
+	messiah := rel(1, "Georg Friedrich Händel", "Messiah")
+	messiah.BasicInfo.Labels = []Label{{Id: 1, Name: "Decca"}}
+	Must(s.InsertBatch(ctx, []Release{
+		messiah,
+		rel(2, "Henry Purcell", "Dido And Aeneas"),
+		rel(3, "Handel And Haydn Society", "Water Music"),
+	}))
+	assert.NoError(t, s.insertDetails(ctx, 2, AlbumDetails{Notes: "Coupled with arias by Handel."}))
+
+	for _, test := range []struct {
+		query    string
+		expected []string
+	}{
+		// artist matches rank above mentions in the notes
+		{"handel", []string{"Messiah", "Water Music", "Dido And Aeneas"}},
+		{"HÄNDEL", []string{"Messiah", "Water Music", "Dido And Aeneas"}},
+		{"händ mess", []string{"Messiah"}},
+		{"decca", []string{"Messiah"}},
+		{"arias", []string{"Dido And Aeneas"}},
+		{"and", []string{"Water Music", "Dido And Aeneas"}},
+		{"bach", nil},
+		{"!!!", nil},
+	} {
+		assert.Equal(t, test.expected, titles(Must(s.Search(ctx, test.query))), test.query)
+	}
+
+	// the query is combined with other filters
+	assert.Equal(
+		t,
+		[]string{"Water Music"},
+		titles(Must(s.Albums(ctx, Filter{Query: "handel", Title: "music"}, Page{Sort: sortRelevance}))),
+	)
+	assert.Equal(
+		t,
+		[]string{"Dido And Aeneas", "Water Music", "Messiah"},
+		titles(Must(s.Albums(ctx, Filter{Query: "handel"}, Page{Sort: sortRelevance, Desc: true}))),
+	)
+	assert.Equal(t, 3, Must(s.CountAlbums(ctx, Filter{Query: "hand"})))
+}
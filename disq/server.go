@@ -1,42 +1,408 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+
+	"github.com/a-h/templ"
 )
 
 const PORT = 3838
 
-var LocalIP string
+// Number of albums per page of /api/albums
+const apiPageSize = 50
 
-func init() {
+// only needed by the server; other modes (e.g. -dump) must not fail when
+// offline
+func localIP() string {
 	// https://stackoverflow.com/a/37382208
 	conn, err := net.Dial("udp", "1:") // arbitrary non-zero addr
 	if err != nil {
 		log.Fatal(err)
 	}
-	LocalIP = strings.Split(conn.LocalAddr().String(), ":")[0]
-	fmt.Println(LocalIP)
-	conn.Close()
+	defer conn.Close()
+	return strings.Split(conn.LocalAddr().String(), ":")[0]
+}
+
+// albumsResponse is a page of /api/albums
+type albumsResponse struct {
+	Total  int     `json:"total"`
+	Page   int     `json:"page"` // 1-based
+	Pages  int     `json:"pages"`
+	Albums []Album `json:"albums"`
+
+	query url.Values // for links to other pages and sort orders
+}
+
+// parseFilter reads a filter from query params. q is a full-text query; year
+// is either a single year, or an inclusive range (e.g. 1990-1999); rating is
+// the minimum rating; masters (a bool) groups pressings of the same master.
+func parseFilter(q url.Values) (Filter, error) {
+	f := Filter{
+		Query:  q.Get("q"),
+		Artist: q.Get("artist"),
+		Title:  q.Get("title"),
+		Genre:  q.Get("genre"),
+		Style:  q.Get("style"),
+		Label:  q.Get("label"),
+	}
+
+	var err error
+	if m := q.Get("masters"); m != "" {
+		if f.GroupMasters, err = strconv.ParseBool(m); err != nil {
+			return f, fmt.Errorf("invalid masters: %s", m)
+		}
+	}
+	if r := q.Get("rating"); r != "" {
+		if f.MinRating, err = strconv.Atoi(r); err != nil {
+			return f, fmt.Errorf("invalid rating: %s", r)
+		}
+	}
+	if y := q.Get("year"); y != "" {
+		from, to, isRange := strings.Cut(y, "-")
+		if !isRange {
+			to = from
+		}
+		for _, v := range []struct {
+			s   string
+			dst *int
+		}{{from, &f.YearMin}, {to, &f.YearMax}} {
+			if v.s == "" { // open range
+				continue
+			}
+			if *v.dst, err = strconv.Atoi(v.s); err != nil {
+				return f, fmt.Errorf("invalid year: %s", y)
+			}
+		}
+	}
+	return f, nil
 }
 
-func listen() {
-	// http.Handle("/", templ.Handler(tableRows(foo())))
+// parsePage reads the sort order and (1-based) page number from query params.
+// A leading - in sort reverses the order.
+func parsePage(q url.Values) (Page, int, error) {
+	p := Page{Limit: apiPageSize}
+	p.Sort, p.Desc = strings.CutPrefix(q.Get("sort"), "-")
+
+	n := 1
+	if s := q.Get("page"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 1 {
+			return p, 0, fmt.Errorf("invalid page: %s", s)
+		}
+	}
+	p.Offset = (n - 1) * apiPageSize
+	return p, n, nil
+}
+
+// albumsLink returns the /api/albums url of q with one param replaced. Any
+// change of sort order returns to the first page.
+func albumsLink(q url.Values, key string, val string) string {
+	q2 := url.Values{}
+	for k, v := range q {
+		q2[k] = v
+	}
+	q2.Set(key, val)
+	if key == "sort" {
+		q2.Del("page")
+	}
+	return "/api/albums?" + q2.Encode()
+}
+
+// nextSort returns the sort param that sorts by col, or reverses the order if
+// already sorted by it
+func nextSort(q url.Values, col string) string {
+	if q.Get("sort") == col {
+		return "-" + col
+	}
+	return col
+}
+
+// forUser returns the store of user, or store itself if user is empty (i.e.
+// the user selected when the server was started)
+func forUser(ctx context.Context, store Store, user string) (Store, error) {
+	if user == "" {
+		return store, nil
+	}
+	return store.ForUser(ctx, user)
+}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+// statusOf maps an error of the store (or player) to an http status.
+// Unexpected errors are the server's fault.
+func statusOf(err error) int {
+	switch {
+	case errors.Is(err, errNotFound), errors.Is(err, errUnplayable):
+		return http.StatusNotFound
+	case errors.Is(err, errUnsupported):
+		return http.StatusBadRequest
+	case errors.Is(err, errUnavailable):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// storeError responds with the status of err. Only the server's own errors
+// are logged; there is no point in logging those of cancelled requests.
+func storeError(w http.ResponseWriter, r *http.Request, err error) {
+	status := statusOf(err)
+	if status == http.StatusInternalServerError && r.Context().Err() == nil {
+		log.Println(r.URL, err)
+	}
+	if status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", "1")
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// isHtmx reports whether the request was made by htmx, i.e. whether a
+// fragment of html, rather than json, should be returned
+func isHtmx(r *http.Request) bool { return r.Header.Get("HX-Request") == "true" }
+
+// respond writes v as json, or renders c for htmx requests
+func respond(w http.ResponseWriter, r *http.Request, v any, c templ.Component) {
+	var err error
+	if isHtmx(r) {
+		err = c.Render(r.Context(), w)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(v)
+	}
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// playerHandler runs a player action, and returns to the page
+func playerHandler(action func(r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := action(r); err != nil {
+			storeError(w, r, err)
+			return
+		}
+		if isHtmx(r) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	}
+}
+
+func newMux(store Store, player *Player, covers coverCache) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
 		// HandleFunc + Component.Render ensures content is dynamically rendered
-		err := tableRows(ch.RandomAlbum(10)).Render(r.Context(), w)
+		if err := index(r.URL.Query()).Render(r.Context(), w); err != nil {
+			log.Println(err)
+		}
+	})
+
+	mux.HandleFunc("GET /api/albums", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		store, err := forUser(r.Context(), store, q.Get("user"))
+		if err != nil {
+			storeError(w, r, err)
+			return
+		}
+		f, err := parseFilter(q)
 		if err != nil {
-			fmt.Fprintln(w, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
+		p, n, err := parsePage(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if f.Query != "" && p.Sort == "" {
+			p.Sort = sortRelevance
+		}
+
+		total, err := store.CountAlbums(r.Context(), f)
+		if err != nil {
+			storeError(w, r, err)
+			return
+		}
+		albums, err := store.Albums(r.Context(), f, p)
+		if err != nil {
+			storeError(w, r, err)
+			return
+		}
+		res := albumsResponse{
+			Total:  total,
+			Page:   n,
+			Pages:  (total + apiPageSize - 1) / apiPageSize,
+			Albums: albums,
+			query:  q,
+		}
+		if res.Albums == nil {
+			res.Albums = []Album{}
+		}
+		respond(w, r, res, albumsTable(res))
+	})
+
+	mux.HandleFunc("GET /api/random", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		store, err := forUser(r.Context(), store, q.Get("user"))
+		if err != nil {
+			storeError(w, r, err)
+			return
+		}
+		f, err := parseFilter(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		n := 10
+		if s := q.Get("n"); s != "" {
+			if n, err = strconv.Atoi(s); err != nil || n < 1 {
+				http.Error(w, "invalid n: "+s, http.StatusBadRequest)
+				return
+			}
+		}
+
+		albums, err := store.RandomAlbum(r.Context(), f, n)
+		if err != nil {
+			storeError(w, r, err)
+			return
+		}
+		if albums == nil {
+			albums = []Album{}
+		}
+		respond(w, r, albums, albumRows(albums, q.Get("user")))
+	})
+
+	// best matches of a full-text query, without pagination
+	mux.HandleFunc("GET /api/search", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		store, err := forUser(r.Context(), store, q.Get("user"))
+		if err != nil {
+			storeError(w, r, err)
+			return
+		}
+		albums, err := store.Search(r.Context(), q.Get("q"))
+		if err != nil {
+			storeError(w, r, err)
+			return
+		}
+		if albums == nil {
+			albums = []Album{}
+		}
+		respond(w, r, albums, albumRows(albums, q.Get("user")))
+	})
+
+	mux.HandleFunc("GET /api/artists/{id}", func(w http.ResponseWriter, r *http.Request) {
+		store, err := forUser(r.Context(), store, r.URL.Query().Get("user"))
+		if err != nil {
+			storeError(w, r, err)
+			return
+		}
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid id: "+r.PathValue("id"), http.StatusBadRequest)
+			return
+		}
+		artist, err := store.ArtistById(r.Context(), id)
+		if err != nil {
+			storeError(w, r, err)
+			return
+		}
+
+		albums, err := store.AlbumsByArtist(r.Context(), artist.Name)
+		if err != nil {
+			storeError(w, r, err)
+			return
+		}
+		if albums == nil {
+			albums = []Album{}
+		}
+		res := struct {
+			*Artist
+			Albums []Album `json:"albums"`
+		}{artist, albums}
+		respond(w, r, res, albumRows(albums, r.URL.Query().Get("user")))
+	})
+
+	// thumbnails; covers are fetched by `disq enrich`
+	mux.HandleFunc("GET /covers/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid id: "+r.PathValue("id"), http.StatusBadRequest)
+			return
+		}
+		e, ok := store.(enricher)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		d, err := e.details(r.Context(), id)
+		if err != nil {
+			storeError(w, r, err)
+			return
+		}
+		if d == nil || d.Cover == "" {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, covers.path(d.Cover))
 	})
 
-	log.Printf("starting server on http://%v:%d\n", LocalIP, PORT)
+	// albums are played on the machine running the server
+	mux.HandleFunc("POST /play", playerHandler(func(r *http.Request) error {
+		if err := player.Play(r.FormValue("artist"), r.FormValue("title")); err != nil {
+			return err
+		}
+		id, err := strconv.Atoi(r.FormValue("id"))
+		if err != nil {
+			return nil
+		}
+		store, err := forUser(r.Context(), store, r.FormValue("user"))
+		if err != nil {
+			return err
+		}
+		return store.RecordPlay(r.Context(), id)
+	}))
+	for path, action := range map[string]func() error{
+		"pause": player.TogglePause,
+		"next":  player.Next,
+		"prev":  player.Prev,
+		"stop":  player.Stop,
+	} {
+		mux.HandleFunc("POST /play/"+path, playerHandler(func(*http.Request) error { return action() }))
+	}
+
+	return mux
+}
 
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", PORT), nil); err != nil {
-		panic(err)
+// listen serves until ctx is done, then waits for running requests
+func listen(ctx context.Context, store Store, player *Player) error {
+	covers, err := defaultCoverCache()
+	if err != nil {
+		return err
+	}
+	log.Printf("starting server on http://%v:%d\n", localIP(), PORT)
+
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%d", PORT),
+		Handler: newMux(store, player, covers),
+	}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Shutdown(context.Background())
+	}()
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
 	}
+	return nil
 }
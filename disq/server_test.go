@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApi(t *testing.T) {
+	ctx := context.Background()
+	s := Must(openSqlite(":memory:"))
+	defer s.Close()
+	rels := newReleases(120)
+	for i := range rels {
+		rels[i].BasicInfo.Year = 1900 + rels[i].BasicInfo.Id
+	}
+	Must(s.InsertBatch(ctx, rels))
+
+	srv := httptest.NewServer(newMux(s, nil, coverCache{dir: t.TempDir()}))
+	defer srv.Close()
+
+	get := func(path string, dst any) int {
+		resp, err := http.Get(srv.URL + path)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(dst))
+		}
+		return resp.StatusCode
+	}
+
+	for _, test := range []struct {
+		path     string
+		status   int
+		total    int
+		pages    int
+		expected []string // first titles
+	}{
+		{"/api/albums", 200, 120, 3, []string{"Album 1", "Album 10"}},
+		{"/api/albums?sort=-year&page=2", 200, 120, 3, []string{"Album 70", "Album 69"}},
+		{"/api/albums?year=1910-1919&rating=5&sort=year", 200, 2, 1, []string{"Album 14", "Album 19"}},
+		{"/api/albums?year=2015-&sort=year", 200, 6, 1, []string{"Album 115"}},
+		{"/api/albums?artist=artist+11&title=0", 200, 1, 1, []string{"Album 110"}},
+		{"/api/albums?q=album+11", 200, 11, 1, []string{"Album 11"}},
+		{"/api/albums?page=4", 200, 120, 3, nil},
+		{"/api/albums?page=0", 400, 0, 0, nil},
+		{"/api/albums?rating=x", 400, 0, 0, nil},
+		{"/api/albums?year=1990-x", 400, 0, 0, nil},
+	} {
+		var res albumsResponse
+		assert.Equal(t, test.status, get(test.path, &res), test.path)
+		assert.Equal(t, test.total, res.Total, test.path)
+		assert.Equal(t, test.pages, res.Pages, test.path)
+		if len(test.expected) > 0 {
+			assert.Equal(t, test.expected, titles(res.Albums)[:len(test.expected)], test.path)
+		}
+	}
+
+	var random []Album
+	assert.Equal(t, 200, get("/api/random?n=3&rating=5", &random))
+	assert.Len(t, random, 3)
+	for _, alb := range random {
+		assert.Equal(t, 5, alb.Rating)
+	}
+	assert.Equal(t, 400, get("/api/random?n=-1", &random))
+
+	var found []Album
+	assert.Equal(t, 200, get("/api/search?q=ALBUM+110", &found))
+	assert.Equal(t, []string{"Album 110"}, titles(found))
+	assert.Equal(t, 200, get("/api/search?q=", &found))
+	assert.Empty(t, found)
+
+	var artist struct {
+		Id     int
+		Name   string
+		Albums []Album
+	}
+	assert.Equal(t, 200, get("/api/artists/7", &artist))
+	assert.Equal(t, "Artist 7", artist.Name)
+	assert.Equal(t, []string{"Album 7"}, titles(artist.Albums))
+	assert.Equal(t, 404, get("/api/artists/1000", &artist))
+	assert.Equal(t, 400, get("/api/artists/x", &artist))
+
+	// htmx gets html
+	req, _ := http.NewRequest("GET", srv.URL+"/api/albums?artist=artist+7&sort=title", nil)
+	req.Header.Set("HX-Request", "true")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	var b strings.Builder
+	_, _ = io.Copy(&b, resp.Body)
+	assert.Contains(t, b.String(), "<td>Album 7</td>")
+	assert.Contains(t, b.String(), "sort=-title")
+}
+
+// failingStore fails every query of the album list
+type failingStore struct {
+	Store
+	err error
+}
+
+func (s failingStore) CountAlbums(context.Context, Filter) (int, error) { return 0, s.err }
+
+func TestApiErrors(t *testing.T) {
+	s := Must(openSqlite(":memory:"))
+	defer s.Close()
+
+	for _, test := range []struct {
+		err    error
+		status int
+	}{
+		{fmt.Errorf("artist 1: %w", errNotFound), http.StatusNotFound},
+		{fmt.Errorf("where: %w", errUnsupported), http.StatusBadRequest},
+		{fmt.Errorf("%w: database is locked", errUnavailable), http.StatusServiceUnavailable},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout},
+		{fmt.Errorf("a - b: %w: not in library", errUnplayable), http.StatusNotFound},
+		{errors.New("no such table: albums"), http.StatusInternalServerError},
+	} {
+		srv := httptest.NewServer(newMux(failingStore{s, test.err}, nil, coverCache{dir: t.TempDir()}))
+		resp, err := http.Get(srv.URL + "/api/albums")
+		assert.NoError(t, err)
+		resp.Body.Close()
+		srv.Close()
+		assert.Equal(t, test.status, resp.StatusCode, test.err)
+	}
+}
+
+func TestApiPlayUnplayable(t *testing.T) {
+	s := Must(openSqlite(":memory:"))
+	defer s.Close()
+	// neither in the library, nor resolvable
+	player := newPlayer(t.TempDir(), fakeResolver{})
+	srv := httptest.NewServer(newMux(s, player, coverCache{dir: t.TempDir()}))
+	defer srv.Close()
+
+	resp, err := http.PostForm(srv.URL+"/play", url.Values{"artist": {"Artist A"}, "title": {"Alpha"}, "id": {"1"}})
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
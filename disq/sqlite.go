@@ -1,16 +1,20 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	_ "embed"
+	"errors"
 	"fmt"
 	"maps"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/jmoiron/sqlx"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
 // TODO: this looks interesting, but requires files that are invalid sql https://github.com/Davmuz/gqt
@@ -20,17 +24,38 @@ import (
 const DBFile = "./collection2.db"
 
 var (
-	s sqlite
-
-	// The schema is normalised, and requires many double inner joins.
-	//go:embed queries/schema.sql
-	_schema string
+	// The schema (see queries/migrations/sqlite) is normalised, and requires
+	// many double inner joins.
+	//go:embed queries/filter.sql
+	_filter string
+	//go:embed queries/select_albums.sql
+	_select_albums string
 	//go:embed queries/select_random.sql
 	_select_random string
+	//go:embed queries/recent_artists.sql
+	_recent_artists string
 	//go:embed queries/select_random_from_artist.sql
 	_select_random_from_artist string
 	//go:embed queries/select_from_artist.sql
 	_select_all_from_artist string
+	//go:embed queries/artist_stats.sql
+	_artist_stats string
+	//go:embed queries/index_album.sql
+	_index_album string
+	//go:embed queries/top_artists_by_avg_rating.sql
+	_top_artists_by_avg_rating string
+	//go:embed queries/top_artists_by_top_n_ratings.sql
+	_top_artists_by_top_n_ratings string
+	//go:embed queries/ratings_by_year.sql
+	_ratings_by_year string
+	//go:embed queries/ratings_by_decade_added.sql
+	_ratings_by_decade_added string
+	//go:embed queries/overlap.sql
+	_overlap string
+	//go:embed queries/album_listens.sql
+	_album_listens string
+	//go:embed queries/select_releases.sql
+	_select_releases string
 )
 
 type (
@@ -39,24 +64,27 @@ type (
 		// *sqlx.DB // can use db.Close() (etc) directly, but compiler complains
 
 		db *sqlx.DB // the inner DB, with all the typical methods
+
+		user string // whose collection is read and written; see ForUser
 	}
 
 	Artist struct {
-		Id   int
-		Name string
+		Id   int    `json:"id"`
+		Name string `json:"name"`
 		// Role string
 	}
 
 	Label struct {
-		Id   int
-		Name string
-		// Catno string
+		Id    int
+		Name  string
+		Catno string
 	}
 
-	// The result of select_random.sql
-	SimpleRow struct {
-		Album  string `ch:"title"       ,db:"album"`
-		Artist string `ch:"artist_name" ,db:"artist"`
+	Format struct {
+		Name         string
+		Qty          string   // a number, but sent as a string
+		Descriptions []string // e.g. LP, Album
+		Text         string
 	}
 
 	// row schema from an old query
@@ -75,16 +103,9 @@ type (
 		Img        string
 		InstanceId string `db:"iid"`
 	}
-
-	AvgResult struct {
-		Artist    string
-		AvgR      float32
-		AlbumsStr string
-		Albums    []string `db:"-"` // i forgot the meaning of -
-	}
 )
 
-func init_sqlite() {
+func openDefaultSqlite() (*sqlite, error) {
 	// note: first db connection tends to be very slow to build. this does
 	// not happen with clickhouse
 
@@ -102,50 +123,544 @@ func init_sqlite() {
 	// 	db_path = filepath.Join(filepath.Dir(bin), DBFile)
 	// }
 
-	bin, _ := os.Executable()
-	db_path := filepath.Join(filepath.Dir(bin), DBFile)
+	db_path := defaultSqlitePath()
 	fmt.Println(db_path)
 
-	s.db = sqlx.MustConnect("sqlite3", db_path)
-	s.db.MustExec(_schema)
+	return openSqlite(db_path)
+}
+
+func defaultSqlitePath() string {
+	bin, _ := os.Executable()
+	return filepath.Join(filepath.Dir(bin), DBFile)
+}
+
+// connectSqlite connects to the db at path (which may be ":memory:"), without
+// migrating it.
+func connectSqlite(path string) (*sqlite, error) {
+	db, err := sqlx.Connect("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if path == ":memory:" {
+		// every connection gets its own in-memory db
+		db.SetMaxOpenConns(1)
+	}
+	return &sqlite{db: db}, nil
+}
+
+// openSqlite connects to the db at path, creating it if needed, and applies
+// any pending migrations.
+func openSqlite(path string) (*sqlite, error) {
+	s, err := connectSqlite(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.migrate(context.Background()); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
+
+// wrapErr marks the errors of a busy db (i.e. one that another process is
+// writing to) as errUnavailable
+func wrapErr(err error) error {
+	var se sqlite3.Error
+	if errors.As(err, &se) && (se.Code == sqlite3.ErrBusy || se.Code == sqlite3.ErrLocked) {
+		return fmt.Errorf("%w: %w", errUnavailable, err)
+	}
+	return err
+}
+
+// inTx runs f in a transaction, which is committed if f succeeds, and rolled
+// back otherwise. It is also rolled back if ctx is done before the commit
+// (e.g. on Ctrl-C), so an interrupted write never leaves half of its rows.
+func (s *sqlite) inTx(ctx context.Context, f func(tx *sqlx.Tx) error) error {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return wrapErr(err)
+	}
+	if err := f(tx); err != nil {
+		_ = tx.Rollback()
+		return wrapErr(err)
+	}
+	return wrapErr(tx.Commit())
+}
+
+// appliedMigrations returns the versions of the migrations that were applied
+func (s *sqlite) appliedMigrations(ctx context.Context) (map[int]time.Time, error) {
+	_, err := s.db.ExecContext(
+		ctx,
+		`CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER,
+			name TEXT NOT NULL,
+			applied_at INTEGER NOT NULL, -- unix seconds
+			PRIMARY KEY (version)
+		)`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		Version   int
+		AppliedAt int64 `db:"applied_at"`
+	}
+	if err := s.db.SelectContext(ctx, &rows, "SELECT version, applied_at FROM schema_version"); err != nil {
+		return nil, err
+	}
+
+	var tables int
+	err = s.db.GetContext(ctx, &tables, "SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'albums'")
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 && tables > 0 {
+		// created before migrations existed
+		t := now().Unix()
+		_, err := s.db.ExecContext(ctx, "INSERT INTO schema_version VALUES (?, ?, ?)", 1, sqliteMigrations[0].Name, t)
+		if err != nil {
+			return nil, err
+		}
+		return map[int]time.Time{1: time.Unix(t, 0)}, nil
+	}
+
+	applied := map[int]time.Time{}
+	for _, r := range rows {
+		applied[r.Version] = time.Unix(r.AppliedAt, 0)
+	}
+	return applied, nil
+}
+
+func (s *sqlite) migrationStatus(ctx context.Context) ([]migrationStatus, error) {
+	applied, err := s.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return migrationStatuses(sqliteMigrations, applied), nil
 }
 
-func (s *sqlite) InsertAlbum(tx *sqlx.Tx, alb Release) {
-	s.insert(
+// migrate applies each migration in its own transaction, so a failed migration
+// leaves the db at the previous version.
+func (s *sqlite) migrate(ctx context.Context) ([]migration, error) {
+	applied, err := s.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkVersions(sqliteMigrations, applied); err != nil {
+		return nil, err
+	}
+
+	var done []migration
+	for _, m := range sqliteMigrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		err := s.inTx(ctx, func(tx *sqlx.Tx) error {
+			if _, err := tx.ExecContext(ctx, m.sql); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, "INSERT INTO schema_version VALUES (?, ?, ?)", m.Version, m.Name, now().Unix())
+			return err
+		})
+		if err != nil && strings.Contains(err.Error(), "no such module: fts5") {
+			return done, fmt.Errorf("migration %s: %w (build with -tags sqlite_fts5)", m, err)
+		} else if err != nil {
+			return done, fmt.Errorf("migration %s: %w", m, err)
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+func (s *sqlite) ForUser(ctx context.Context, user string) (Store, error) {
+	if user == "" {
+		users, err := s.users(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if user, err = onlyUser(users); err != nil {
+			return nil, err
+		}
+	}
+	return &sqlite{db: s.db, user: user}, nil
+}
+
+func (s *sqlite) adoptUser(ctx context.Context, user string) (bool, error) {
+	if user == "" {
+		return false, nil
+	}
+	adopted := false
+	err := s.inTx(ctx, func(tx *sqlx.Tx) error {
+		var users []string
+		if err := tx.SelectContext(ctx, &users, "SELECT name FROM users"); err != nil {
+			return err
+		}
+		if len(users) != 1 || users[0] != "" {
+			return nil
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE users SET name = ? WHERE name = ''", user); err != nil {
+			return err
+		}
+		for _, table := range []string{"collection", "plays", "sync_state", "listens", "library"} {
+			if _, err := tx.ExecContext(ctx, "UPDATE "+table+" SET user = ? WHERE user = ''", user); err != nil {
+				return err
+			}
+		}
+		adopted = true
+		return nil
+	})
+	return adopted, err
+}
+
+// ensureUser adds the user, if they are new. Every write of the user's rows
+// must call it, as users are only listed (e.g. by ForUser) once added.
+func (s *sqlite) ensureUser(ctx context.Context, tx *sqlx.Tx) error {
+	// not replaced, so that added_at is kept
+	_, err := tx.ExecContext(
+		ctx,
+		"INSERT OR IGNORE INTO users (name, added_at) VALUES (?, ?)",
+		s.user,
+		now().Unix(),
+	)
+	return err
+}
+
+// What InsertAlbum did to the user's collection
+type change int
+
+const (
+	albumUnchanged change = iota
+	albumAdded            // new, or previously removed from the collection
+	albumChanged          // title, year, rating or instance differ
+)
+
+func (s *sqlite) InsertAlbum(ctx context.Context, tx *sqlx.Tx, alb Release) (change, error) {
+	var old struct {
+		Title      string
+		Year       int
+		Rating     int
+		InstanceId int  `db:"instance_id"`
+		Deleted    bool `db:"deleted"`
+	}
+	c := albumChanged
+	err := tx.GetContext(
+		ctx,
+		&old,
+		`SELECT
+			albums.title,
+			albums.year,
+			collection.rating,
+			ifnull(collection.instance_id, 0) AS instance_id,
+			collection.deleted_at IS NOT NULL AS deleted
+		FROM albums
+		INNER JOIN collection ON albums.id = collection.album_id
+		WHERE albums.id = ? AND collection.user = ?`,
+		alb.BasicInfo.Id,
+		s.user,
+	)
+	switch {
+	case errors.Is(err, sql.ErrNoRows) || err == nil && old.Deleted:
+		c = albumAdded
+	case err != nil:
+		return c, err
+	case old.Title == strings.TrimSpace(alb.BasicInfo.Title) &&
+		old.Year == alb.BasicInfo.Year &&
+		old.Rating == alb.Rating &&
+		old.InstanceId == alb.InstanceId:
+		c = albumUnchanged
+	}
+
+	added, err := time.Parse(time.RFC3339, alb.DateAdded)
+	if err != nil {
+		return c, fmt.Errorf("release %d: %w", alb.BasicInfo.Id, err)
+	}
+
+	if err := s.ensureUser(ctx, tx); err != nil {
+		return c, err
+	}
+
+	if err := s.insert(
+		ctx,
 		tx,
 		"albums",
 		map[string]any{
 			// go funcs should be used over sql funcs, so that dbs
 			// can be more easily swapped out
-			"id":         alb.BasicInfo.Id,
-			"title":      strings.TrimSpace(alb.BasicInfo.Title),
-			"year":       alb.BasicInfo.Year,
-			"rating":     alb.Rating,
-			"date_added": Must(time.Parse(time.RFC3339, alb.DateAdded)).Unix(),
+			"id":        alb.BasicInfo.Id,
+			"title":     strings.TrimSpace(alb.BasicInfo.Title),
+			"year":      alb.BasicInfo.Year,
+			"master_id": alb.BasicInfo.MasterId,
 		},
-	)
+	); err != nil {
+		return c, err
+	}
+	// deleted_at is not set, and thus cleared
+	if err := s.insert(
+		ctx,
+		tx,
+		"collection",
+		map[string]any{
+			"user":        s.user,
+			"album_id":    alb.BasicInfo.Id,
+			"rating":      alb.Rating,
+			"date_added":  added.Unix(),
+			"instance_id": alb.InstanceId,
+			"synced_at":   now().Unix(),
+		},
+	); err != nil {
+		return c, err
+	}
+
+	// weak entities cannot be replaced row by row. the credited artists
+	// may change too, e.g. from the synthetic ids of a csv import to those
+	// of Discogs
+	for _, table := range []string{"albums_artists", "albums_labels", "genres", "styles", "formats"} {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE album_id = ?", alb.BasicInfo.Id); err != nil {
+			return c, err
+		}
+	}
 
 	for _, a := range alb.BasicInfo.Artists {
-		s.insert(
+		if err := s.insert(
+			ctx,
 			tx,
 			"artists",
 			map[string]any{"id": a.Id, "name": a.Name},
-		)
-		s.insert(
+		); err != nil {
+			return c, err
+		}
+		if err := s.insert(
+			ctx,
 			tx,
 			"albums_artists",
 			map[string]any{"album_id": alb.BasicInfo.Id, "artist_id": a.Id},
-		)
+		); err != nil {
+			return c, err
+		}
+	}
+
+	for _, l := range alb.BasicInfo.Labels {
+		if err := s.insert(
+			ctx,
+			tx,
+			"labels",
+			map[string]any{"id": l.Id, "name": l.Name},
+		); err != nil {
+			return c, err
+		}
+		if err := s.insert(
+			ctx,
+			tx,
+			"albums_labels",
+			map[string]any{"album_id": alb.BasicInfo.Id, "label_id": l.Id, "catno": l.Catno},
+		); err != nil {
+			return c, err
+		}
+	}
+
+	for _, g := range alb.BasicInfo.Genres {
+		if err := s.insert(
+			ctx,
+			tx,
+			"genres",
+			map[string]any{"album_id": alb.BasicInfo.Id, "name": g},
+		); err != nil {
+			return c, err
+		}
+	}
+
+	for _, st := range alb.BasicInfo.Styles {
+		if err := s.insert(
+			ctx,
+			tx,
+			"styles",
+			map[string]any{"album_id": alb.BasicInfo.Id, "name": st},
+		); err != nil {
+			return c, err
+		}
+	}
+
+	for i, f := range alb.BasicInfo.Formats {
+		qty, err := strconv.Atoi(f.Qty)
+		if err != nil {
+			qty = 1
+		}
+		if err := s.insert(
+			ctx,
+			tx,
+			"formats",
+			map[string]any{
+				"album_id":     alb.BasicInfo.Id,
+				"position":     i,
+				"name":         f.Name,
+				"qty":          qty,
+				"descriptions": strings.Join(f.Descriptions, ", "),
+				"text":         f.Text,
+			},
+		); err != nil {
+			return c, err
+		}
+	}
+
+	return c, s.indexAlbum(ctx, tx, alb.BasicInfo.Id)
+}
+
+// indexAlbum replaces the album's row of the full-text index
+func (s *sqlite) indexAlbum(ctx context.Context, tx *sqlx.Tx, id int) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM album_search WHERE rowid = ?", id); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, _index_album, sql.Named("id", id))
+	return err
+}
+
+// removeUnsynced tombstones albums of the user that were not touched by a
+// full sync that started at t, i.e. albums no longer in their collection, and
+// returns them. Other users' copies are left alone.
+func (s *sqlite) removeUnsynced(ctx context.Context, tx *sqlx.Tx, t int64) ([]Album, error) {
+	var removed []Album
+	err := tx.SelectContext(
+		ctx,
+		&removed,
+		`SELECT
+			albums.id,
+			albums.title,
+			group_concat(artists.name, ' ') AS artist,
+			albums.year,
+			collection.rating
+		FROM albums
+		INNER JOIN collection ON albums.id = collection.album_id
+		INNER JOIN albums_artists ON albums.id = albums_artists.album_id
+		INNER JOIN artists ON albums_artists.artist_id = artists.id
+		WHERE collection.user = ?
+			AND collection.deleted_at IS NULL
+			AND ifnull(collection.synced_at, 0) < ?
+		GROUP BY albums.id`,
+		s.user,
+		t,
+	)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(
+		ctx,
+		`UPDATE collection SET deleted_at = ?
+		WHERE user = ? AND deleted_at IS NULL AND ifnull(synced_at, 0) < ?`,
+		now().Unix(),
+		s.user,
+		t,
+	)
+	return removed, err
+}
+
+// hasInstance reports whether the collection item is already stored.
+func (s *sqlite) hasInstance(ctx context.Context, instanceId int) (bool, error) {
+	n, err := query[int](
+		ctx,
+		s,
+		"SELECT count(*) FROM collection WHERE user = ? AND instance_id = ?",
+		s.user,
+		instanceId,
+	)
+	if err != nil {
+		return false, err
+	}
+	return n[0] > 0, nil
+}
+
+// syncState returns the checkpoint of the user's last sync; a user that was
+// never synced gets the zero value.
+func (s *sqlite) syncState(ctx context.Context, user string) (syncState, error) {
+	st := syncState{User: user}
+	err := s.db.GetContext(ctx, &st, "SELECT * FROM sync_state WHERE user = ?", user)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return st, wrapErr(err)
+	}
+	return st, nil
+}
+
+func (s *sqlite) saveSyncState(ctx context.Context, tx *sqlx.Tx, st syncState) error {
+	return s.insert(
+		ctx,
+		tx,
+		"sync_state",
+		map[string]any{
+			"user":       st.User,
+			"page":       st.Page,
+			"started":    st.Started,
+			"newest":     st.Newest,
+			"last_added": st.LastAdded,
+			"full":       st.Full,
+		},
+	)
+}
+
+func (s *sqlite) InsertBatch(ctx context.Context, rels []Release) ([]change, error) {
+	var changes []change
+	err := s.inTx(ctx, func(tx *sqlx.Tx) (err error) {
+		changes, err = s.insertAlbums(ctx, tx, rels)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+func (s *sqlite) insertPage(ctx context.Context, rels []Release, st syncState) ([]change, error) {
+	var changes []change
+	err := s.inTx(ctx, func(tx *sqlx.Tx) (err error) {
+		if changes, err = s.insertAlbums(ctx, tx, rels); err != nil {
+			return err
+		}
+		return s.saveSyncState(ctx, tx, st)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+func (s *sqlite) insertAlbums(ctx context.Context, tx *sqlx.Tx, rels []Release) ([]change, error) {
+	var changes []change
+	for _, rel := range rels {
+		c, err := s.InsertAlbum(ctx, tx, rel)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+func (s *sqlite) finishSync(ctx context.Context, st syncState, full bool) ([]Album, error) {
+	var removed []Album
+	err := s.inTx(ctx, func(tx *sqlx.Tx) (err error) {
+		if full {
+			if removed, err = s.removeUnsynced(ctx, tx, st.Started); err != nil {
+				return err
+			}
+		}
+		st.Page = 0
+		st.Started = 0
+		st.Newest = 0
+		st.Full = false
+		return s.saveSyncState(ctx, tx, st)
+	})
+	if err != nil {
+		return nil, err
 	}
+	return removed, nil
 }
 
 // wrapper over sqlx.NamedExec (which guards against sql injection). maybe gorm
 // is easier, but i will hold off for now
 func (s *sqlite) insert(
+	ctx context.Context,
 	tx *sqlx.Tx,
 	table string,
 	m map[string]any,
-) {
+) error {
 	// https://jmoiron.github.io/sqlx/#namedParams
 	// INSERT OR IGNORE INTO albums
 	//         (title,year,rating,date_added,id)
@@ -167,10 +682,10 @@ func (s *sqlite) insert(
 	VALUES
 		(` + strings.Join(ckeys, ",") + `)
 	`
-	_, err := tx.NamedExec(query, m)
-	if err != nil {
-		panic(err)
+	if _, err := tx.NamedExecContext(ctx, query, m); err != nil {
+		return fmt.Errorf("%s: %w", table, err)
 	}
+	return nil
 }
 
 // excluding columns is just not a thing in sql; don't bother
@@ -181,10 +696,11 @@ func (s *sqlite) insert(
 // func (s *sqlite)query[T any]( query string, _ []T) []T {}
 
 func query[T any](
+	ctx context.Context,
 	s *sqlite,
 	query string,
 	args ...any, // not ...string!
-) []T { // {{{
+) ([]T, error) { // {{{
 	// When making a query, two things are required: the query string, and
 	// the expected structure in which to store the result.
 	//
@@ -210,30 +726,573 @@ func query[T any](
 	// typical json.Unmarshal call.
 
 	var rows []T
-	if err := s.db.Select(&rows, query, args...); err != nil {
-		panic(err)
+	if err := s.db.SelectContext(ctx, &rows, query, args...); err != nil {
+		return nil, wrapErr(err)
 	}
-	// if len(args) > 0 {
-	// 	if err := s.db.Select(&rows, query, args...); err != nil {
-	// 		panic(err)
-	// 	}
-	// } else {
-	// 	if err := s.db.Select(&rows, query); err != nil {
-	// 		panic(err)
-	// 	}
-	// }
-	return rows
+	return rows, nil
 } // }}}
 
-// RandomAlbum selects a random album with rating >= 3
-func (s *sqlite) RandomAlbum() []SimpleRow {
-	return query[SimpleRow](s, _select_random)
+// args binds the filter to the :named params of filter.sql. Every param must
+// be bound, even if its value is empty.
+//
+// sqlx.Named is not used, as it chokes on colons in comments (e.g. urls).
+// sqlite understands named params natively.
+func (f Filter) args() []any {
+	return []any{
+		sql.Named("artist", f.Artist),
+		sql.Named("title", f.Title),
+		sql.Named("year_min", f.YearMin),
+		sql.Named("year_max", f.YearMax),
+		sql.Named("min_rating", f.MinRating),
+		sql.Named("genre", f.Genre),
+		sql.Named("style", f.Style),
+		sql.Named("label", f.Label),
+		sql.Named("group_masters", f.GroupMasters),
+		sql.Named("query", ftsQuery(f.Query)),
+	}
+}
+
+// filterArgs binds the filter, and the user whose collection is queried
+func (s *sqlite) filterArgs(f Filter) []any {
+	return append(f.args(), sql.Named("user", s.user))
+}
+
+// withFilter prepends filter.sql to a query, as the CTE "filtered"
+func withFilter(query string) string {
+	return "WITH filtered AS (\n" + _filter + "\n)\n" + query
+}
+
+func (s *sqlite) RandomAlbum(ctx context.Context, f Filter, n int) ([]Album, error) {
+	f.MinRating = max(f.MinRating, 3)
+	cands, err := query[candidate](ctx, s, withFilter(_select_random), s.filterArgs(f)...)
+	if err != nil {
+		return nil, err
+	}
+	for i, c := range cands {
+		for _, id := range strings.Split(c.ArtistIdsStr, ",") {
+			n, err := strconv.Atoi(id)
+			if err != nil {
+				return nil, fmt.Errorf("album %d: invalid artist id: %q", c.Id, id)
+			}
+			cands[i].ArtistIds = append(cands[i].ArtistIds, n)
+		}
+	}
+	recent, err := query[int](
+		ctx,
+		s,
+		_recent_artists,
+		sql.Named("n", artistCooldown),
+		sql.Named("user", s.user),
+	)
+	if err != nil {
+		return nil, err
+	}
+	picked := pickWeighted(cands, n, recent)
+
+	err = s.inTx(ctx, func(tx *sqlx.Tx) error {
+		for _, alb := range picked {
+			if err := s.insertPlay(ctx, tx, alb.Id, playSuggested); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return picked, nil
+}
+
+func (s *sqlite) insertPlay(ctx context.Context, tx *sqlx.Tx, albumId int, kind string) error {
+	_, err := tx.ExecContext(
+		ctx,
+		"INSERT INTO plays (user, album_id, played_at, kind) VALUES (?, ?, ?, ?)",
+		s.user,
+		albumId,
+		now().Unix(),
+		kind,
+	)
+	return err
+}
+
+func (s *sqlite) RecordPlay(ctx context.Context, albumId int) error {
+	return s.inTx(ctx, func(tx *sqlx.Tx) error {
+		return s.insertPlay(ctx, tx, albumId, playPlayed)
+	})
+}
+
+func (s *sqlite) Albums(ctx context.Context, f Filter, p Page) ([]Album, error) {
+	// wrapped, so that ORDER BY only sees the selected columns (and not
+	// e.g. artists.id)
+	order := p.orderBy(nil)
+	if p.Sort == sortRelevance && f.Query != "" {
+		// the better the match, the lower its bm25
+		dir := " ASC"
+		if p.Desc {
+			dir = " DESC"
+		}
+		order = `(
+			SELECT ` + ftsRank + ` FROM album_search
+			WHERE album_search MATCH :query AND album_search.rowid = id
+		)` + dir + ", " + order
+	}
+	q := withFilter("SELECT * FROM (\n"+_select_albums+"\n)") + "\nORDER BY " + order
+	args := s.filterArgs(f)
+	if p.Limit > 0 {
+		q += "\nLIMIT :limit OFFSET :offset"
+		args = append(args, sql.Named("limit", p.Limit), sql.Named("offset", p.Offset))
+	}
+	return query[Album](ctx, s, q, args...)
+}
+
+func (s *sqlite) CountAlbums(ctx context.Context, f Filter) (int, error) {
+	n, err := query[int](ctx, s, withFilter("SELECT count(*) FROM filtered"), s.filterArgs(f)...)
+	if err != nil {
+		return 0, err
+	}
+	return n[0], nil
 }
 
-func (s *sqlite) AllAlbumsFromArtist(artist string) []SimpleRow {
-	return query[SimpleRow](s, _select_all_from_artist, artist)
+func (s *sqlite) AlbumsByArtist(ctx context.Context, artist string) ([]Album, error) {
+	return query[Album](
+		ctx,
+		s,
+		_select_all_from_artist,
+		sql.Named("artist", artist),
+		sql.Named("user", s.user),
+	)
 }
 
-func (s *sqlite) RandomAlbumFromArtist(artist string) []string {
-	return query[string](s, _select_random_from_artist, artist)
+func (s *sqlite) ArtistById(ctx context.Context, id int) (*Artist, error) {
+	artists, err := query[Artist](ctx, s, "SELECT id, name FROM artists WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(artists) == 0 {
+		return nil, fmt.Errorf("artist %d: %w", id, errNotFound)
+	}
+	return &artists[0], nil
+}
+
+func (s *sqlite) ArtistStats(ctx context.Context, minAlbums int) ([]ArtistStat, error) {
+	return query[ArtistStat](
+		ctx,
+		s,
+		_artist_stats,
+		sql.Named("min_albums", minAlbums),
+		sql.Named("user", s.user),
+	)
+}
+
+func (s *sqlite) topArtistsByAvg(ctx context.Context, f Filter, minAlbums int, minAvg float64) ([]AvgResult, error) {
+	rows, err := query[AvgResult](
+		ctx,
+		s,
+		withFilter(_top_artists_by_avg_rating),
+		append(
+			s.filterArgs(f),
+			sql.Named("min_albums", minAlbums),
+			sql.Named("min_avg", minAvg),
+		)...,
+	)
+	for i := range rows {
+		rows[i].Albums = strings.Split(rows[i].AlbumsStr, "\x1f")
+	}
+	return rows, err
+}
+
+func (s *sqlite) topArtistsByTopN(ctx context.Context, f Filter, n int, minSum int) ([]TopNResult, error) {
+	rows, err := query[TopNResult](
+		ctx,
+		s,
+		withFilter(_top_artists_by_top_n_ratings),
+		append(
+			s.filterArgs(f),
+			sql.Named("n", n),
+			sql.Named("min_sum", minSum),
+		)...,
+	)
+	for i := range rows {
+		rows[i].Albums = strings.Split(rows[i].AlbumsStr, "\x1f")
+	}
+	return rows, err
+}
+
+func (s *sqlite) ratingsByYear(ctx context.Context, f Filter) ([]RatingDist, error) {
+	return query[RatingDist](ctx, s, withFilter(_ratings_by_year), s.filterArgs(f)...)
+}
+
+func (s *sqlite) ratingsByDecadeAdded(ctx context.Context, f Filter) ([]RatingDist, error) {
+	return query[RatingDist](ctx, s, withFilter(_ratings_by_decade_added), s.filterArgs(f)...)
+}
+
+func (s *sqlite) overlap(ctx context.Context, minOwners int, masters bool) ([]Overlap, error) {
+	rows, err := query[Overlap](
+		ctx,
+		s,
+		_overlap,
+		sql.Named("min_owners", minOwners),
+		sql.Named("group_masters", masters),
+	)
+	if err != nil {
+		return nil, err
+	}
+	for i := range rows {
+		rows[i].Ratings = parseRatings(rows[i].RatingsStr)
+	}
+	return rows, nil
+}
+
+// parseRatings parses the ratings of overlap.sql, i.e. "user:rating" pairs
+// delimited by char(31). Malformed pairs (e.g. of no ratings at all) are
+// skipped.
+func parseRatings(s string) map[string]int {
+	ratings := map[string]int{}
+	for _, pair := range strings.Split(s, "\x1f") {
+		// user names may contain colons (though Discogs' do not)
+		j := strings.LastIndex(pair, ":")
+		if j < 0 {
+			continue
+		}
+		ratings[pair[:j]], _ = strconv.Atoi(pair[j+1:])
+	}
+	return ratings
+}
+
+// unenriched is not scoped to the user; details are shared by all users.
+func (s *sqlite) unenriched(ctx context.Context) ([]int, error) {
+	// newest first, since those are most likely to be browsed
+	return query[int](
+		ctx,
+		s,
+		`SELECT album_id FROM collection
+		WHERE deleted_at IS NULL
+		AND album_id NOT IN (SELECT album_id FROM release_details)
+		GROUP BY album_id
+		ORDER BY max(date_added) DESC`,
+	)
+}
+
+func (s *sqlite) insertDetails(ctx context.Context, id int, d AlbumDetails) error {
+	return s.inTx(ctx, func(tx *sqlx.Tx) error {
+		err := s.insert(
+			ctx,
+			tx,
+			"release_details",
+			map[string]any{
+				"album_id":   id,
+				"notes":      d.Notes,
+				"cover":      d.Cover,
+				"fetched_at": now().Unix(),
+			},
+		)
+		if err != nil {
+			return err
+		}
+		for _, table := range []string{"tracks", "credits"} {
+			if _, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE album_id = ?", id); err != nil {
+				return err
+			}
+		}
+		for i, t := range d.Tracks {
+			if err := s.insert(
+				ctx,
+				tx,
+				"tracks",
+				map[string]any{
+					"album_id": id,
+					"position": i,
+					"number":   t.Number,
+					"title":    t.Title,
+					"duration": t.Duration,
+				},
+			); err != nil {
+				return err
+			}
+		}
+		for i, c := range d.Credits {
+			if err := s.insert(
+				ctx,
+				tx,
+				"credits",
+				map[string]any{
+					"album_id":  id,
+					"position":  i,
+					"artist_id": c.ArtistId,
+					"name":      c.Name,
+					"role":      c.Role,
+					"tracks":    c.Tracks,
+				},
+			); err != nil {
+				return err
+			}
+		}
+		return s.indexAlbum(ctx, tx, id)
+	})
+}
+
+func (s *sqlite) insertFailure(ctx context.Context, id int, reason error) error {
+	return s.inTx(ctx, func(tx *sqlx.Tx) error {
+		return s.insert(
+			ctx,
+			tx,
+			"release_details",
+			map[string]any{
+				"album_id":   id,
+				"fetched_at": now().Unix(),
+				"error":      reason.Error(),
+			},
+		)
+	})
+}
+
+func (s *sqlite) details(ctx context.Context, id int) (*AlbumDetails, error) {
+	var d AlbumDetails
+	err := s.db.GetContext(
+		ctx,
+		&d,
+		"SELECT notes, cover FROM release_details WHERE album_id = ? AND error = ''",
+		id,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, wrapErr(err)
+	}
+	if d.Tracks, err = query[Track](
+		ctx,
+		s,
+		"SELECT number, title, duration FROM tracks WHERE album_id = ? ORDER BY position",
+		id,
+	); err != nil {
+		return nil, err
+	}
+	if d.Credits, err = query[Credit](
+		ctx,
+		s,
+		"SELECT artist_id, name, role, tracks FROM credits WHERE album_id = ? ORDER BY position",
+		id,
+	); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (s *sqlite) Search(ctx context.Context, q string) ([]Album, error) {
+	if ftsQuery(q) == "" {
+		return nil, nil
+	}
+	return s.Albums(ctx, Filter{Query: q}, Page{Sort: sortRelevance})
+}
+
+func (s *sqlite) insertListens(ctx context.Context, ls []scrobble) (int, error) {
+	added := 0
+	err := s.inTx(ctx, func(tx *sqlx.Tx) error {
+		if err := s.ensureUser(ctx, tx); err != nil {
+			return err
+		}
+		for _, l := range ls {
+			res, err := tx.ExecContext(
+				ctx,
+				`INSERT OR IGNORE INTO listens
+				(user, listened_at, artist, track, album, source)
+				VALUES (?, ?, ?, ?, ?, ?)`,
+				s.user,
+				l.ListenedAt,
+				l.Artist,
+				l.Track,
+				l.Album,
+				l.Source,
+			)
+			if err != nil {
+				return err
+			}
+			n, _ := res.RowsAffected()
+			added += int(n)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return added, nil
+}
+
+func (s *sqlite) unmatchedListens(ctx context.Context) ([]unmatchedAlbum, error) {
+	return query[unmatchedAlbum](
+		ctx,
+		s,
+		`SELECT artist, album, count(*) AS listens FROM listens
+		WHERE user = ? AND album_id IS NULL
+		GROUP BY artist, album
+		ORDER BY listens DESC, artist ASC, album ASC`,
+		s.user,
+	)
+}
+
+func (s *sqlite) matchListens(ctx context.Context, matches map[listenedAlbum]int) error {
+	return s.inTx(ctx, func(tx *sqlx.Tx) error {
+		for alb, id := range matches {
+			_, err := tx.ExecContext(
+				ctx,
+				`UPDATE listens SET album_id = ?
+				WHERE user = ? AND artist = ? AND album = ? AND album_id IS NULL`,
+				id,
+				s.user,
+				alb.Artist,
+				alb.Album,
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqlite) albumListens(ctx context.Context, f Filter) ([]ListenCount, error) {
+	return query[ListenCount](ctx, s, withFilter(_album_listens), s.filterArgs(f)...)
+}
+
+// releases returns up to n albums of the collection as releases, in order of
+// id, starting after the given id
+func (s *sqlite) releases(ctx context.Context, after int, n int) ([]Release, error) {
+	rows, err := query[struct {
+		Id         int
+		Title      string
+		Year       int
+		MasterId   int `db:"master_id"`
+		InstanceId int `db:"instance_id"`
+		Rating     int
+		DateAdded  int64          `db:"date_added"`
+		ArtistsStr sql.NullString `db:"artists_str"`
+		LabelsStr  sql.NullString `db:"labels_str"`
+		GenresStr  sql.NullString `db:"genres_str"`
+		StylesStr  sql.NullString `db:"styles_str"`
+	}](
+		ctx,
+		s,
+		_select_releases,
+		sql.Named("user", s.user),
+		sql.Named("after", after),
+		sql.Named("n", n),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	split := func(ns sql.NullString) []string {
+		if !ns.Valid {
+			return nil
+		}
+		return strings.Split(ns.String, "\x1e")
+	}
+	var rels []Release
+	for _, row := range rows {
+		var rel Release
+		rel.DateAdded = time.Unix(row.DateAdded, 0).UTC().Format(time.RFC3339)
+		rel.InstanceId = row.InstanceId
+		rel.Rating = row.Rating
+		rel.BasicInfo.Id = row.Id
+		rel.BasicInfo.MasterId = row.MasterId
+		rel.BasicInfo.Title = row.Title
+		rel.BasicInfo.Year = row.Year
+		rel.BasicInfo.Genres = split(row.GenresStr)
+		rel.BasicInfo.Styles = split(row.StylesStr)
+		for _, a := range split(row.ArtistsStr) {
+			id, name, _ := strings.Cut(a, "\x1f")
+			n, err := strconv.Atoi(id)
+			if err != nil {
+				return nil, fmt.Errorf("album %d: invalid artist id: %q", row.Id, id)
+			}
+			rel.BasicInfo.Artists = append(rel.BasicInfo.Artists, Artist{Id: n, Name: name})
+		}
+		for _, l := range split(row.LabelsStr) {
+			fields := strings.SplitN(l, "\x1f", 3)
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("album %d: invalid label: %q", row.Id, l)
+			}
+			n, err := strconv.Atoi(fields[0])
+			if err != nil {
+				return nil, fmt.Errorf("album %d: invalid label id: %q", row.Id, fields[0])
+			}
+			rel.BasicInfo.Labels = append(rel.BasicInfo.Labels, Label{Id: n, Name: fields[1], Catno: fields[2]})
+		}
+		rels = append(rels, rel)
+	}
+	return rels, nil
+}
+
+// history returns the plays of the collection, and when each album was last
+// listened to
+func (s *sqlite) history(ctx context.Context) (history, error) {
+	var h history
+	var err error
+	h.Plays, err = query[play](
+		ctx,
+		s,
+		"SELECT album_id, played_at, kind FROM plays WHERE user = ? ORDER BY id",
+		s.user,
+	)
+	if err != nil {
+		return h, err
+	}
+	h.Listens, err = query[play](
+		ctx,
+		s,
+		`SELECT album_id, max(listened_at) AS played_at, '' AS kind FROM listens
+		WHERE user = ? AND album_id IS NOT NULL
+		GROUP BY album_id ORDER BY album_id`,
+		s.user,
+	)
+	return h, err
+}
+
+// users lists the users that have a collection
+func (s *sqlite) users(ctx context.Context) ([]string, error) {
+	return query[string](ctx, s, "SELECT name FROM users ORDER BY name")
+}
+
+func (s *sqlite) replaceLibrary(ctx context.Context, dirs []libraryDir) error {
+	return s.inTx(ctx, func(tx *sqlx.Tx) error {
+		if err := s.ensureUser(ctx, tx); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM library WHERE user = ?", s.user); err != nil {
+			return err
+		}
+		for _, d := range dirs {
+			var albumId sql.NullInt64
+			if d.AlbumId != 0 {
+				albumId = sql.NullInt64{Int64: int64(d.AlbumId), Valid: true}
+			}
+			_, err := tx.ExecContext(
+				ctx,
+				`INSERT INTO library (user, path, artist, title, year, album_id)
+				VALUES (?, ?, ?, ?, ?, ?)`,
+				s.user,
+				d.Path,
+				d.Artist,
+				d.Title,
+				d.Year,
+				albumId,
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqlite) Close() error { return s.db.Close() }
+
+func (s *sqlite) RandomAlbumFromArtist(ctx context.Context, artist string) ([]string, error) {
+	return query[string](
+		ctx,
+		s,
+		_select_random_from_artist,
+		sql.Named("artist", artist),
+		sql.Named("user", s.user),
+	)
 }
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInsertAlbumDetails(t *testing.T) {
+	ctx := context.Background()
+	s := Must(openSqlite(":memory:"))
+
+	rel := newRelease(1, time.Now())
+	rel.Rating = 4
+	rel.BasicInfo.Genres = []string{"Rock", "Pop"}
+	rel.BasicInfo.Styles = []string{"Shoegaze"}
+	rel.BasicInfo.Labels = []Label{
+		{Id: 7, Name: "Creation Records", Catno: "CRE 1"},
+		{Id: 7, Name: "Creation Records", Catno: "CRE 1 CD"},
+	}
+	rel.BasicInfo.Formats = []Format{
+		{Name: "Vinyl", Qty: "2", Descriptions: []string{"LP", "Album"}},
+		{Name: "CD", Qty: "1"},
+	}
+
+	other := newRelease(2, time.Now())
+	other.Rating = 5
+	other.BasicInfo.Genres = []string{"Jazz"}
+
+	tx := s.db.MustBegin()
+	Must(s.InsertAlbum(ctx, tx, rel))
+	Must(s.InsertAlbum(ctx, tx, other))
+	assert.NoError(t, tx.Commit())
+
+	var catnos []string
+	assert.NoError(t, s.db.Select(&catnos, "SELECT catno FROM albums_labels WHERE album_id = 1 ORDER BY catno"))
+	assert.Equal(t, []string{"CRE 1", "CRE 1 CD"}, catnos)
+
+	var formats []struct {
+		Name         string
+		Qty          int
+		Descriptions string
+	}
+	assert.NoError(t, s.db.Select(&formats, "SELECT name, qty, descriptions FROM formats WHERE album_id = 1 ORDER BY position"))
+	assert.Len(t, formats, 2)
+	assert.Equal(t, 2, formats[0].Qty)
+	assert.Equal(t, "LP, Album", formats[0].Descriptions)
+
+	// reinserting replaces, rather than appends
+	rel.BasicInfo.Genres = []string{"Rock"}
+	tx = s.db.MustBegin()
+	Must(s.InsertAlbum(ctx, tx, rel))
+	assert.NoError(t, tx.Commit())
+	var genres []string
+	assert.NoError(t, s.db.Select(&genres, "SELECT name FROM genres WHERE album_id = 1"))
+	assert.Equal(t, []string{"Rock"}, genres)
+
+	for _, test := range []struct {
+		filter   Filter
+		expected []string
+	}{
+		{Filter{Genre: "rock"}, []string{"Album 1"}},
+		{Filter{Genre: "Jazz"}, []string{"Album 2"}},
+		{Filter{Style: "Shoegaze", Label: "Creation Records"}, []string{"Album 1"}},
+		{Filter{Genre: "Jazz", Label: "Creation Records"}, nil},
+		{Filter{Genre: "Pop"}, nil},
+	} {
+		assert.Equal(t, test.expected, titles(Must(s.Albums(ctx, test.filter, Page{}))), test.filter)
+	}
+}
+
+func TestSqliteMultiUser(t *testing.T) {
+	ctx := context.Background()
+	s := Must(openSqlite(":memory:"))
+	defer s.Close()
+
+	rel := func(id int, rating int) Release {
+		r := newRelease(id, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+		r.Rating = rating
+		return r
+	}
+	alice := Must(s.ForUser(ctx, "alice"))
+	assert.Equal(t, []change{albumAdded, albumAdded}, Must(alice.InsertBatch(ctx, []Release{rel(1, 5), rel(2, 4)})))
+
+	// with a single user, none needs to be chosen
+	assert.Equal(t, 2, Must(Must(s.ForUser(ctx, "")).CountAlbums(ctx, Filter{})))
+
+	// album 1 is shared, but rated differently
+	bob := Must(s.ForUser(ctx, "bob"))
+	assert.Equal(t, []change{albumAdded, albumAdded}, Must(bob.InsertBatch(ctx, []Release{rel(1, 2), rel(3, 3)})))
+	_, err := s.ForUser(ctx, "")
+	assert.ErrorContains(t, err, "choose one with -user")
+	assert.Equal(t, []string{"Album 1", "Album 2"}, titles(Must(alice.Albums(ctx, Filter{}, Page{}))))
+	assert.Equal(t, []string{"Album 1", "Album 3"}, titles(Must(bob.Albums(ctx, Filter{}, Page{}))))
+	assert.Equal(t, []string{"Album 1"}, titles(Must(alice.Albums(ctx, Filter{MinRating: 5}, Page{}))))
+	assert.Empty(t, Must(bob.Albums(ctx, Filter{MinRating: 5}, Page{})))
+	assert.Equal(t, 2, Must(bob.AlbumsByArtist(ctx, "Artist 1"))[0].Rating)
+
+	// plays are per user, so alice's picks do not affect bob's
+	assert.NoError(t, alice.RecordPlay(ctx, 1))
+	var plays int
+	assert.NoError(t, s.db.Get(&plays, "SELECT count(*) FROM plays WHERE user = 'bob'"))
+	assert.Equal(t, 0, plays)
+
+	assert.Equal(
+		t,
+		[]Overlap{{
+			Id:         1,
+			Artist:     "Artist 1",
+			Title:      "Album 1",
+			Owners:     2,
+			Spread:     3,
+			RatingsStr: "alice:5\x1fbob:2",
+			Ratings:    map[string]int{"alice": 5, "bob": 2},
+		}},
+		Must(s.overlap(ctx, 2, false)),
+	)
+	assert.Len(t, Must(s.overlap(ctx, 1, false)), 3)
+
+	// a full sync of alice's collection that touched nothing removes only
+	// her copies
+	cp := alice.(checkpointer)
+	assert.True(t, Must(cp.hasInstance(ctx, 20)))
+	assert.False(t, Must(bob.(checkpointer).hasInstance(ctx, 20)))
+	removed := Must(cp.finishSync(ctx, syncState{User: "alice", Started: now().Unix() + 1}, true))
+	assert.Equal(t, []string{"Album 1", "Album 2"}, titles(removed))
+	assert.Equal(t, 0, Must(alice.CountAlbums(ctx, Filter{})))
+	assert.Equal(t, 2, Must(bob.CountAlbums(ctx, Filter{})))
+	assert.Empty(t, Must(s.overlap(ctx, 2, false)))
+
+	var b strings.Builder
+	assert.NoError(t, stats(ctx, bob, []string{"-report", "overlap", "-min-owners", "1", "-format", "csv"}, &b))
+	assert.Equal(t, "artist,title,owners,spread,ratings\nArtist 1,Album 1,1,0,bob:2\nArtist 3,Album 3,1,0,bob:3\n", b.String())
+}
+
+func TestParseRatings(t *testing.T) {
+	for s, expected := range map[string]map[string]int{
+		"":                    {},
+		"alice:5\x1fbob:2":    {"alice": 5, "bob": 2},
+		"a:b:3":               {"a:b": 3},
+		"alice:5\x1fnocolon":  {"alice": 5},
+		"alice:5\x1f\x1fbob:": {"alice": 5, "bob": 0},
+	} {
+		assert.Equal(t, expected, parseRatings(s), s)
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// statser is implemented by stores that can run the analytical queries of
+// `disq stats`. Queries consider the albums of the store's user that match f.
+type statser interface {
+	// topArtistsByAvg lists artists with at least minAlbums albums, whose
+	// average rating is at least minAvg
+	topArtistsByAvg(ctx context.Context, f Filter, minAlbums int, minAvg float64) ([]AvgResult, error)
+
+	// topArtistsByTopN lists artists whose n best ratings add up to at
+	// least minSum
+	topArtistsByTopN(ctx context.Context, f Filter, n int, minSum int) ([]TopNResult, error)
+
+	ratingsByYear(ctx context.Context, f Filter) ([]RatingDist, error)
+	ratingsByDecadeAdded(ctx context.Context, f Filter) ([]RatingDist, error)
+
+	// overlap lists albums owned by at least minOwners users (of any user,
+	// not just the store's), most disputed first. If masters is set,
+	// pressings of the same master release count as the same album.
+	overlap(ctx context.Context, minOwners int, masters bool) ([]Overlap, error)
+}
+
+type (
+	AvgResult struct {
+		Artist    string   `json:"artist"`
+		N         int      `json:"n"`
+		AvgR      float32  `json:"avg_rating" db:"avg_rating"`
+		AlbumsStr string   `json:"-" db:"albums_str"`
+		Albums    []string `json:"albums" db:"-"` // i forgot the meaning of -
+	}
+
+	TopNResult struct {
+		Artist    string   `json:"artist"`
+		Sum       int      `json:"sum"`
+		AlbumsStr string   `json:"-" db:"albums_str"`
+		Albums    []string `json:"albums" db:"-"` // best first
+	}
+
+	// RatingDist counts the albums of a period (e.g. a year) per rating
+	RatingDist struct {
+		Period    int     `json:"period"`
+		Albums    int     `json:"albums"`
+		AvgRating float64 `json:"avg_rating" db:"avg_rating"` // of rated albums
+		Unrated   int     `json:"unrated"`
+		R1        int     `json:"r1"`
+		R2        int     `json:"r2"`
+		R3        int     `json:"r3"`
+		R4        int     `json:"r4"`
+		R5        int     `json:"r5"`
+	}
+
+	// Overlap is an album owned by several users
+	Overlap struct {
+		Id         int            `json:"id"`
+		Artist     string         `json:"artist"`
+		Title      string         `json:"title"`
+		Owners     int            `json:"owners"`
+		Spread     int            `json:"spread"` // highest minus lowest rating
+		RatingsStr string         `json:"-" db:"ratings_str"`
+		Ratings    map[string]int `json:"ratings" db:"-"` // by user; 0 if unrated
+	}
+)
+
+func (r AvgResult) record() []string {
+	return []string{
+		r.Artist,
+		strconv.Itoa(r.N),
+		fmt.Sprintf("%.2f", r.AvgR),
+		strings.Join(r.Albums, ", "),
+	}
+}
+
+func (r TopNResult) record() []string {
+	return []string{r.Artist, strconv.Itoa(r.Sum), strings.Join(r.Albums, ", ")}
+}
+
+func (r RatingDist) record() []string {
+	rec := []string{strconv.Itoa(r.Period), strconv.Itoa(r.Albums), fmt.Sprintf("%.2f", r.AvgRating)}
+	for _, n := range []int{r.Unrated, r.R1, r.R2, r.R3, r.R4, r.R5} {
+		rec = append(rec, strconv.Itoa(n))
+	}
+	return rec
+}
+
+func (r Overlap) record() []string {
+	var ratings []string
+	for _, user := range slices.Sorted(maps.Keys(r.Ratings)) {
+		ratings = append(ratings, fmt.Sprintf("%s:%d", user, r.Ratings[user]))
+	}
+	return []string{
+		r.Artist,
+		r.Title,
+		strconv.Itoa(r.Owners),
+		strconv.Itoa(r.Spread),
+		strings.Join(ratings, " "),
+	}
+}
+
+var ratingDistHeader = []string{"albums", "avg_rating", "unrated", "1", "2", "3", "4", "5"}
+
+// report is the result of one stats query, which can be printed as a table or
+// csv (via records), or as json (via rows, as is)
+type report struct {
+	name    string
+	header  []string
+	records [][]string
+	rows    any
+}
+
+func newReport[T interface{ record() []string }](name string, header []string, rows []T) report {
+	r := report{name: name, header: header, rows: rows}
+	if rows == nil {
+		r.rows = []T{}
+	}
+	for _, row := range rows {
+		r.records = append(r.records, row.record())
+	}
+	return r
+}
+
+// statsReports are the names of the reports, in the order they are printed
+var statsReports = []string{"avg", "top", "year", "decade", "overlap", "listens", "unheard"}
+
+// stats runs `disq stats` with the given args.
+func stats(ctx context.Context, store Store, args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	var (
+		which     = fs.String("report", "", "only run one report: "+strings.Join(statsReports, ", "))
+		format    = fs.String("format", "table", "output format: table, csv or json")
+		minAlbums = fs.Int("min-albums", 3, "avg: only consider artists with at least <n> albums")
+		minAvg    = fs.Float64("min-avg", 2.7, "avg: minimum average rating")
+		topN      = fs.Int("top", 3, "top: number of best albums of each artist")
+		minSum    = fs.Int("min-sum", 11, "top: minimum sum of ratings of the best albums")
+		minOwners = fs.Int("min-owners", 2, "overlap: only list albums owned by at least <n> users")
+		masters   = fs.Bool("masters", false, "count only the highest-rated pressing of each master release")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	st, ok := store.(statser)
+	if !ok {
+		return fmt.Errorf("stats: %w", errUnsupported)
+	}
+
+	names := statsReports
+	if *which != "" {
+		if !slices.Contains(statsReports, *which) {
+			return fmt.Errorf("unknown report: %s", *which)
+		}
+		names = []string{*which}
+	}
+	if *format == "csv" && len(names) > 1 {
+		return errors.New("csv output requires -report")
+	}
+
+	f := Filter{GroupMasters: *masters}
+	var reports []report
+	for _, name := range names {
+		var err error
+		switch name {
+		case "avg":
+			var rows []AvgResult
+			rows, err = st.topArtistsByAvg(ctx, f, *minAlbums, *minAvg)
+			reports = append(reports, newReport(
+				name,
+				[]string{"artist", "albums", "avg_rating", "titles"},
+				rows,
+			))
+		case "top":
+			var rows []TopNResult
+			rows, err = st.topArtistsByTopN(ctx, f, *topN, *minSum)
+			reports = append(reports, newReport(
+				name,
+				[]string{"artist", "sum", "titles"},
+				rows,
+			))
+		case "year":
+			var rows []RatingDist
+			rows, err = st.ratingsByYear(ctx, f)
+			reports = append(reports, newReport(
+				name,
+				append([]string{"year"}, ratingDistHeader...),
+				rows,
+			))
+		case "decade":
+			var rows []RatingDist
+			rows, err = st.ratingsByDecadeAdded(ctx, f)
+			reports = append(reports, newReport(
+				name,
+				append([]string{"decade_added"}, ratingDistHeader...),
+				rows,
+			))
+		case "overlap":
+			var rows []Overlap
+			rows, err = st.overlap(ctx, *minOwners, *masters)
+			reports = append(reports, newReport(
+				name,
+				[]string{"artist", "title", "owners", "spread", "ratings"},
+				rows,
+			))
+		case "listens", "unheard":
+			// most listened vs highest rated, and albums that were
+			// never listened to, best first
+			l, ok := store.(listener)
+			if !ok {
+				return fmt.Errorf("listens: %w", errUnsupported)
+			}
+			var all, rows []ListenCount
+			all, err = l.albumListens(ctx, f)
+			for _, r := range all {
+				if (r.Listens > 0) == (name == "listens") {
+					rows = append(rows, r)
+				}
+			}
+			reports = append(reports, newReport(
+				name,
+				[]string{"artist", "title", "rating", "listens", "last_listened"},
+				rows,
+			))
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	return writeReports(w, *format, reports)
+}
+
+// writeReports writes reports as tables, csv (only one report) or json
+func writeReports(w io.Writer, format string, reports []report) error {
+	switch format {
+	case "table":
+		for i, r := range reports {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			if len(reports) > 1 {
+				fmt.Fprintf(w, "# %s\n", r.name)
+			}
+			tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(tw, strings.Join(r.header, "\t"))
+			for _, rec := range r.records {
+				fmt.Fprintln(tw, strings.Join(rec, "\t"))
+			}
+			if err := tw.Flush(); err != nil {
+				return err
+			}
+		}
+
+	case "csv":
+		cw := csv.NewWriter(w)
+		_ = cw.Write(reports[0].header)
+		_ = cw.WriteAll(reports[0].records) // flushes
+		return cw.Error()
+
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if len(reports) == 1 {
+			return enc.Encode(reports[0].rows)
+		}
+		all := map[string]any{}
+		for _, r := range reports {
+			all[r.name] = r.rows
+		}
+		return enc.Encode(all)
+
+	default:
+		return fmt.Errorf("unknown format: %s", format)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStats(t *testing.T) {
+	ctx := context.Background()
+	s := Must(openSqlite(":memory:"))
+	defer s.Close()
+
+	rel := func(id int, artist string, year int, rating int, added time.Time) Release {
+		r := newRelease(id, added)
+		r.BasicInfo.Artists = []Artist{{Id: int(artist[0]), Name: artist}}
+		r.BasicInfo.Year = year
+		r.Rating = rating
+		return r
+	}
+	t0 := time.Date(2009, 6, 1, 0, 0, 0, 0, time.UTC)
+	t1 := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	Must(s.InsertBatch(ctx, []Release{
+		rel(1, "A", 1990, 5, t0),
+		rel(2, "A", 1990, 4, t0),
+		rel(3, "A", 1991, 2, t1),
+		rel(4, "B", 1991, 5, t1),
+		rel(5, "B", 1991, 5, t1),
+		rel(6, "C", 1991, 1, t1),
+		rel(7, "C", 1992, 1, t1),
+		rel(8, "C", 1992, 0, t1),
+	}))
+
+	assert.Equal(
+		t,
+		[]AvgResult{{
+			Artist:    "A",
+			N:         3,
+			AvgR:      11.0 / 3,
+			AlbumsStr: "Album 1\x1fAlbum 2\x1fAlbum 3",
+			Albums:    []string{"Album 1", "Album 2", "Album 3"},
+		}},
+		Must(s.topArtistsByAvg(ctx, Filter{}, 3, 2.7)),
+	)
+	assert.Len(t, Must(s.topArtistsByAvg(ctx, Filter{}, 2, 0)), 3)
+
+	top := Must(s.topArtistsByTopN(ctx, Filter{}, 2, 9))
+	assert.Equal(t, []string{"B", "A"}, []string{top[0].Artist, top[1].Artist})
+	assert.Equal(t, []int{10, 9}, []int{top[0].Sum, top[1].Sum})
+	assert.Equal(t, []string{"Album 1", "Album 2"}, top[1].Albums)
+
+	assert.Equal(
+		t,
+		[]RatingDist{
+			{Period: 1990, Albums: 2, AvgRating: 4.5, R4: 1, R5: 1},
+			{Period: 1991, Albums: 4, AvgRating: 13.0 / 4, R1: 1, R2: 1, R5: 2},
+			{Period: 1992, Albums: 2, AvgRating: 1, Unrated: 1, R1: 1},
+		},
+		Must(s.ratingsByYear(ctx, Filter{})),
+	)
+	decades := Must(s.ratingsByDecadeAdded(ctx, Filter{}))
+	assert.Len(t, decades, 2)
+	assert.Equal(t, []int{2000, 2020}, []int{decades[0].Period, decades[1].Period})
+
+	var b strings.Builder
+	assert.NoError(t, stats(ctx, s, []string{"-report", "top", "-top", "2", "-min-sum", "9", "-format", "csv"}, &b))
+	assert.Equal(t, "artist,sum,titles\nB,10,\"Album 4, Album 5\"\nA,9,\"Album 1, Album 2\"\n", b.String())
+
+	b.Reset()
+	assert.NoError(t, stats(ctx, s, []string{"-format", "json"}, &b))
+	var all map[string][]map[string]any
+	assert.NoError(t, json.Unmarshal([]byte(b.String()), &all))
+	assert.Len(t, all["year"], 3)
+	assert.Len(t, all["top"], 1) // 5+4+2
+
+	b.Reset()
+	assert.NoError(t, stats(ctx, s, []string{"-report", "year"}, &b))
+	assert.Equal(t, 4, strings.Count(b.String(), "\n"))
+	assert.True(t, strings.HasPrefix(b.String(), "year  albums  avg_rating"))
+
+	assert.Error(t, stats(ctx, s, []string{"-format", "csv"}, &b))
+	assert.Error(t, stats(ctx, s, []string{"-report", "foo"}, &b))
+	assert.Error(t, stats(ctx, nopCheckpointer{s}, nil, &b))
+
+	// a worse pressing of album 1
+	orig := rel(1, "A", 1990, 5, t0)
+	orig.BasicInfo.MasterId = 10
+	reissue := rel(9, "A", 1990, 3, t1)
+	reissue.BasicInfo.MasterId = 10
+	Must(s.InsertBatch(ctx, []Release{orig, reissue}))
+	assert.Equal(t, 3, Must(s.ratingsByYear(ctx, Filter{}))[0].Albums)
+	assert.Equal(t, 2, Must(s.ratingsByYear(ctx, Filter{GroupMasters: true}))[0].Albums)
+	albumsOfA := func(masters bool) int {
+		for _, r := range Must(s.topArtistsByAvg(ctx, Filter{GroupMasters: masters}, 1, 0)) {
+			if r.Artist == "A" {
+				return r.N
+			}
+		}
+		return 0
+	}
+	assert.Equal(t, 4, albumsOfA(false))
+	assert.Equal(t, 3, albumsOfA(true))
+}
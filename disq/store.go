@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Store is a backend that collections can be written to and queried from.
+// Each collection belongs to a user; a Store reads and writes the collection
+// of one user (see ForUser). Queries never return albums that were removed
+// from the collection.
+//
+// All methods (except Close) stop when ctx is done. Writes are atomic; a
+// write that fails (or is cancelled) changes nothing.
+type Store interface {
+	// ForUser returns a Store (sharing the same connection) for the
+	// collection of user. If user is empty, the only stored user is used
+	// (see onlyUser).
+	ForUser(ctx context.Context, user string) (Store, error)
+
+	// InsertBatch writes releases (typically a page of the collection),
+	// replacing any that are already stored, and reports what changed.
+	InsertBatch(ctx context.Context, rels []Release) ([]change, error)
+
+	// RandomAlbum picks up to n random albums with rating >= 3, weighted by
+	// rating and by time since last suggested or played (see
+	// pickWeighted), and records them as suggested
+	RandomAlbum(ctx context.Context, f Filter, n int) ([]Album, error)
+
+	// RecordPlay records that an album was played, so that it is picked
+	// less often
+	RecordPlay(ctx context.Context, albumId int) error
+
+	// Albums lists a page of the albums that match the filter
+	Albums(ctx context.Context, f Filter, p Page) ([]Album, error)
+
+	// CountAlbums counts the albums that match the filter, i.e. the total
+	// number of rows of all pages
+	CountAlbums(ctx context.Context, f Filter) (int, error)
+
+	// AlbumsByArtist lists all albums of an artist (matched exactly), oldest
+	// first
+	AlbumsByArtist(ctx context.Context, artist string) ([]Album, error)
+
+	// ArtistById looks up an artist, returning errNotFound if no album of
+	// theirs is stored
+	ArtistById(ctx context.Context, id int) (*Artist, error)
+
+	// ArtistStats aggregates the ratings of every artist with at least
+	// minAlbums albums, best first
+	ArtistStats(ctx context.Context, minAlbums int) ([]ArtistStat, error)
+
+	// Search lists albums that match a full-text query (see
+	// Filter.Query), best match first
+	Search(ctx context.Context, query string) ([]Album, error)
+
+	Close() error
+}
+
+// Errors of a Store that callers may want to tell apart (e.g. to pick an http
+// status). Backends wrap them, so they must be checked with errors.Is.
+var (
+	errNotFound = errors.New("not found")
+
+	// the backend cannot run the query, e.g. clickhouse keeps no listening
+	// history
+	errUnsupported = errors.New("not supported by this backend")
+
+	// the backend is busy (e.g. sqlite is locked by another writer) or
+	// unreachable; retrying later may succeed
+	errUnavailable = errors.New("temporarily unavailable")
+)
+
+type (
+	// Filter restricts the albums considered by a query. Empty fields
+	// match everything. Names are compared case-insensitively.
+	Filter struct {
+		Artist string // substring of any artist
+		Title  string // substring
+
+		// Query is a full-text search over artists, titles, labels and
+		// notes. Every word must match the start of a word, ignoring case
+		// and diacritics (e.g. "hand mess" matches Händel's Messiah).
+		Query     string
+		YearMin   int
+		YearMax   int
+		MinRating int
+
+		Genre string
+		Style string
+		Label string
+
+		// GroupMasters considers only one pressing of each master release
+		// (the highest-rated one), so that reissues are not counted twice
+		GroupMasters bool
+	}
+
+	// Page selects a window of sorted albums
+	Page struct {
+		Sort   string // one of sortColumns; artist if empty
+		Desc   bool
+		Offset int
+		Limit  int // 0 means no limit
+	}
+
+	// A row of any query that lists albums
+	Album struct {
+		Id     int    `json:"id"`
+		Title  string `json:"title"`
+		Artist string `json:"artist"` // all artists, " "-delimited
+		Year   int    `json:"year"`
+		Rating int    `json:"rating"`
+	}
+
+	ArtistStat struct {
+		Artist    string  `json:"artist"`
+		Albums    int     `json:"albums"`
+		AvgRating float64 `json:"avg_rating" db:"avg_rating"`
+	}
+)
+
+func (f Filter) empty() bool { return f == Filter{} }
+
+// Columns that albums can be sorted by. Ties are broken by artist, then year.
+var sortColumns = []string{"artist", "title", "year", "rating"}
+
+// Albums that match a Filter.Query can also be sorted by relevance, best
+// first. Backends that cannot rank sort by artist instead.
+const sortRelevance = "relevance"
+
+// orderBy returns the ORDER BY expression of a page, in terms of the columns
+// of the Album struct. Backends that name them differently pass the
+// differences in rename.
+func (p Page) orderBy(rename map[string]string) string {
+	col := "artist"
+	if slices.Contains(sortColumns, p.Sort) {
+		col = p.Sort
+	}
+	dir := " ASC"
+	if p.Desc {
+		dir = " DESC"
+	}
+	cols := []string{col + dir, "artist ASC", "year ASC", "id ASC"}
+	for i, c := range cols {
+		name, dir, _ := strings.Cut(c, " ")
+		if r, ok := rename[name]; ok {
+			cols[i] = r + " " + dir
+		}
+	}
+	return strings.Join(cols, ", ")
+}
+
+// onlyUser chooses the user of ForUser, if none was given. An empty db has no
+// users, and its collection is that of the unnamed user. With several users,
+// there is no sensible default; silently using the unnamed user would read
+// (and write to) a collection that belongs to nobody.
+func onlyUser(users []string) (string, error) {
+	switch len(users) {
+	case 0:
+		return "", nil
+	case 1:
+		return users[0], nil
+	}
+	return "", fmt.Errorf("%d users are stored (%s); choose one with -user", len(users), strings.Join(users, ", "))
+}
+
+// adopter is implemented by stores that may hold a collection of the unnamed
+// user (e.g. a sqlite db that was synced before users existed).
+type adopter interface {
+	// adoptUser renames the unnamed user to user, if they are the only
+	// user, and reports whether it did. The next sync of user then updates the
+	// existing collection, instead of storing a second copy.
+	adoptUser(ctx context.Context, user string) (bool, error)
+}
+
+// checkpointer is implemented by stores that can resume an interrupted sync,
+// and detect releases that were removed from the collection.
+type checkpointer interface {
+	syncState(ctx context.Context, user string) (syncState, error)
+	hasInstance(ctx context.Context, instanceId int) (bool, error)
+
+	// insertPage is InsertBatch, but also saves the checkpoint in the same
+	// transaction
+	insertPage(ctx context.Context, rels []Release, st syncState) ([]change, error)
+
+	// finishSync resets the checkpoint, and, after a full sync, tombstones
+	// the releases that it did not touch
+	finishSync(ctx context.Context, st syncState, full bool) ([]Album, error)
+}
+
+// Without a checkpoint, every sync is a full sync that starts from the first
+// page.
+type nopCheckpointer struct{ Store }
+
+func (n nopCheckpointer) syncState(_ context.Context, user string) (syncState, error) {
+	return syncState{User: user}, nil
+}
+
+func (n nopCheckpointer) hasInstance(context.Context, int) (bool, error) { return false, nil }
+
+func (n nopCheckpointer) insertPage(ctx context.Context, rels []Release, _ syncState) ([]change, error) {
+	return n.InsertBatch(ctx, rels)
+}
+
+func (n nopCheckpointer) finishSync(context.Context, syncState, bool) ([]Album, error) {
+	return nil, nil
+}
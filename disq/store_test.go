@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testStore checks that a Store behaves as documented. It expects an empty
+// store.
+func testStore(t *testing.T, store Store) {
+	ctx := context.Background()
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	rel := func(id int, artist string, title string, year int, rating int) Release {
+		r := newRelease(id, t0.AddDate(0, 0, id))
+		r.BasicInfo.Artists = []Artist{{Id: int(artist[len(artist)-1]), Name: artist}}
+		r.BasicInfo.Title = title
+		r.BasicInfo.Year = year
+		r.Rating = rating
+		return r
+	}
+	rels := []Release{
+		rel(1, "Artist A", "Alpha", 1990, 5),
+		rel(2, "Artist A", "Beta", 1985, 3),
+		rel(3, "Artist B", "Gamma", 2000, 1),
+		rel(4, "Artist C", "Delta", 2010, 4),
+	}
+	rels[3].BasicInfo.MasterId = 40
+
+	assert.Equal(
+		t,
+		[]change{albumAdded, albumAdded, albumAdded, albumAdded},
+		Must(store.InsertBatch(ctx, rels)),
+	)
+	rels[1].Rating = 4
+	assert.Equal(
+		t,
+		[]change{albumUnchanged, albumChanged},
+		Must(store.InsertBatch(ctx, rels[:2])),
+	)
+
+	assert.Equal(
+		t,
+		[]Album{
+			{Id: 2, Title: "Beta", Artist: "Artist A", Year: 1985, Rating: 4},
+			{Id: 1, Title: "Alpha", Artist: "Artist A", Year: 1990, Rating: 5},
+		},
+		Must(store.AlbumsByArtist(ctx, "Artist A")),
+	)
+	assert.Empty(t, Must(store.AlbumsByArtist(ctx, "Artist")))
+
+	assert.Equal(t, &Artist{Id: 'B', Name: "Artist B"}, Must(store.ArtistById(ctx, 'B')))
+	_, err := store.ArtistById(ctx, 1)
+	assert.ErrorIs(t, err, errNotFound)
+
+	for _, test := range []struct {
+		filter   Filter
+		page     Page
+		expected []string
+	}{
+		{Filter{}, Page{}, []string{"Beta", "Alpha", "Gamma", "Delta"}},
+		{Filter{}, Page{Sort: "title"}, []string{"Alpha", "Beta", "Delta", "Gamma"}},
+		{Filter{}, Page{Sort: "rating", Desc: true}, []string{"Alpha", "Beta", "Delta", "Gamma"}},
+		{Filter{}, Page{Sort: "year", Offset: 1, Limit: 2}, []string{"Alpha", "Gamma"}},
+		{Filter{}, Page{Sort: "; DROP TABLE albums"}, []string{"Beta", "Alpha", "Gamma", "Delta"}},
+		{Filter{YearMin: 1990, YearMax: 2000}, Page{}, []string{"Alpha", "Gamma"}},
+		{Filter{Artist: "a", MinRating: 5}, Page{}, []string{"Alpha"}},
+		{Filter{Title: "TA"}, Page{}, []string{"Beta", "Delta"}},
+		{Filter{Title: "'%"}, Page{}, nil},
+		{Filter{Query: "gam"}, Page{}, []string{"Gamma"}},
+		{Filter{Query: "gam", MinRating: 2}, Page{}, nil},
+	} {
+		assert.Equal(t, test.expected, titles(Must(store.Albums(ctx, test.filter, test.page))), test)
+		if test.page.Limit == 0 {
+			assert.Equal(t, len(test.expected), Must(store.CountAlbums(ctx, test.filter)), test)
+		}
+	}
+
+	defer func(n int) { artistCooldown = n }(artistCooldown)
+	artistCooldown = 2
+	random := Must(store.RandomAlbum(ctx, Filter{}, 10))
+	assert.Len(t, random, 2) // at most one album per artist
+	assert.Contains(t, titles(random), "Delta")
+	// both were just suggested, but the cooldown never leaves nothing
+	assert.Len(t, Must(store.RandomAlbum(ctx, Filter{}, 1)), 1)
+	assert.NoError(t, store.RecordPlay(ctx, 3))
+	assert.NoError(t, store.RecordPlay(ctx, 3))
+	assert.Len(t, Must(store.RandomAlbum(ctx, Filter{}, 10)), 2) // Gamma is rated too low
+	assert.Equal(t, []string{"Delta"}, titles(Must(store.RandomAlbum(ctx, Filter{Artist: "Artist C"}, 1))))
+
+	assert.Equal(
+		t,
+		[]ArtistStat{
+			{Artist: "Artist A", Albums: 2, AvgRating: 4.5},
+			{Artist: "Artist C", Albums: 1, AvgRating: 4},
+			{Artist: "Artist B", Albums: 1, AvgRating: 1},
+		},
+		Must(store.ArtistStats(ctx, 1)),
+	)
+	assert.Len(t, Must(store.ArtistStats(ctx, 2)), 1)
+
+	assert.Equal(t, []string{"Gamma"}, titles(Must(store.Search(ctx, "gam"))))
+	assert.Equal(t, []string{"Alpha"}, titles(Must(store.Search(ctx, "alp"))))
+	assert.Empty(t, Must(store.Search(ctx, "epsilon")))
+
+	// a better-rated reissue replaces the original
+	reissue := rel(5, "Artist C", "Delta (Remastered)", 2020, 5)
+	reissue.BasicInfo.MasterId = 40
+	Must(store.InsertBatch(ctx, []Release{reissue}))
+	grouped := Filter{GroupMasters: true}
+	assert.Equal(t, 5, Must(store.CountAlbums(ctx, Filter{})))
+	assert.Equal(t, 4, Must(store.CountAlbums(ctx, grouped)))
+	assert.Equal(
+		t,
+		[]string{"Beta", "Alpha", "Gamma", "Delta (Remastered)"},
+		titles(Must(store.Albums(ctx, grouped, Page{}))),
+	)
+	// representatives are chosen before filtering
+	assert.Empty(t, Must(store.Albums(ctx, Filter{YearMax: 2010, Title: "delta", GroupMasters: true}, Page{})))
+}
+
+func TestSqliteStore(t *testing.T) {
+	s := Must(openSqlite(":memory:"))
+	defer s.Close()
+	testStore(t, s)
+}
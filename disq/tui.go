@@ -1,31 +1,97 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/charmbracelet/bubbles/table" // NOT lipgloss/table!
+	"github.com/charmbracelet/bubbles/textinput"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
 )
 
+// Rows are fetched in windows of this size, so that large collections never
+// have to be loaded at once. The window is moved when the cursor leaves it.
+const windowSize = 200
+
+// Width of the tracklist pane
+const detailsWidth = 60
+
+// The filter inputs, in tab order
+const (
+	inputQuery = iota
+	inputArtist
+	inputTitle
+	inputYearMin
+	inputYearMax
+	inputRating
+	numInputs
+)
+
 type model struct {
-	table table.Model
+	ctx    context.Context // of all store queries
+	store  Store
+	player *Player // nil disables playback
+	table  table.Model
+	albums []Album // the rows of the table
+	status string  // result of the last player action or query
+
+	showDetails bool
+	details     *AlbumDetails // of the selected album; nil if not fetched
+	detailsId   int           // album that details belongs to
 
-	searching bool
-	input     string
+	inputs  []textinput.Model
+	focus   int  // index of the focused input; -1 if the table has focus
+	masters bool // see Filter.GroupMasters
+	filter  Filter
+	page    Page // Offset is the index of the first row in the table
+	total   int  // number of rows that match the filter
 }
 
-func sqlToTable(query string, args ...any) table.Model {
-	sqlRows := []JoinedRow{}
-	if err := s.db.Select(&sqlRows, query, args...); err != nil {
-		panic(err)
+func newModel(ctx context.Context, store Store, player *Player) *model {
+	m := &model{
+		ctx:    ctx,
+		store:  store,
+		player: player,
+		table: table.New(
+			table.WithColumns([]table.Column{
+				{Title: "Artist", Width: 40},
+				{Title: "Album", Width: 40},
+				{Title: "Year", Width: 4},
+				{Title: "Rating", Width: 6},
+			}),
+			table.WithFocused(true),
+			table.WithHeight(20),
+		),
+		focus: -1,
+		page:  Page{Sort: "artist", Limit: windowSize},
+	}
+
+	for i, p := range []string{"search", "artist", "title", "from", "to", "min rating"} {
+		in := textinput.New()
+		in.Prompt = ""
+		in.Placeholder = p
+		in.Width = 12
+		if i == inputQuery {
+			in.Width = 20
+		}
+		if i >= inputYearMin {
+			// non-numeric values are ignored
+			in.CharLimit = 4
+			in.Width = 10
+		}
+		m.inputs = append(m.inputs, in)
 	}
 
-	// fmt.Println(len(sqlRows), sqlRows[0])
+	m.applyFilter()
+	return m
+}
 
-	// table := sqlToTable(sqlRows[:50])
+func albumsToRows(albums []Album) []table.Row {
 	var rows []table.Row
-	for _, row := range sqlRows {
+	for _, row := range albums {
 		rows = append(rows, table.Row{
 			row.Artist,
 			row.Title,
@@ -33,37 +99,191 @@ func sqlToTable(query string, args ...any) table.Model {
 			strconv.Itoa(row.Rating),
 		})
 	}
+	return rows
+}
 
-	cols := []table.Column{
-		{Title: "Artist", Width: 40},
-		{Title: "Album", Width: 40},
-		{Title: "Year", Width: 4},
-		{Title: "Rating", Width: 6},
+// applyFilter rebuilds the filter from the inputs, and reloads the first
+// window. All filtering is done by the store (i.e. via sql). A new search is
+// sorted by relevance, until another sort order is chosen.
+func (m *model) applyFilter() {
+	atoi := func(i int) int {
+		n, _ := strconv.Atoi(m.inputs[i].Value())
+		return n
+	}
+	query := m.inputs[inputQuery].Value()
+	switch {
+	case query != "" && m.filter.Query == "":
+		m.page.Sort, m.page.Desc = sortRelevance, false
+	case query == "" && m.page.Sort == sortRelevance:
+		m.page.Sort, m.page.Desc = "artist", false
 	}
+	m.filter = Filter{
+		Query:     query,
+		Artist:    m.inputs[inputArtist].Value(),
+		Title:     m.inputs[inputTitle].Value(),
+		YearMin:   atoi(inputYearMin),
+		YearMax:   atoi(inputYearMax),
+		MinRating: atoi(inputRating),
 
-	return table.New(
-		table.WithColumns(cols),
-		table.WithRows(rows),
-	)
+		GroupMasters: m.masters,
+	}
+	total, err := m.store.CountAlbums(m.ctx, m.filter)
+	if err != nil {
+		m.status = err.Error()
+		return
+	}
+	m.total = total
+	m.load(0, 0)
+}
+
+// load fetches the window starting at row offset, and places the cursor on
+// the given row (relative to the whole result). On error, the current window
+// is kept.
+func (m *model) load(offset int, cursor int) {
+	page := m.page
+	page.Offset = max(0, min(offset, m.total-windowSize))
+	albums, err := m.store.Albums(m.ctx, m.filter, page)
+	if err != nil {
+		m.status = err.Error()
+		return
+	}
+	m.page, m.albums = page, albums
+	m.table.SetRows(albumsToRows(m.albums))
+	m.table.SetCursor(cursor - m.page.Offset)
 }
 
-func (m *model) filter() {
-	// TODO: textinput for each column
-	// TODO: buttons for sort field
-	m.table = sqlToTable(
-		`
-		SELECT * FROM collection WHERE artist LIKE '%`+m.input+`%'
-		ORDER BY year
-		`,
-		m.input,
+// move moves the cursor by n rows, moving the window if necessary.
+func (m *model) move(n int) {
+	pos := max(0, min(m.page.Offset+m.table.Cursor()+n, m.total-1))
+	if pos < m.page.Offset || pos >= m.page.Offset+len(m.table.Rows()) {
+		// center the window on the cursor
+		m.load(pos-windowSize/2, pos)
+		return
+	}
+	m.table.SetCursor(pos - m.page.Offset)
+}
+
+// sortBy sorts by the given column, or reverses the order if already sorted
+// by it. The cursor returns to the top.
+func (m *model) sortBy(col string) {
+	if m.page.Sort == col {
+		m.page.Desc = !m.page.Desc
+	} else {
+		m.page.Sort = col
+		m.page.Desc = false
+	}
+	m.load(0, 0)
+}
+
+// playerMsg reports the result of a player action
+type playerMsg struct {
+	status string
+	err    error
+}
+
+// playerCmd runs a player action in the background, since resolving an album
+// online may take a while.
+func (m *model) playerCmd(status string, action func() error) tea.Cmd {
+	if m.player == nil {
+		return nil
+	}
+	return func() tea.Msg {
+		return playerMsg{status: status, err: action()}
+	}
+}
+
+// selected returns the album under the cursor, if any
+func (m *model) selected() (Album, bool) {
+	i := m.table.Cursor()
+	if i < 0 || i >= len(m.albums) {
+		return Album{}, false
+	}
+	return m.albums[i], true
+}
+
+// play plays the selected album
+func (m *model) play() tea.Cmd {
+	alb, ok := m.selected()
+	if !ok {
+		return nil
+	}
+	return m.playerCmd(
+		"playing "+alb.Artist+" - "+alb.Title,
+		func() error {
+			if err := m.player.Play(alb.Artist, alb.Title); err != nil {
+				return err
+			}
+			return m.store.RecordPlay(m.ctx, alb.Id)
+		},
 	)
-	m.table.SetHeight(10)
+}
+
+// loadDetails loads the details of the selected album, if the pane is shown.
+// Details are fetched by `disq enrich`, never by the tui.
+func (m *model) loadDetails() {
+	e, ok := m.store.(enricher)
+	alb, selected := m.selected()
+	if !m.showDetails || !ok || !selected || alb.Id == m.detailsId {
+		return
+	}
+	d, err := e.details(m.ctx, alb.Id)
+	if err != nil {
+		m.status = err.Error()
+		return
+	}
+	m.details = d
+	m.detailsId = alb.Id
+}
+
+// detailsView renders the tracklist and credits of the selected album
+func (m *model) detailsView() string {
+	if m.details == nil {
+		return "no details; run disq enrich"
+	}
+	var b strings.Builder
+	for _, t := range m.details.Tracks {
+		dur := ""
+		if t.Duration > 0 {
+			dur = fmt.Sprintf(" (%d:%02d)", t.Duration/60, t.Duration%60)
+		}
+		fmt.Fprintf(&b, "%-4s %s%s\n", t.Number, t.Title, dur)
+	}
+	if len(m.details.Credits) > 0 {
+		b.WriteString("\n")
+	}
+	for _, c := range m.details.Credits {
+		fmt.Fprintf(&b, "%s: %s", c.Role, c.Name)
+		if c.Tracks != "" {
+			fmt.Fprintf(&b, " [%s]", c.Tracks)
+		}
+		b.WriteString("\n")
+	}
+	if m.details.Notes != "" {
+		b.WriteString("\n" + m.details.Notes)
+	}
+	return lipgloss.NewStyle().
+		Width(detailsWidth).
+		MaxHeight(m.table.Height() + 2). // header
+		PaddingLeft(2).
+		Render(b.String())
+}
+
+func (m *model) focusInput(i int) tea.Cmd {
+	if m.focus >= 0 {
+		m.inputs[m.focus].Blur()
+	}
+	m.focus = i
+	if i < 0 {
+		m.table.Focus()
+		return nil
+	}
+	m.table.Blur()
+	return m.inputs[i].Focus()
 }
 
 // Init is the first function that will be called. It returns an optional
 // initial command. To not perform an initial command return nil.
 func (m *model) Init() tea.Cmd {
-	m.table.SetHeight(10)
 	return nil
 }
 
@@ -71,57 +291,135 @@ func (m *model) Init() tea.Cmd {
 // and, in response, update the model and/or send a command.
 func (m *model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		// filter line, table header (with border), footer, player status
+		m.table.SetHeight(max(1, msg.Height-5))
+
+	case playerMsg:
+		m.status = msg.status
+		if msg.err != nil {
+			m.status = msg.err.Error()
+		}
+
 	case tea.KeyMsg:
 
-		if m.searching {
+		if m.focus >= 0 {
 			switch msg.String() {
 			case "enter":
-				m.filter()
-				m.searching = false
-				m.input = ""
-			case "backspace":
-				m.input = m.input[:len(m.input)-1]
-			default:
-				m.input += string(msg.Runes[0])
+				m.applyFilter()
+				return m, m.focusInput(-1)
+			case "esc":
+				return m, m.focusInput(-1)
+			case "tab":
+				return m, m.focusInput((m.focus + 1) % numInputs)
+			case "shift+tab":
+				return m, m.focusInput((m.focus + numInputs - 1) % numInputs)
 			}
-			break
+			var cmd tea.Cmd
+			m.inputs[m.focus], cmd = m.inputs[m.focus].Update(msg)
+			return m, cmd
 		}
 
 		switch msg.String() {
-		case "q":
+		case "q", "ctrl+c":
+			if m.player != nil {
+				_ = m.player.Stop()
+			}
 			return m, tea.Quit
 
+		case "enter", "p":
+			return m, m.play()
+		case "m":
+			m.masters = !m.masters
+			m.applyFilter()
+		case "t":
+			m.showDetails = !m.showDetails
+			m.detailsId = 0
+		case " ":
+			return m, m.playerCmd("", m.player.TogglePause)
+		case "n":
+			return m, m.playerCmd("", m.player.Next)
+		case "N":
+			return m, m.playerCmd("", m.player.Prev)
+		case "s":
+			return m, m.playerCmd("stopped", m.player.Stop)
+
 		case "/":
-			m.searching = true
+			return m, m.focusInput(inputQuery)
 
-		case "j":
-			m.table.MoveDown(1)
-		case "k":
-			m.table.MoveUp(1)
+		case "esc": // clear all filters
+			for i := range m.inputs {
+				m.inputs[i].SetValue("")
+			}
+			m.applyFilter()
+
+		case "1", "2", "3", "4":
+			i, _ := strconv.Atoi(msg.String())
+			m.sortBy(sortColumns[i-1])
+
+		case "j", "down":
+			m.move(1)
+		case "k", "up":
+			m.move(-1)
 
 		case "pgdown":
-			m.table.MoveDown(10)
+			m.move(m.table.Height())
 		case "pgup":
-			m.table.MoveUp(10)
+			m.move(-m.table.Height())
+
+		case "g", "home":
+			m.move(-m.total)
+		case "G", "end":
+			m.move(m.total)
 
 		}
 	}
+	m.loadDetails()
 	return m, nil
 }
 
 // View renders the program's UI, which is just a string. The view is
 // rendered after every Update.
 func (m *model) View() string {
-	var header string
-	switch m.searching {
-	case true:
-		header = "/" + m.input
-	case false:
-		header = "Searched: " + m.input
+	var filters []string
+	for _, in := range m.inputs {
+		filters = append(filters, in.View())
 	}
+
+	dir := "asc"
+	if m.page.Desc {
+		dir = "desc"
+	}
+	pos := 0
+	if m.total > 0 {
+		pos = m.page.Offset + m.table.Cursor() + 1
+	}
+	footer := fmt.Sprintf(
+		"%d/%d, sorted by %s (%s)",
+		pos,
+		m.total,
+		m.page.Sort,
+		dir,
+	)
+	if m.masters {
+		footer += ", one per master"
+	}
+	if m.focus < 0 {
+		footer += " | / search, esc clear, 1-4 sort, m group masters, t tracklist, p play, space pause, n/N next/prev, s stop, q quit"
+	} else {
+		footer += " | tab next field, enter apply, esc cancel"
+	}
+
+	tbl := m.table.View()
+	if m.showDetails {
+		tbl = lipgloss.JoinHorizontal(lipgloss.Top, tbl, m.detailsView())
+	}
+
 	return lipgloss.JoinVertical(
 		lipgloss.Left,
-		header,
-		m.table.View(),
+		"Filter: "+strings.Join(filters, " | "),
+		tbl,
+		footer,
+		m.status,
 	)
 }
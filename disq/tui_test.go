@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModelWindow(t *testing.T) {
+	ctx := context.Background()
+	s := Must(openSqlite(":memory:"))
+	defer s.Close()
+	Must(s.InsertBatch(ctx, newReleases(500)))
+
+	m := newModel(ctx, s, nil)
+	assert.Equal(t, 500, m.total)
+	assert.Len(t, m.table.Rows(), windowSize)
+
+	selected := func() string { return m.table.SelectedRow()[1] }
+	assert.Equal(t, "Album 1", selected())
+
+	// sorted by artist, as strings
+	m.move(windowSize - 1)
+	assert.Equal(t, 0, m.page.Offset)
+	m.move(1)
+	assert.Equal(t, windowSize/2, m.page.Offset)
+	assert.Equal(t, titles(Must(s.Albums(ctx, Filter{}, Page{Offset: windowSize, Limit: 1})))[0], selected())
+
+	m.move(1000)
+	assert.Equal(t, 500-windowSize, m.page.Offset)
+	assert.Equal(t, "Album 99", selected())
+	m.move(-1000)
+	assert.Equal(t, 0, m.page.Offset)
+	assert.Equal(t, "Album 1", selected())
+
+	m.sortBy("year")
+	m.sortBy("year")
+	assert.True(t, m.page.Desc)
+
+	m.inputs[inputTitle].SetValue("Album 1")
+	m.inputs[inputYearMin].SetValue("x") // ignored
+	m.applyFilter()
+	assert.Equal(t, 111, m.total) // 1, 10-19, 100-199
+	assert.Len(t, m.table.Rows(), 111)
+
+	// a search is sorted by relevance, until it is cleared
+	m.inputs[inputTitle].SetValue("")
+	m.inputs[inputQuery].SetValue("album 12")
+	m.applyFilter()
+	assert.Equal(t, sortRelevance, m.page.Sort)
+	assert.Equal(t, 11, m.total) // 12, 120-129
+	m.inputs[inputQuery].SetValue("")
+	m.applyFilter()
+	assert.Equal(t, "artist", m.page.Sort)
+}
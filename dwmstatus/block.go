@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// A Block is one section of the status bar. Each block is updated on its own
+// interval, independently of the others.
+type Block interface {
+	Name() string
+	// Time until the next update; may change after each update
+	Interval() time.Duration
+	// An empty value hides the block
+	Update(ctx context.Context) (string, error)
+}
+
+// A Notifier is a block that can be updated as soon as it changes, instead of
+// waiting for its next interval
+type Notifier interface {
+	// Signals whenever the block should be updated, until ctx is done
+	Changes(ctx context.Context) <-chan struct{}
+}
+
+// An Urgenter is a block whose value may need attention (e.g. low battery),
+// which some outputs can highlight
+type Urgenter interface {
+	// Whether the last value is urgent
+	Urgent() bool
+}
+
+// templateBlock formats the data of a block with a text/template
+type templateBlock struct {
+	name     string
+	interval time.Duration
+	format   *template.Template
+	// nil hides the block
+	data func(context.Context) (any, error)
+	// optional; see Notifier
+	changes func(context.Context) <-chan struct{}
+
+	urgent bool
+}
+
+// data that can be urgent (see Urgenter)
+type urgentData interface{ urgent() bool }
+
+func (b *templateBlock) Urgent() bool { return b.urgent }
+
+func (b *templateBlock) Changes(ctx context.Context) <-chan struct{} {
+	if b.changes == nil {
+		return nil
+	}
+	return b.changes(ctx)
+}
+
+func (b *templateBlock) Name() string            { return b.name }
+func (b *templateBlock) Interval() time.Duration { return b.interval }
+func (b *templateBlock) Update(ctx context.Context) (string, error) {
+	data, err := b.data(ctx)
+	b.urgent = false
+	if err != nil || data == nil {
+		return "", err
+	}
+	if u, ok := data.(urgentData); ok {
+		b.urgent = u.urgent()
+	}
+	var sb strings.Builder
+	if err := b.format.Execute(&sb, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(sb.String()), nil
+}
+
+// Cacher wraps a block that is slow or expensive to update.
+//
+// While the cached value is empty, the block is updated on its own (slow)
+// interval; once it is non-empty, every Active, so that we can "clear" the
+// notif (e.g. mail). If an update fails, the last value is kept for up to
+// MaxAge (e.g. weather, when offline).
+type Cacher struct {
+	Block
+	Active time.Duration // 0: always use the block's interval
+	MaxAge time.Duration // 0: never keep a value on failure
+
+	value   string
+	updated time.Time
+}
+
+func (c *Cacher) Interval() time.Duration {
+	if c.value != "" && c.Active > 0 {
+		return c.Active
+	}
+	return c.Block.Interval()
+}
+
+func (c *Cacher) Urgent() bool {
+	u, ok := c.Block.(Urgenter)
+	return ok && u.Urgent()
+}
+
+func (c *Cacher) Changes(ctx context.Context) <-chan struct{} {
+	if n, ok := c.Block.(Notifier); ok {
+		return n.Changes(ctx)
+	}
+	return nil
+}
+
+func (c *Cacher) Update(ctx context.Context) (string, error) {
+	v, err := c.Block.Update(ctx)
+	if err != nil {
+		if c.value != "" && time.Since(c.updated) < c.MaxAge {
+			return c.value, nil
+		}
+		c.value = ""
+		return "", err
+	}
+	c.value = v
+	c.updated = time.Now()
+	return v, nil
+}
+
+// update runs a single update of b, which may take no longer than its
+// interval. Failed blocks are logged and hidden.
+func update(ctx context.Context, b Block) Segment {
+	ctx, cancel := context.WithTimeout(ctx, b.Interval())
+	defer cancel()
+	seg := Segment{Name: b.Name()}
+	v, err := b.Update(ctx)
+	if err != nil {
+		die(fmt.Errorf("%s: %w", b.Name(), err))
+		return seg
+	}
+	seg.Text = v
+	if u, ok := b.(Urgenter); ok {
+		seg.Urgent = u.Urgent()
+	}
+	return seg
+}
+
+// schedule runs each block in its own goroutine, on its own ticker (or when it
+// changes; see Notifier, or when its index is sent on refresh), and calls
+// render with the segments of all blocks (in order) whenever one of them
+// changes. Blocks are updated once immediately. Returns when ctx is done, and
+// no block is still updating (as updates may share state, e.g. lastCPU, with
+// the blocks of the next schedule).
+func schedule(ctx context.Context, blocks []Block, refresh <-chan int, render func([]Segment)) {
+	type result struct {
+		i   int
+		seg Segment
+	}
+	results := make(chan result)
+	refreshes := make([]chan struct{}, len(blocks))
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for i, b := range blocks {
+		refreshes[i] = make(chan struct{}, 1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			interval := b.Interval()
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			var changes <-chan struct{} // nil blocks forever
+			if n, ok := b.(Notifier); ok {
+				changes = n.Changes(ctx)
+			}
+			for {
+				select {
+				case results <- result{i, update(ctx, b)}:
+				case <-ctx.Done():
+					return
+				}
+				if next := b.Interval(); next != interval {
+					interval = next
+					ticker.Reset(interval)
+				}
+				select {
+				case <-ticker.C:
+				case <-refreshes[i]:
+				case _, ok := <-changes:
+					if !ok {
+						changes = nil
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	segments := make([]Segment, len(blocks))
+	for i, b := range blocks {
+		segments[i].Name = b.Name()
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case i := <-refresh:
+			if i >= 0 && i < len(refreshes) {
+				select {
+				case refreshes[i] <- struct{}{}:
+				default: // already pending
+				}
+			}
+		case r := <-results:
+			if segments[r.i] == r.seg {
+				continue
+			}
+			segments[r.i] = r.seg
+			render(slices.Clone(segments))
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// funcBlock is updated by a function
+type funcBlock struct {
+	name     string
+	interval time.Duration
+	update   func() (string, error)
+}
+
+func (b *funcBlock) Name() string                           { return b.name }
+func (b *funcBlock) Interval() time.Duration                { return b.interval }
+func (b *funcBlock) Update(context.Context) (string, error) { return b.update() }
+
+// counter returns 1, 2, 3, ... on each update
+func counter(n *atomic.Int32) func() (string, error) {
+	return func() (string, error) { return strconv.Itoa(int(n.Add(1))), nil }
+}
+
+// runSchedule runs schedule until the test ends, and returns its renders
+func runSchedule(t *testing.T, blocks []Block, refresh <-chan int) <-chan []string {
+	ctx, cancel := context.WithCancel(context.Background())
+	renders := make(chan []string, 100)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		schedule(ctx, blocks, refresh, func(segs []Segment) {
+			var texts []string
+			for _, s := range segs {
+				texts = append(texts, s.Text)
+			}
+			renders <- texts
+		})
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return renders
+}
+
+// nextRender waits for a render
+func nextRender(t *testing.T, renders <-chan []string) []string {
+	t.Helper()
+	select {
+	case r := <-renders:
+		return r
+	case <-time.After(time.Second):
+		t.Fatal("no render")
+		return nil
+	}
+}
+
+// waitRender skips renders until want is rendered, and returns the skipped ones
+func waitRender(t *testing.T, renders <-chan []string, want ...string) [][]string {
+	t.Helper()
+	var skipped [][]string
+	for r := nextRender(t, renders); !slices.Equal(r, want); r = nextRender(t, renders) {
+		skipped = append(skipped, r)
+	}
+	return skipped
+}
+
+// noRender checks that nothing is rendered for a while
+func noRender(t *testing.T, renders <-chan []string) {
+	t.Helper()
+	select {
+	case r := <-renders:
+		t.Errorf("unexpected render: %q", r)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestScheduleRendersChanges(t *testing.T) {
+	var n atomic.Int32
+	// a, a, a, b, b, ...
+	b := &funcBlock{"x", 5 * time.Millisecond, func() (string, error) {
+		if n.Add(1) <= 3 {
+			return "a", nil
+		}
+		return "b", nil
+	}}
+	renders := runSchedule(t, []Block{b, &funcBlock{"y", time.Hour, func() (string, error) { return "y", nil }}}, nil)
+
+	skipped := waitRender(t, renders, "b", "y")
+	noRender(t, renders)
+	if n.Load() < 5 {
+		t.Errorf("updated %d times, want at least 5", n.Load())
+	}
+	// rendered once per change (of either block), with every block in order
+	if len(skipped) != 2 || !slices.Equal(skipped[1], []string{"a", "y"}) {
+		t.Errorf("got renders %q before b", skipped)
+	}
+}
+
+func TestScheduleRefresh(t *testing.T) {
+	var n0, n1 atomic.Int32
+	refresh := make(chan int)
+	renders := runSchedule(t, []Block{
+		&funcBlock{"a", time.Hour, counter(&n0)},
+		&funcBlock{"b", time.Hour, counter(&n1)},
+	}, refresh)
+	waitRender(t, renders, "1", "1")
+
+	refresh <- 1
+	if r := nextRender(t, renders); !slices.Equal(r, []string{"1", "2"}) {
+		t.Errorf("got %q, want only b updated", r)
+	}
+	// unknown blocks (e.g. after a reload) are ignored
+	refresh <- 5
+	refresh <- -1
+	noRender(t, renders)
+	if n0.Load() != 1 {
+		t.Errorf("a updated %d times, want once", n0.Load())
+	}
+}
+
+func TestCacherActive(t *testing.T) {
+	value := ""
+	c := &Cacher{
+		Block:  &funcBlock{"mail", 10 * time.Minute, func() (string, error) { return value, nil }},
+		Active: 5 * time.Second,
+	}
+	for _, v := range []struct {
+		value    string
+		interval time.Duration
+	}{
+		{"", 10 * time.Minute},
+		{"1 new mail", 5 * time.Second}, // until it is read
+		{"", 10 * time.Minute},
+	} {
+		value = v.value
+		if got, err := c.Update(context.Background()); err != nil || got != v.value {
+			t.Fatalf("got %q, %v", got, err)
+		}
+		if got := c.Interval(); got != v.interval {
+			t.Errorf("%q: got interval %v, want %v", v.value, got, v.interval)
+		}
+	}
+}
+
+func TestCacherMaxAge(t *testing.T) {
+	errOffline := errors.New("offline")
+	var err error
+	c := &Cacher{
+		Block:  &funcBlock{"weather", time.Minute, func() (string, error) { return "sunny", err }},
+		MaxAge: time.Hour,
+	}
+	if v, err := c.Update(context.Background()); err != nil || v != "sunny" {
+		t.Fatalf("got %q, %v", v, err)
+	}
+
+	// the last value is kept while it is recent enough
+	err = errOffline
+	if v, err := c.Update(context.Background()); err != nil || v != "sunny" {
+		t.Errorf("got %q, %v, want the last value", v, err)
+	}
+	c.updated = time.Now().Add(-2 * time.Hour)
+	if v, err := c.Update(context.Background()); !errors.Is(err, errOffline) || v != "" {
+		t.Errorf("got %q, %v, want the error", v, err)
+	}
+	// and not restored by a later failure
+	c.updated = time.Now()
+	if v, _ := c.Update(context.Background()); v != "" {
+		t.Errorf("got %q after expiry", v)
+	}
+
+	// without MaxAge, a failure hides the block at once
+	err = nil
+	c = &Cacher{Block: c.Block}
+	_, _ = c.Update(context.Background())
+	err = errOffline
+	if v, err := c.Update(context.Background()); err == nil || v != "" {
+		t.Errorf("got %q, %v, want the error", v, err)
+	}
+}
+
+// slowBlock takes a while to notice that its update was cancelled
+type slowBlock struct{ running atomic.Int32 }
+
+func (b *slowBlock) Name() string            { return "slow" }
+func (b *slowBlock) Interval() time.Duration { return time.Minute }
+func (b *slowBlock) Update(ctx context.Context) (string, error) {
+	b.running.Add(1)
+	defer b.running.Add(-1)
+	<-ctx.Done()
+	time.Sleep(50 * time.Millisecond)
+	return "", ctx.Err()
+}
+
+func TestScheduleWaits(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &slowBlock{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		schedule(ctx, []Block{b}, nil, func([]Segment) {})
+	}()
+	for b.running.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+	if n := b.running.Load(); n != 0 {
+		t.Errorf("%d updates still running", n)
+	}
+}
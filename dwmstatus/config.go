@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+)
+
+// Config is read from $XDG_CONFIG_HOME/dwmstatus/config.json, e.g.
+//
+//	{
+//		"separator": " | ",
+//		"blocks": [
+//			{"name": "mail"},
+//			{"name": "sys", "interval": "2s", "thresholds": {"temp": 70}},
+//			{"name": "battery", "format": "{{if .Warn}}LOW {{end}}{{.Capacity}}%"},
+//			{"name": "time", "format": "{{.Format \"15:04\"}}"}
+//		]
+//	}
+//
+// Only the listed blocks are shown, in the order listed; without "blocks",
+// all of them are. Unset fields take the defaults of the block (see
+// defaultBlocks). The config is reloaded whenever it is written, or on
+// SIGHUP.
+type Config struct {
+	Prefix    string        `json:"prefix"` // template; .Machine is the machine name
+	Separator string        `json:"separator"`
+	Blocks    []BlockConfig `json:"blocks"`
+
+	prefix string // executed
+}
+
+type BlockConfig struct {
+	Name     string   `json:"name"`
+	Interval Duration `json:"interval"`
+	// If set, the block is cached (see Cacher)
+	Active Duration `json:"active"`
+	MaxAge Duration `json:"max_age"`
+	// text/template, executed on the data of the block; see the block's
+	// function for the fields. An empty result hides the block.
+	Format     string             `json:"format"`
+	Thresholds map[string]float64 `json:"thresholds"`
+
+	// Only used by some outputs (see Output)
+	Color string `json:"color"` // e.g. "#ff0000"
+	// Shell command run when the block is clicked, with $BUTTON set; the
+	// block is updated once it exits
+	OnClick string `json:"on_click"`
+}
+
+// Duration is a time.Duration written as a string, e.g. "5s" or "10m"
+type Duration struct{ time.Duration }
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// The blocks shown without a config, in order
+var defaultBlocks = []BlockConfig{
+	{
+		Name:     "mail",
+		Interval: Duration{10 * time.Minute},
+		Active:   Duration{5 * time.Second},
+		Format:   `{{if .Failed}}mail error{{else if .Count}}{{.Count}} new mail{{end}}`,
+	},
+	{
+		Name:     "weather",
+		Interval: Duration{30 * time.Minute},
+		MaxAge:   Duration{3 * time.Hour},
+		Format:   `{{.Summary}}, {{printf "%.0f" .Min}} - {{printf "%.0f" .Max}}°C`,
+	},
+	{
+		Name:     "nowplaying",
+		Interval: Duration{5 * time.Second},
+		Format:   `{{if .Paused}}⏸ {{end}}{{.Player}}: {{.Artist}} - {{.Title}}`,
+	},
+	{
+		Name:     "network",
+		Interval: Duration{5 * time.Second},
+		Format:   `{{if .Name}}{{.Name}} [{{.KBps}} kb/s]{{else}}No network{{end}}`,
+	},
+	{
+		Name:       "sys",
+		Interval:   Duration{5 * time.Second},
+		Format:     `{{printf "%.1f" .CPU}}%, {{.Mem}}, {{printf "%.0f" .Temp}}°C`,
+		Thresholds: map[string]float64{"cpu": 90, "temp": 80},
+	},
+	{
+		Name:     "disk",
+		Interval: Duration{time.Minute},
+		Format:   `{{join . " "}}`,
+	},
+	{
+		Name:       "battery",
+		Interval:   Duration{time.Minute},
+		Format:     `{{.Capacity}}`,
+		Thresholds: map[string]float64{"low": 15},
+	},
+	{
+		Name:     "time",
+		Interval: Duration{5 * time.Second},
+		Format:   `{{.Format "` + TimeFmt + `"}}`,
+	},
+}
+
+// The data of each block, which its format is executed on. nil hides the
+// block.
+var blockData = map[string]func(context.Context, BlockConfig) (any, error){
+	"mail": func(context.Context, BlockConfig) (any, error) { return mail(), nil },
+	"weather": func(ctx context.Context, _ BlockConfig) (any, error) {
+		f, err := weather(ctx)
+		return orNil(f), err
+	},
+	"nowplaying": func(ctx context.Context, _ BlockConfig) (any, error) {
+		t, err := nowplaying(ctx)
+		return orNil(t), err
+	},
+	"network": func(context.Context, BlockConfig) (any, error) { return network(), nil },
+	"sys":     func(_ context.Context, c BlockConfig) (any, error) { return sys(c.Thresholds) },
+	"disk":    func(context.Context, BlockConfig) (any, error) { return disk() },
+	"battery": func(_ context.Context, c BlockConfig) (any, error) { return orNil(battery(c.Thresholds)), nil },
+	"time":    func(context.Context, BlockConfig) (any, error) { return _time(), nil },
+}
+
+// Blocks that are also updated as soon as they change
+var blockChanges = map[string]func(context.Context) <-chan struct{}{
+	"nowplaying": playerChanges,
+}
+
+// What blocks do when clicked, unless on_click is set
+var blockClicks = map[string]func(ctx context.Context, button int) error{
+	"nowplaying": func(ctx context.Context, button int) error {
+		if button != 1 {
+			return nil
+		}
+		bus, err := sessionBus()
+		if err != nil {
+			return err
+		}
+		p, err := bus.Active(ctx)
+		if err != nil || p == nil {
+			return err
+		}
+		return bus.PlayPause(ctx, p.Bus)
+	},
+}
+
+var formatFuncs = template.FuncMap{"join": strings.Join}
+
+// a nil pointer in an interface is not nil
+func orNil[T any](p *T) any {
+	if p == nil {
+		return nil
+	}
+	return p
+}
+
+func configPath() string {
+	dir, err := os.UserConfigDir() // $XDG_CONFIG_HOME, or ~/.config
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "dwmstatus", "config.json")
+}
+
+func defaultConfig() *Config {
+	c := &Config{
+		Prefix:    "{{.Machine}} > ",
+		Separator: Separator,
+		Blocks:    slices.Clone(defaultBlocks),
+	}
+	if err := c.init(); err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// loadConfig reads the config at path. A missing config is not an error.
+func loadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return defaultConfig(), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	c := defaultConfig()
+	c.Blocks = nil
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields() // catch typos
+	if err := dec.Decode(c); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if c.Blocks == nil {
+		c.Blocks = slices.Clone(defaultBlocks)
+	}
+	if err := c.init(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+// init fills in the defaults of each block, and checks that the blocks can be
+// constructed
+func (c *Config) init() error {
+	for i, bc := range c.Blocks {
+		j := slices.IndexFunc(defaultBlocks, func(d BlockConfig) bool { return d.Name == bc.Name })
+		if j < 0 {
+			return fmt.Errorf("unknown block: %q", bc.Name)
+		}
+		def := defaultBlocks[j]
+		if bc.Interval.Duration == 0 {
+			bc.Interval = def.Interval
+		}
+		if bc.Active.Duration == 0 {
+			bc.Active = def.Active
+		}
+		if bc.MaxAge.Duration == 0 {
+			bc.MaxAge = def.MaxAge
+		}
+		if bc.Format == "" {
+			bc.Format = def.Format
+		}
+		thresholds := map[string]float64{}
+		for k, v := range def.Thresholds {
+			thresholds[k] = v
+		}
+		for k, v := range bc.Thresholds {
+			thresholds[k] = v
+		}
+		bc.Thresholds = thresholds
+		if bc.Interval.Duration < 0 || bc.Active.Duration < 0 {
+			return fmt.Errorf("%s: negative interval", bc.Name)
+		}
+		c.Blocks[i] = bc
+	}
+	if _, err := c.newBlocks(); err != nil {
+		return err
+	}
+
+	prefix, err := template.New("prefix").Parse(c.Prefix)
+	if err != nil {
+		return err
+	}
+	var sb strings.Builder
+	if err := prefix.Execute(&sb, struct{ Machine string }{MachineName}); err != nil {
+		return err
+	}
+	c.prefix = sb.String()
+	return nil
+}
+
+// newBlocks constructs the configured blocks. Blocks keep state (see Cacher),
+// so this should be called once per run.
+func (c *Config) newBlocks() ([]Block, error) {
+	var blocks []Block
+	for _, bc := range c.Blocks {
+		format, err := template.New(bc.Name).Funcs(formatFuncs).Parse(bc.Format)
+		if err != nil {
+			return nil, err
+		}
+		data := blockData[bc.Name]
+		var b Block = &templateBlock{
+			name:     bc.Name,
+			interval: bc.Interval.Duration,
+			format:   format,
+			data:     func(ctx context.Context) (any, error) { return data(ctx, bc) },
+			changes:  blockChanges[bc.Name],
+		}
+		if bc.Active.Duration > 0 || bc.MaxAge.Duration > 0 {
+			b = &Cacher{Block: b, Active: bc.Active.Duration, MaxAge: bc.MaxAge.Duration}
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks, nil
+}
+
+// click runs the action of a clicked block (see BlockConfig.OnClick), and
+// returns its index; -1 if there is no such block (e.g. after a reload).
+func (c *Config) click(ctx context.Context, cl Click) (int, error) {
+	i, err := strconv.Atoi(cl.Instance)
+	if err != nil || i < 0 || i >= len(c.Blocks) || c.Blocks[i].Name != cl.Name {
+		return -1, nil
+	}
+	bc := c.Blocks[i]
+	if bc.OnClick != "" {
+		cmd := exec.CommandContext(ctx, "sh", "-c", bc.OnClick)
+		cmd.Env = append(os.Environ(), "BUTTON="+strconv.Itoa(cl.Button))
+		return i, cmd.Run()
+	}
+	if action, ok := blockClicks[bc.Name]; ok {
+		return i, action(ctx, cl.Button)
+	}
+	return i, nil
+}
+
+// handleClicks runs the actions of clicked blocks, then updates them
+func (c *Config) handleClicks(ctx context.Context, clicks <-chan Click, refresh chan<- int) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case cl := <-clicks:
+			// actions may take a while, e.g. opening a window
+			go func() {
+				i, err := c.click(ctx, cl)
+				if err != nil {
+					die(fmt.Errorf("%s: click: %w", cl.Name, err))
+				}
+				if i < 0 {
+					return
+				}
+				select {
+				case refresh <- i:
+				case <-ctx.Done():
+				}
+			}()
+		}
+	}
+}
+
+// How often watchConfig polls the mtime of the config
+var configPoll = 2 * time.Second
+
+// watchConfig signals when the config at path should be reloaded, i.e. when it
+// is written (or created, or removed), or on SIGHUP. Without inotify (not in
+// the stdlib), the mtime is polled.
+func watchConfig(ctx context.Context, path string) <-chan struct{} {
+	reload := make(chan struct{}, 1)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	modTime := func() time.Time {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}
+		}
+		return fi.ModTime()
+	}
+
+	go func() {
+		defer signal.Stop(hup)
+		ticker := time.NewTicker(configPoll)
+		defer ticker.Stop()
+		last := modTime()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+			case <-ticker.C:
+				t := modTime()
+				if t.Equal(last) {
+					continue
+				}
+				last = t
+			}
+			select {
+			case reload <- struct{}{}:
+			default: // already pending
+			}
+		}
+	}()
+	return reload
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		config string // empty: no config file
+		err    string // empty: no error
+		check  func(*testing.T, *Config)
+	}{
+		{
+			name: "missing",
+			check: func(t *testing.T, c *Config) {
+				if len(c.Blocks) != len(defaultBlocks) || c.Separator != Separator {
+					t.Errorf("got %+v, want the defaults", c)
+				}
+			},
+		},
+		{
+			name:   "no blocks",
+			config: `{"separator": " / ", "prefix": "{{.Machine}}: "}`,
+			check: func(t *testing.T, c *Config) {
+				if len(c.Blocks) != len(defaultBlocks) || c.Separator != " / " {
+					t.Errorf("got %+v, want all blocks, separated by /", c)
+				}
+				if c.prefix != MachineName+": " {
+					t.Errorf("got prefix %q", c.prefix)
+				}
+			},
+		},
+		{
+			name:   "merged",
+			config: `{"blocks": [{"name": "sys", "interval": "2s", "thresholds": {"temp": 70}}, {"name": "mail", "active": "1s"}]}`,
+			check: func(t *testing.T, c *Config) {
+				if len(c.Blocks) != 2 {
+					t.Fatalf("got %d blocks, want 2", len(c.Blocks))
+				}
+				sys, mail := c.Blocks[0], c.Blocks[1]
+				if sys.Interval.Duration != 2*time.Second || sys.Format != defaultBlocks[4].Format {
+					t.Errorf("sys: got %+v", sys)
+				}
+				if want := map[string]float64{"cpu": 90, "temp": 70}; !maps.Equal(sys.Thresholds, want) {
+					t.Errorf("sys: got thresholds %v, want %v", sys.Thresholds, want)
+				}
+				if mail.Interval.Duration != 10*time.Minute || mail.Active.Duration != time.Second {
+					t.Errorf("mail: got %+v", mail)
+				}
+				// the defaults are not changed
+				if defaultBlocks[4].Thresholds["temp"] != 80 {
+					t.Error("default thresholds changed")
+				}
+			},
+		},
+		{name: "unknown block", config: `{"blocks": [{"name": "foo"}]}`, err: `unknown block: "foo"`},
+		{name: "unknown field", config: `{"blocks": [{"name": "time", "intreval": "1s"}]}`, err: `unknown field "intreval"`},
+		{name: "bad duration", config: `{"blocks": [{"name": "time", "interval": "soon"}]}`, err: "invalid duration"},
+		{name: "negative interval", config: `{"blocks": [{"name": "time", "interval": "-1s"}]}`, err: "time: negative interval"},
+		{name: "bad format", config: `{"blocks": [{"name": "time", "format": "{{.Format"}]}`, err: "template: time"},
+		{name: "bad prefix", config: `{"prefix": "{{"}`, err: "template: prefix"},
+		{name: "not json", config: `blocks: []`, err: "invalid character"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.json")
+			if test.config != "" {
+				if err := os.WriteFile(path, []byte(test.config), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			c, err := loadConfig(path)
+			switch {
+			case test.err == "" && err != nil:
+				t.Fatal(err)
+			case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+				t.Fatalf("got error %v, want %q", err, test.err)
+			case test.err == "":
+				test.check(t, c)
+			}
+		})
+	}
+}
+
+func TestNewBlocks(t *testing.T) {
+	c := &Config{Blocks: []BlockConfig{{Name: "weather"}, {Name: "time", Interval: Duration{time.Second}}}}
+	if err := c.init(); err != nil {
+		t.Fatal(err)
+	}
+	blocks, err := c.newBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 2 {
+		t.Fatalf("got %d blocks, want 2", len(blocks))
+	}
+	// blocks with an active interval or max age are cached
+	if b, ok := blocks[0].(*Cacher); !ok || b.MaxAge != 3*time.Hour || b.Interval() != 30*time.Minute {
+		t.Errorf("weather: got %#v, want a Cacher", blocks[0])
+	}
+	if b, ok := blocks[1].(*templateBlock); !ok || b.Name() != "time" || b.Interval() != time.Second {
+		t.Errorf("time: got %#v", blocks[1])
+	}
+	// each call constructs new blocks, as they keep state
+	again, _ := c.newBlocks()
+	if again[0] == blocks[0] {
+		t.Error("blocks were reused")
+	}
+
+	for _, bc := range defaultBlocks {
+		if blockData[bc.Name] == nil {
+			t.Errorf("%s: no data", bc.Name)
+		}
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	defer func(d time.Duration) { configPoll = d }(configPoll)
+	configPoll = 10 * time.Millisecond
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reload := watchConfig(ctx, path)
+
+	expect := func(what string, want bool) {
+		t.Helper()
+		select {
+		case <-reload:
+			if !want {
+				t.Errorf("%s: unexpected reload", what)
+			}
+		case <-time.After(500 * time.Millisecond):
+			if want {
+				t.Errorf("%s: no reload", what)
+			}
+		}
+	}
+
+	expect("unchanged", false)
+	if err := os.WriteFile(path, []byte("{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	expect("created", true)
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	expect("written", true)
+	expect("unchanged", false)
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	expect("SIGHUP", true)
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	expect("removed", true)
+}
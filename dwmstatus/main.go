@@ -1,18 +1,26 @@
 // Statusbar for `dwm`
 //
 // A rewrite of a 3+ year-old Bash script. I could never be bothered to
-// properly implement 2 loops with different intervals in Bash, but Go makes
-// this trivial.
+// properly implement loops with different intervals in Bash, but Go makes
+// this trivial: each block (see Block) is updated on its own interval.
+//
+// Besides dwm (i.e. the X root window name), the bar can be shown by i3bar or
+// swaybar, lemonbar, or written to stdout (see Output).
 //
 // Until I find native Go equivalents, the following executables are required:
-//	df, free, iwgetid, top, sensors, playerctl
+//	iwgetid  (network)
+//	notmuch  (mail)
+//	xsetroot (-output xsetroot)
 //
 // No non-stdlib imports are allowed.
 
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/fs"
@@ -20,12 +28,18 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+
+	"dwmstatus/mpris"
 )
 
+// Defaults, unless configured (see Config)
 const (
 	// Divides sections in the status bar
 	Separator = " | "
@@ -39,29 +53,14 @@ const (
 )
 
 var (
-	fastInterval = 5 * time.Second
-	slowInterval = 10 * time.Minute
-
-	lastBytes       = netBytes()
+	lastBytes, _    = netBytes("/sys/class")
+	lastBytesTime   = time.Now()
+	lastCPU, _      = readCPU("/proc/stat")
 	currentLocation = getLocation()
 
 	MachineName = readFile("/sys/devices/virtual/dmi/id/product_name")
-	MailCache   = Cacher{
-		f:        mail,
-		value:    mail(),
-		interval: int(slowInterval.Seconds() / fastInterval.Seconds()),
-	}
 )
 
-type Cacher struct {
-	f        func() string
-	value    string
-	count    int
-	interval int
-
-	// interval := 120 // 10 min / 5 s
-}
-
 func die(err error) {
 	lf, _ := os.OpenFile("/tmp/dwmstatus", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	// if err != nil {
@@ -192,16 +191,22 @@ func getLocation() *location { // {{{
 		Lon:  float32(lon),
 	} //, nil
 } // }}}
-// Uses wttr.in for ease of parsing
-func weather() string { // {{{
+type forecast struct {
+	Summary  string // e.g. "cloudy"
+	Min, Max float32
+}
+
+// The forecast for the next 24 hours. Uses api.met.no (previously wttr.in)
+func weather(ctx context.Context) (*forecast, error) { // {{{
 	// curl -sL ipinfo.io
 	// curl --max-time 1 --fail -sL "wttr.in/$location?format=%C,+%t+(%s)"
 
 	if currentLocation == nil {
-		return ""
+		return nil, errors.New("unknown location")
 	}
 
-	req, err := http.NewRequest(
+	req, err := http.NewRequestWithContext(
+		ctx,
 		"GET",
 		fmt.Sprintf(
 			"https://api.met.no/weatherapi/locationforecast/2.0/compact?lat=%f&lon=%f",
@@ -211,20 +216,20 @@ func weather() string { // {{{
 		nil,
 	)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	req.Header.Set("User-Agent", "github.com/hejops/dwmstatus")
 
 	resp, err := http.DefaultClient.Do(req)
-	if err != nil { // ignore network errors
-		return ""
+	if err != nil {
+		return nil, err
 	}
+	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	defer resp.Body.Close()
 
 	// jq '[.properties | .timeseries[] | .data | .instant | .details | .air_temperature]'
 
@@ -246,7 +251,10 @@ func weather() string { // {{{
 	}
 
 	if err := json.Unmarshal(body, &x); err != nil {
-		panic(err)
+		return nil, err
+	}
+	if len(x.Properties.Timeseries) < 24 {
+		return nil, errors.New("no forecast")
 	}
 
 	minT := x.Properties.Timeseries[0].Data.Instant.Details.Air_Temperature
@@ -256,177 +264,232 @@ func weather() string { // {{{
 		maxT = max(t.Data.Instant.Details.Air_Temperature, maxT)
 	}
 
-	wt := fmt.Sprintf(
-		"%s, %.0f - %.0f°C",
-		strings.Split(x.Properties.Timeseries[0].Data.Next_12_Hours.Summary.Symbol_Code, "_")[0],
-		minT,
-		maxT,
-	)
-
-	return wt
+	return &forecast{
+		Summary: strings.Split(x.Properties.Timeseries[0].Data.Next_12_Hours.Summary.Symbol_Code, "_")[0],
+		Min:     minT,
+		Max:     maxT,
+	}, nil
 } // }}}
 
-func battery() string {
+type batteryStatus struct {
+	Capacity int  // %
+	Warn     bool // at or below the "low" threshold
+}
+
+func (b batteryStatus) urgent() bool { return b.Warn }
+
+// nil if there is no battery
+func battery(thresholds map[string]float64) *batteryStatus {
 	if _, err := os.Stat(BatteryCapacity); err != nil {
-		return ""
+		return nil
+	}
+	capacity, _ := strconv.Atoi(readFile(BatteryCapacity))
+	low, ok := thresholds["low"]
+	return &batteryStatus{
+		Capacity: capacity,
+		Warn:     ok && float64(capacity) <= low,
 	}
-	return readFile(BatteryCapacity)
 }
 
 // '+%a %d/%m +%H:%M'
-func _time() string {
-	// refer to time.Layout
-	return time.Now().Format(TimeFmt)
+func _time() time.Time {
+	// formatted with time.Layout
+	return time.Now()
 }
 
-func sys() string { // {{{
+type sysStatus struct {
+	CPU  float64 // %
+	Mem  string  // used, e.g. "6.8G"
+	Temp float64 // highest, in °C
+	Warn bool    // at or above the "cpu" or "temp" threshold
+}
 
-	// SwapUse          0B CachUse        6.9G  MemUse        6.8G MemFree        2.8G
-	mem := getCmdOutputLazy("free --line --human --si")
-	mem = strings.Fields(mem)[5]
-	// TODO: warn if >= 8 G
+func (s sysStatus) urgent() bool { return s.Warn }
 
-	// sensors -u | grep temp1_input | sort | tail -n1 | cut -d' ' -f4 | cut -d. -f1
-
-	// parsing the json (sensors -j) is not trivial, due to inconsistent
-	// field names
-	sensors := getCmdOutputLazy("sensors -u")
-	var max_temp string
-	for _, line := range strings.Split(sensors, "\n") {
-		if strings.Contains(line, "temp1_input") {
-			temp := strings.Fields(line)[1]
-			// don't bother with strconv.Atoi
-			if strings.Compare(temp, max_temp) > 0 {
-				max_temp = temp
-			}
-		}
+func sys(thresholds map[string]float64) (sysStatus, error) { // {{{
+	// usage since the last update
+	cur, err := readCPU("/proc/stat")
+	if err != nil {
+		return sysStatus{}, err
 	}
-	max_temp, _, _ = strings.Cut(max_temp, ".")
-	// fmt.Println(max_temp)
+	cpu := cpuUsage(lastCPU, cur)
+	lastCPU = cur
 
-	// %Cpu(s):  5.8 us,  1.7 sy,  0.0 ni, 92.5 id,  0.0 wa,  0.0 hi,  0.0 si,  0.0 st
+	mem, err := readMeminfo("/proc/meminfo")
+	if err != nil {
+		return sysStatus{}, err
+	}
+	// TODO: warn if >= 8 G
 
-	// 3rd line, but the intent is clearer this way (and performance is
-	// essentially identical, despite the 3 extra strings.Contains calls)
-	cpu := "?"
-	// pid 8 is arbitrary; we just get the summary and ignore the processes
-	cpu_out := getCmdOutputLazy("top --batch --iterations=1 --pid=8")
-	for _, line := range strings.Split(cpu_out, "\n") {
-		if strings.Contains(line, "%Cpu") {
-			cpu = strings.Fields(line)[1]
-			break
-		}
+	temp, err := maxTemp("/sys/class")
+	if err != nil {
+		return sysStatus{}, err
 	}
 
-	return fmt.Sprintf("%s%%, %s, %s°C", cpu, mem, max_temp)
+	st := sysStatus{
+		CPU:  cpu,
+		Mem:  humanBytes(mem.Used(), 1000), // like free --si
+		Temp: temp,
+	}
+	if t, ok := thresholds["cpu"]; ok && cpu >= t {
+		st.Warn = true
+	}
+	if t, ok := thresholds["temp"]; ok && temp >= t {
+		st.Warn = true
+	}
+	return st, nil
 } // }}}
 
-func disk() string {
-	// df -h / /dev/sda?*
-	// exec.Command does not do shell expansion!
-	// on some machines, / /dev/sdaX are the same
-	df := "df --human-readable --output=avail / /dev/sda?* | uniq"
-	out := getCmdOutput("sh", "-c", df)
+// Free space of each mounted disk (/ first), e.g. "120G"
+func disk() ([]string, error) {
+	mounts, err := readMounts("/proc/self/mounts")
+	if err != nil {
+		return nil, err
+	}
 	var arr []string
-	for _, line := range strings.Split(out, "\n")[1:] {
-		arr = append(arr, strings.TrimSpace(line))
+	for _, m := range mounts {
+		free, err := freeSpace(m)
+		if err != nil {
+			// e.g. an unplugged usb drive that is still mounted
+			continue
+		}
+		arr = append(arr, humanBytes(free, 1024)) // like df -h
 	}
-	return strings.Join(arr, " ")
+	return arr, nil
 }
 
-func nowplaying() string { // {{{
-	// a marquee is not too hard to implement, but the 5 second interval
-	// makes this a moot point
-	status, err := exec.Command("playerctl", "status").Output()
-	if err != nil {
-		return ""
-	}
+type track struct {
+	Player string
+	Artist string
+	Title  string
+	Album  string
+	Paused bool
+}
 
-	np := getCmdOutput(
-		"playerctl",
-		"metadata",
-		"--format",
-		"{{ playerName }}: {{ artist }} - {{ title }}",
-	)
+var (
+	mprisMu   sync.Mutex
+	mprisConn *mpris.Conn
+)
 
-	if strings.Contains(string(status), "Paused") {
-		np = "⏸ " + np
+// session bus, reconnected if lost (e.g. when logging out and in again)
+func sessionBus() (*mpris.Conn, error) {
+	mprisMu.Lock()
+	defer mprisMu.Unlock()
+	if mprisConn != nil && mprisConn.Err() == nil {
+		return mprisConn, nil
+	}
+	c, err := mpris.SessionBus()
+	if err != nil {
+		return nil, err
 	}
+	mprisConn = c
+	return c, nil
+}
 
-	return np
+// nil if nothing is playing
+func nowplaying(ctx context.Context) (*track, error) { // {{{
+	bus, err := sessionBus()
+	if err != nil {
+		return nil, err
+	}
+	p, err := bus.Active(ctx)
+	if err != nil || p == nil {
+		return nil, err
+	}
+	return &track{
+		Player: p.Name(),
+		Artist: p.Artist,
+		Title:  p.Title,
+		Album:  p.Album,
+		Paused: p.Status == mpris.Paused,
+	}, nil
 } // }}}
 
+// playerChanges signals whenever a player changes, so that nowplaying can be
+// updated immediately (instead of on its next interval). If the session bus
+// is lost, it is resubscribed to.
+func playerChanges(ctx context.Context) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+	go func() {
+		for {
+			bus, err := sessionBus()
+			var ch <-chan struct{}
+			if err == nil {
+				ch, err = bus.Subscribe(ctx)
+			}
+			if err != nil {
+				// e.g. started before the session bus; ranging
+				// over the nil ch would block forever
+				die(fmt.Errorf("nowplaying: %w", err))
+			} else {
+				for range ch {
+					select {
+					case changes <- struct{}{}:
+					default:
+					}
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Minute):
+			}
+		}
+	}()
+	return changes
+}
+
+type mailStatus struct {
+	Count  int // unread today
+	Failed bool
+}
+
+func (m mailStatus) urgent() bool { return m.Failed }
+
 // fetching mail is handled by a cronjob
-func mail() string {
+func mail() mailStatus {
 	cmd := exec.Command(
 		"notmuch",
 		strings.Fields("count tag:inbox and tag:unread and date:today")...,
 	)
-	_ = os.WriteFile("/tmp/dwmstatus.log", []byte(strings.Join(os.Environ(), "\n")), os.ModePerm)
 	cmd.Env = os.Environ()
 	out, err := execRawCommand(*cmd)
-	fmt.Println(out)
-	switch {
-	case err != nil:
-		return "mail error"
-	case out == "0":
-		return ""
-	default:
-		return out + " new mail"
+	if err != nil {
+		return mailStatus{Failed: true}
 	}
+	count, _ := strconv.Atoi(out)
+	return mailStatus{Count: count}
+}
+
+type netStatus struct {
+	Name string // empty if not connected
+	KBps int    // received
 }
 
-func network() string {
+func network() netStatus {
 	// name := getCmdOutputWithFallback("iwgetid -r", "No network")
 
 	name, err := execRawCommand(*exec.Command("iwgetid", "-r"))
 	if err != nil {
-		return "No network"
+		return netStatus{}
 	}
 
-	nowBytes := netBytes()
-	diff := nowBytes - lastBytes
-	kbps := diff / int(fastInterval.Seconds()) / 1024
-
-	lastBytes = nowBytes
-
-	return fmt.Sprintf("%s [%d kb/s]", name, kbps)
-}
-
-func fastLoop() []string {
-	return []string{
-		// potentially fallible
-		nowplaying(),
-		// getCmdOutputWithFallback("iwgetid -r", "No network"),
-		network(),
-		// the following cmds should all be infallible
-		sys(),
-		disk(),
-		battery(),
-		_time(),
+	nowBytes, err := netBytes("/sys/class")
+	if err != nil {
+		return netStatus{Name: name}
 	}
-}
-
-// Reserved for making network requests with no action to be taken. Typically,
-// this includes weather, stocks, etc.
-func slowLoop() []string {
-	return []string{
-		weather(),
+	var kbps int
+	// counters are reset when an interface goes down
+	if nowBytes >= lastBytes {
+		// at least 1 s, in case of an immediate update
+		secs := max(time.Since(lastBytesTime).Seconds(), 1)
+		kbps = int(float64(nowBytes-lastBytes) / secs / 1024)
 	}
-}
 
-// Caches are checked slowly (every 10 min) when empty, but quickly (every 5 s)
-// when non-empty, so that we can "clear" the notif
-func (c *Cacher) update() { // https://gobyexample.com/methods
-	if c.value != "" {
-		c.value = c.f()
-	} else if c.count > c.interval {
-		c.value = c.f()
-		c.count = 0
-	} else {
-		c.count += 1
-	}
-	// fmt.Println(cache.count, cache.value)
+	lastBytes = nowBytes
+	lastBytesTime = time.Now()
+
+	return netStatus{Name: name, KBps: kbps}
 }
 
 // Check if an existing dwmstatus instance is running, and, if found, kill it
@@ -475,61 +538,82 @@ func checkRestart() {
 	}
 }
 
-func netBytes() int {
-	b, err := exec.Command("ip", "-j", "-s", "link").Output()
-	if err != nil {
-		panic(err)
-	}
-	var sources []struct {
-		Stats64 struct{ Rx struct{ Bytes int } }
-	}
-	if err := json.Unmarshal(b, &sources); err != nil {
-		panic(err)
+var output = flag.String("output", "xsetroot", "where to show the status bar: xsetroot, stdout, i3bar, swaybar or lemonbar")
+
+// render shows the segments of c.Blocks on out
+func (c *Config) render(out Output, segments []Segment) {
+	for i := range segments {
+		segments[i].Instance = instance(i)
+		segments[i].Color = c.Blocks[i].Color
 	}
-	var sum int
-	for _, x := range sources {
-		sum += x.Stats64.Rx.Bytes
+	if err := out.Render(c.prefix, c.Separator, segments); err != nil {
+		die(err)
 	}
-	return sum
 }
 
 func main() {
 	// checkRestart()
 
-	// https://stackoverflow.com/a/40364927
-	fastTick := time.NewTicker(fastInterval)
-	slowTick := time.NewTicker(slowInterval)
+	flag.Parse()
+	newOutput, ok := outputs[*output]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown output: %s\n", *output)
+		os.Exit(2)
+	}
+	out, err := newOutput(os.Stdout, os.Stdin)
+	if err != nil {
+		die(err)
+		os.Exit(1)
+	}
+	var clicks <-chan Click // nil blocks forever
+	if c, ok := out.(Clicker); ok {
+		clicks = c.Clicks()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	a := fastLoop()
-	b := slowLoop()
+	path := configPath()
+	reload := watchConfig(ctx, path)
+	config, err := loadConfig(path)
+	if err != nil {
+		die(err)
+		config = defaultConfig()
+	}
 
+	// note: mail is fetched immediately after login, but fetching mail
+	// should not be the responsibility of this program
 	for {
-		select {
-
-		case <-fastTick.C:
-			a = fastLoop()
-			// note: mail is fetched immediately after login, but
-			// update can only be called 10 mins after login.
-			// fetching mail should not be the responsibility of
-			// this program
-			MailCache.update()
-
-		case <-slowTick.C:
-			b = slowLoop()
+		blocks, err := config.newBlocks()
+		if err != nil {
+			panic(err) // checked by loadConfig
 		}
-
-		// [slow] + [fast]
-		merged := append(b, a...)
-		merged = append([]string{MailCache.value}, merged...)
-		msg := strings.Join(filter(merged), Separator)
-		msg = MachineName + " > " + msg
-
-		// fmt.Println(msg)
-
-		// TODO: wide chars (e.g. korean) cause date to be truncated
-
-		if err := exec.Command("xsetroot", "-name", msg).Run(); err != nil {
-			die(err)
+		run, cancel := context.WithCancel(ctx)
+		refresh := make(chan int)
+		done := make(chan struct{})
+		c := config
+		go func() {
+			defer close(done)
+			schedule(run, blocks, refresh, func(segments []Segment) { c.render(out, segments) })
+		}()
+		go c.handleClicks(run, clicks, refresh)
+
+		// an invalid config is logged, and the current one kept
+		var next *Config
+		for next == nil {
+			select {
+			case <-ctx.Done():
+				cancel()
+				<-done
+				return
+			case <-reload:
+				if next, err = loadConfig(path); err != nil {
+					die(fmt.Errorf("config not reloaded: %w", err))
+				}
+			}
 		}
+		cancel()
+		<-done
+		config = next
 	}
 }
@@ -0,0 +1,852 @@
+package mpris
+
+// A minimal D-Bus client: just enough of the wire protocol to call methods,
+// and receive signals. See
+// https://dbus.freedesktop.org/doc/dbus-specification.html
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type msgType byte
+
+const (
+	typeMethodCall   msgType = 1
+	typeMethodReturn msgType = 2
+	typeError        msgType = 3
+	typeSignal       msgType = 4
+)
+
+// header field codes
+const (
+	fieldPath        = 1
+	fieldInterface   = 2
+	fieldMember      = 3
+	fieldErrorName   = 4
+	fieldReplySerial = 5
+	fieldDestination = 6
+	fieldSender      = 7
+	fieldSignature   = 8
+)
+
+// messages larger than this are rejected by the spec
+const maxMessageSize = 128 << 20
+
+type message struct {
+	Type        msgType
+	Flags       byte
+	Serial      uint32
+	Path        string
+	Interface   string
+	Member      string
+	ErrorName   string
+	ReplySerial uint32
+	Destination string
+	Sender      string
+	Signature   string
+	Body        []any
+
+	// the body could not be decoded; the message is otherwise valid
+	bodyErr error
+}
+
+// Variant is a value of any type. When decoding, variants are unwrapped to
+// their value.
+type Variant struct {
+	Sig   string
+	Value any
+}
+
+// Error is an error reply to a method call
+type Error struct {
+	Name    string // e.g. org.freedesktop.DBus.Error.ServiceUnknown
+	Message string
+}
+
+func (e *Error) Error() string { return e.Name + ": " + e.Message }
+
+// nextType returns the first complete type of sig
+func nextType(sig string) (string, error) {
+	if sig == "" {
+		return "", errors.New("dbus: empty signature")
+	}
+	switch sig[0] {
+	case 'a':
+		t, err := nextType(sig[1:])
+		return "a" + t, err
+	case '(', '{':
+		depth := 0
+		for i := 0; i < len(sig); i++ {
+			switch sig[i] {
+			case '(', '{':
+				depth++
+			case ')', '}':
+				depth--
+				if depth == 0 {
+					return sig[:i+1], nil
+				}
+			}
+		}
+		return "", fmt.Errorf("dbus: unbalanced signature: %s", sig)
+	}
+	if !strings.ContainsRune("ybnqiuxtdsogvh", rune(sig[0])) {
+		return "", fmt.Errorf("dbus: invalid signature: %s", sig)
+	}
+	return sig[:1], nil
+}
+
+// splitSig splits sig into complete types
+func splitSig(sig string) ([]string, error) {
+	var types []string
+	for sig != "" {
+		t, err := nextType(sig)
+		if err != nil {
+			return nil, err
+		}
+		types = append(types, t)
+		sig = sig[len(t):]
+	}
+	return types, nil
+}
+
+func alignOf(t byte) int {
+	switch t {
+	case 'y', 'g', 'v':
+		return 1
+	case 'n', 'q':
+		return 2
+	case 'x', 't', 'd', '(', '{':
+		return 8
+	default: // b i u h s o a
+		return 4
+	}
+}
+
+// encoder writes little-endian values. Alignment is relative to the start of
+// buf, which must be the start of the message (or of the body, which is
+// 8-aligned).
+type encoder struct{ buf []byte }
+
+func (e *encoder) align(n int) {
+	for len(e.buf)%n != 0 {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+func (e *encoder) encode(t string, v any) error {
+	e.align(alignOf(t[0]))
+	le := binary.LittleEndian
+	mismatch := fmt.Errorf("dbus: cannot encode %T as %s", v, t)
+	switch t[0] {
+	case 'y':
+		b, ok := v.(byte)
+		if !ok {
+			return mismatch
+		}
+		e.buf = append(e.buf, b)
+	case 'b':
+		b, ok := v.(bool)
+		if !ok {
+			return mismatch
+		}
+		var u uint32
+		if b {
+			u = 1
+		}
+		e.buf = le.AppendUint32(e.buf, u)
+	case 'n':
+		n, ok := v.(int16)
+		if !ok {
+			return mismatch
+		}
+		e.buf = le.AppendUint16(e.buf, uint16(n))
+	case 'q':
+		n, ok := v.(uint16)
+		if !ok {
+			return mismatch
+		}
+		e.buf = le.AppendUint16(e.buf, n)
+	case 'i':
+		n, ok := v.(int32)
+		if !ok {
+			return mismatch
+		}
+		e.buf = le.AppendUint32(e.buf, uint32(n))
+	case 'u', 'h':
+		n, ok := v.(uint32)
+		if !ok {
+			return mismatch
+		}
+		e.buf = le.AppendUint32(e.buf, n)
+	case 'x':
+		n, ok := v.(int64)
+		if !ok {
+			return mismatch
+		}
+		e.buf = le.AppendUint64(e.buf, uint64(n))
+	case 't':
+		n, ok := v.(uint64)
+		if !ok {
+			return mismatch
+		}
+		e.buf = le.AppendUint64(e.buf, n)
+	case 'd':
+		f, ok := v.(float64)
+		if !ok {
+			return mismatch
+		}
+		e.buf = le.AppendUint64(e.buf, math.Float64bits(f))
+	case 's', 'o':
+		s, ok := v.(string)
+		if !ok {
+			return mismatch
+		}
+		e.buf = le.AppendUint32(e.buf, uint32(len(s)))
+		e.buf = append(append(e.buf, s...), 0)
+	case 'g':
+		s, ok := v.(string)
+		if !ok || len(s) > 255 {
+			return mismatch
+		}
+		e.buf = append(e.buf, byte(len(s)))
+		e.buf = append(append(e.buf, s...), 0)
+	case 'v':
+		vr, ok := v.(Variant)
+		if !ok {
+			return mismatch
+		}
+		if t, err := nextType(vr.Sig); err != nil || t != vr.Sig {
+			return fmt.Errorf("dbus: invalid variant signature: %s", vr.Sig)
+		}
+		if err := e.encode("g", vr.Sig); err != nil {
+			return err
+		}
+		return e.encode(vr.Sig, vr.Value)
+	case 'a':
+		elem := t[1:]
+		lenPos := len(e.buf)
+		e.buf = append(e.buf, 0, 0, 0, 0)
+		e.align(alignOf(elem[0]))
+		start := len(e.buf)
+		if elem[0] == '{' {
+			// only string keys, which is all that is needed
+			m, ok := v.(map[string]any)
+			kv, err := splitSig(elem[1 : len(elem)-1])
+			if !ok || err != nil || len(kv) != 2 {
+				return mismatch
+			}
+			keys := make([]string, 0, len(m))
+			for k := range m {
+				keys = append(keys, k)
+			}
+			slices.Sort(keys)
+			for _, k := range keys {
+				e.align(8)
+				if err := e.encode(kv[0], k); err != nil {
+					return err
+				}
+				if err := e.encode(kv[1], m[k]); err != nil {
+					return err
+				}
+			}
+		} else {
+			items, ok := v.([]any)
+			if !ok {
+				return mismatch
+			}
+			for _, x := range items {
+				if err := e.encode(elem, x); err != nil {
+					return err
+				}
+			}
+		}
+		le.PutUint32(e.buf[lenPos:], uint32(len(e.buf)-start))
+	case '(':
+		fields, ok := v.([]any)
+		types, err := splitSig(t[1 : len(t)-1])
+		if !ok || err != nil || len(fields) != len(types) {
+			return mismatch
+		}
+		for i, ft := range types {
+			if err := e.encode(ft, fields[i]); err != nil {
+				return err
+			}
+		}
+	default:
+		return mismatch
+	}
+	return nil
+}
+
+type decoder struct {
+	buf   []byte
+	pos   int
+	order binary.ByteOrder
+}
+
+var errShort = errors.New("dbus: message too short")
+
+// sizes of the fixed-size types
+var fixedSize = map[byte]int{'y': 1, 'n': 2, 'q': 2, 'b': 4, 'i': 4, 'u': 4, 'h': 4, 'x': 8, 't': 8, 'd': 8}
+
+func (d *decoder) align(n int) error {
+	for d.pos%n != 0 {
+		d.pos++
+	}
+	if d.pos > len(d.buf) {
+		return errShort
+	}
+	return nil
+}
+
+func (d *decoder) read(n int) ([]byte, error) {
+	if n < 0 || d.pos+n > len(d.buf) {
+		return nil, errShort
+	}
+	b := d.buf[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// decode reads a value of the complete type t. Arrays and structs are []any,
+// dicts are map[string]any (other keys are formatted), and variants are
+// unwrapped.
+func (d *decoder) decode(t string) (any, error) {
+	if err := d.align(alignOf(t[0])); err != nil {
+		return nil, err
+	}
+	if n, ok := fixedSize[t[0]]; ok {
+		b, err := d.read(n)
+		if err != nil {
+			return nil, err
+		}
+		switch t[0] {
+		case 'y':
+			return b[0], nil
+		case 'n':
+			return int16(d.order.Uint16(b)), nil
+		case 'q':
+			return d.order.Uint16(b), nil
+		case 'b':
+			return d.order.Uint32(b) != 0, nil
+		case 'i':
+			return int32(d.order.Uint32(b)), nil
+		case 'u', 'h':
+			return d.order.Uint32(b), nil
+		case 'x':
+			return int64(d.order.Uint64(b)), nil
+		case 't':
+			return d.order.Uint64(b), nil
+		case 'd':
+			return math.Float64frombits(d.order.Uint64(b)), nil
+		}
+	}
+
+	switch t[0] {
+	case 's', 'o':
+		b, err := d.read(4)
+		if err != nil {
+			return nil, err
+		}
+		s, err := d.read(int(d.order.Uint32(b)) + 1)
+		if err != nil {
+			return nil, err
+		}
+		return string(s[:len(s)-1]), nil
+	case 'g':
+		b, err := d.read(1)
+		if err != nil {
+			return nil, err
+		}
+		s, err := d.read(int(b[0]) + 1)
+		if err != nil {
+			return nil, err
+		}
+		return string(s[:len(s)-1]), nil
+	case 'v':
+		sig, err := d.decode("g")
+		if err != nil {
+			return nil, err
+		}
+		vt, err := nextType(sig.(string))
+		if err != nil || vt != sig {
+			return nil, fmt.Errorf("dbus: invalid variant signature: %s", sig)
+		}
+		return d.decode(vt)
+	case 'a':
+		b, err := d.read(4)
+		if err != nil {
+			return nil, err
+		}
+		n := int(d.order.Uint32(b))
+		elem := t[1:]
+		if err := d.align(alignOf(elem[0])); err != nil {
+			return nil, err
+		}
+		end := d.pos + n
+		if n > maxMessageSize || end > len(d.buf) {
+			return nil, errShort
+		}
+
+		if elem[0] == '{' {
+			kv, err := splitSig(elem[1 : len(elem)-1])
+			if err != nil || len(kv) != 2 {
+				return nil, fmt.Errorf("dbus: invalid dict signature: %s", elem)
+			}
+			m := map[string]any{}
+			for d.pos < end {
+				if err := d.align(8); err != nil {
+					return nil, err
+				}
+				k, err := d.decode(kv[0])
+				if err != nil {
+					return nil, err
+				}
+				v, err := d.decode(kv[1])
+				if err != nil {
+					return nil, err
+				}
+				ks, ok := k.(string)
+				if !ok {
+					ks = fmt.Sprint(k)
+				}
+				m[ks] = v
+			}
+			if d.pos != end {
+				return nil, errors.New("dbus: array overflows its length")
+			}
+			return m, nil
+		}
+
+		items := []any{}
+		for d.pos < end {
+			x, err := d.decode(elem)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, x)
+		}
+		if d.pos != end {
+			return nil, errors.New("dbus: array overflows its length")
+		}
+		return items, nil
+	case '(':
+		types, err := splitSig(t[1 : len(t)-1])
+		if err != nil {
+			return nil, err
+		}
+		fields := make([]any, len(types))
+		for i, ft := range types {
+			if fields[i], err = d.decode(ft); err != nil {
+				return nil, err
+			}
+		}
+		return fields, nil
+	}
+	return nil, fmt.Errorf("dbus: cannot decode %s", t)
+}
+
+// marshal encodes m, which must have a serial
+func (m *message) marshal() ([]byte, error) {
+	types, err := splitSig(m.Signature)
+	if err != nil {
+		return nil, err
+	}
+	if len(types) != len(m.Body) {
+		return nil, fmt.Errorf("dbus: signature %q does not match %d args", m.Signature, len(m.Body))
+	}
+	var body encoder
+	for i, t := range types {
+		if err := body.encode(t, m.Body[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	var fields []any
+	add := func(code byte, sig string, v any) {
+		fields = append(fields, []any{code, Variant{sig, v}})
+	}
+	for _, f := range []struct {
+		code byte
+		sig  string
+		v    string
+	}{
+		{fieldPath, "o", m.Path},
+		{fieldInterface, "s", m.Interface},
+		{fieldMember, "s", m.Member},
+		{fieldErrorName, "s", m.ErrorName},
+		{fieldDestination, "s", m.Destination},
+		{fieldSender, "s", m.Sender},
+		{fieldSignature, "g", m.Signature},
+	} {
+		if f.v != "" {
+			add(f.code, f.sig, f.v)
+		}
+	}
+	if m.ReplySerial != 0 {
+		add(fieldReplySerial, "u", m.ReplySerial)
+	}
+
+	e := encoder{buf: []byte{'l', byte(m.Type), m.Flags, 1}}
+	e.buf = binary.LittleEndian.AppendUint32(e.buf, uint32(len(body.buf)))
+	e.buf = binary.LittleEndian.AppendUint32(e.buf, m.Serial)
+	if err := e.encode("a(yv)", fields); err != nil {
+		return nil, err
+	}
+	e.align(8)
+	return append(e.buf, body.buf...), nil
+}
+
+// readMessage reads the next message from r. A body that cannot be decoded
+// is not an error here (see message.bodyErr), as the stream is still intact.
+func readMessage(r io.Reader) (*message, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder
+	switch fixed[0] {
+	case 'l':
+		order = binary.LittleEndian
+	case 'B':
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("dbus: invalid endianness: %q", fixed[0])
+	}
+	bodyLen := int(order.Uint32(fixed[4:]))
+	fieldsLen := int(order.Uint32(fixed[12:]))
+	if bodyLen > maxMessageSize || fieldsLen > maxMessageSize {
+		return nil, errors.New("dbus: message too long")
+	}
+	headerLen := (16 + fieldsLen + 7) &^ 7
+	buf := make([]byte, headerLen+bodyLen)
+	copy(buf, fixed)
+	if _, err := io.ReadFull(r, buf[16:]); err != nil {
+		return nil, err
+	}
+
+	m := &message{
+		Type:   msgType(fixed[1]),
+		Flags:  fixed[2],
+		Serial: order.Uint32(fixed[8:]),
+	}
+	d := &decoder{buf: buf[:16+fieldsLen], pos: 12, order: order}
+	fields, err := d.decode("a(yv)")
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range fields.([]any) {
+		f := f.([]any)
+		code, v := f[0].(byte), f[1]
+		s, _ := v.(string)
+		switch code {
+		case fieldPath:
+			m.Path = s
+		case fieldInterface:
+			m.Interface = s
+		case fieldMember:
+			m.Member = s
+		case fieldErrorName:
+			m.ErrorName = s
+		case fieldReplySerial:
+			m.ReplySerial, _ = v.(uint32)
+		case fieldDestination:
+			m.Destination = s
+		case fieldSender:
+			m.Sender = s
+		case fieldSignature:
+			m.Signature = s
+		}
+	}
+
+	types, err := splitSig(m.Signature)
+	if err != nil {
+		m.bodyErr = err
+		return m, nil
+	}
+	d = &decoder{buf: buf[headerLen:], order: order}
+	for _, t := range types {
+		v, err := d.decode(t)
+		if err != nil {
+			m.Body, m.bodyErr = nil, err
+			break
+		}
+		m.Body = append(m.Body, v)
+	}
+	return m, nil
+}
+
+// Conn is a connection to a message bus
+type Conn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	name string // unique name, e.g. ":1.42"
+
+	wmu sync.Mutex // serialises writes
+
+	mu     sync.Mutex // guards the following
+	serial uint32
+	calls  map[uint32]chan *message
+	subs   map[chan *message]bool
+	err    error // why the connection was closed
+	done   chan struct{}
+
+	// answers method calls; only used by tests, which act as a player
+	onCall func(*message)
+}
+
+var errClosed = errors.New("dbus: connection closed")
+
+const handshakeTimeout = 5 * time.Second
+
+// Dial connects to the bus at addr, e.g. "unix:path=/run/user/1000/bus".
+// Only unix sockets are supported.
+func Dial(addr string) (*Conn, error) {
+	err := fmt.Errorf("dbus: no supported address in %q", addr)
+	for _, a := range strings.Split(addr, ";") {
+		transport, params, _ := strings.Cut(a, ":")
+		if transport != "unix" {
+			continue
+		}
+		kv := map[string]string{}
+		for _, p := range strings.Split(params, ",") {
+			k, v, _ := strings.Cut(p, "=")
+			if v, uerr := url.PathUnescape(v); uerr == nil {
+				kv[k] = v
+			}
+		}
+		var path string
+		if p, ok := kv["path"]; ok {
+			path = p
+		} else if p, ok := kv["abstract"]; ok {
+			path = "@" + p
+		} else {
+			continue
+		}
+
+		var nc net.Conn
+		if nc, err = net.Dial("unix", path); err != nil {
+			continue
+		}
+		var c *Conn
+		if c, err = newConn(nc); err != nil {
+			nc.Close()
+			continue
+		}
+		return c, nil
+	}
+	return nil, err
+}
+
+func newConn(nc net.Conn) (*Conn, error) {
+	c := &Conn{
+		conn:  nc,
+		r:     bufio.NewReader(nc),
+		calls: map[uint32]chan *message{},
+		subs:  map[chan *message]bool{},
+		done:  make(chan struct{}),
+	}
+	// a bus that accepts, but never answers
+	_ = nc.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := c.auth(); err != nil {
+		return nil, err
+	}
+	go c.readLoop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+	body, err := c.call(ctx, busName, busPath, busName, "Hello", "")
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.name, _ = body[0].(string)
+	_ = nc.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// call calls a method, and returns the body of the reply
+func (c *Conn) call(ctx context.Context, dest, path, iface, member, sig string, args ...any) ([]any, error) {
+	m := &message{
+		Type:        typeMethodCall,
+		Destination: dest,
+		Path:        path,
+		Interface:   iface,
+		Member:      member,
+		Signature:   sig,
+		Body:        args,
+	}
+	reply := make(chan *message, 1)
+	if err := c.write(m, reply); err != nil {
+		return nil, err
+	}
+	select {
+	case r := <-reply:
+		if r.Type == typeError {
+			e := &Error{Name: r.ErrorName}
+			if len(r.Body) > 0 {
+				e.Message, _ = r.Body[0].(string)
+			}
+			return nil, e
+		}
+		return r.Body, r.bodyErr
+	case <-ctx.Done():
+		c.forget(m.Serial)
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, c.Err()
+	}
+}
+
+// auth authenticates as the current user (i.e. by the credentials of the
+// socket)
+func (c *Conn) auth() error {
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Getuid())))
+	if _, err := fmt.Fprintf(c.conn, "\x00AUTH EXTERNAL %s\r\n", uid); err != nil {
+		return err
+	}
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "OK ") {
+		return fmt.Errorf("dbus: authentication failed: %s", strings.TrimSpace(line))
+	}
+	_, err = fmt.Fprint(c.conn, "BEGIN\r\n")
+	return err
+}
+
+func (c *Conn) readLoop() {
+	for {
+		m, err := readMessage(c.r)
+		if err != nil {
+			c.close(err)
+			return
+		}
+		switch m.Type {
+		case typeMethodReturn, typeError:
+			c.mu.Lock()
+			ch, ok := c.calls[m.ReplySerial]
+			delete(c.calls, m.ReplySerial)
+			c.mu.Unlock()
+			if ok {
+				ch <- m // buffered
+			}
+		case typeSignal:
+			c.mu.Lock()
+			for ch := range c.subs {
+				select {
+				case ch <- m:
+				default: // slow subscribers miss signals
+				}
+			}
+			c.mu.Unlock()
+		case typeMethodCall:
+			c.mu.Lock()
+			onCall := c.onCall
+			c.mu.Unlock()
+			if onCall != nil {
+				go onCall(m)
+			}
+		}
+	}
+}
+
+func (c *Conn) close(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+	c.conn.Close()
+	for ch := range c.subs {
+		close(ch)
+	}
+	c.subs = nil
+}
+
+// Close closes the connection
+func (c *Conn) Close() error {
+	c.close(errClosed)
+	return nil
+}
+
+// Err returns why the connection was closed, or nil if it is open
+func (c *Conn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// write sends m, with the next serial. If reply is non-nil, the reply to m
+// is sent to it.
+func (c *Conn) write(m *message, reply chan *message) error {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return c.err
+	}
+	c.serial++
+	m.Serial = c.serial
+	if reply != nil {
+		c.calls[m.Serial] = reply
+	}
+	c.mu.Unlock()
+
+	b, err := m.marshal()
+	if err == nil {
+		c.wmu.Lock()
+		_, err = c.conn.Write(b)
+		c.wmu.Unlock()
+	}
+	if err != nil && reply != nil {
+		c.forget(m.Serial)
+	}
+	return err
+}
+
+func (c *Conn) forget(serial uint32) {
+	c.mu.Lock()
+	delete(c.calls, serial)
+	c.mu.Unlock()
+}
+
+// subscribe returns a channel of all signals received (that are matched by
+// the bus), which is closed by unsubscribe, or when the connection is closed.
+func (c *Conn) subscribe() chan *message {
+	ch := make(chan *message, 16)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		close(ch)
+	} else {
+		c.subs[ch] = true
+	}
+	return ch
+}
+
+func (c *Conn) unsubscribe(ch chan *message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.subs[ch] {
+		delete(c.subs, ch)
+		close(ch)
+	}
+}
@@ -0,0 +1,206 @@
+// Package mpris reads and controls media players over D-Bus (MPRIS), like
+// playerctl does, but without shelling out to it. See
+// https://specifications.freedesktop.org/mpris-spec/latest/
+package mpris
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	busName = "org.freedesktop.DBus"
+	busPath = "/org/freedesktop/DBus"
+
+	propsIface = "org.freedesktop.DBus.Properties"
+
+	// players are named e.g. org.mpris.MediaPlayer2.mpv, or
+	// org.mpris.MediaPlayer2.firefox.instance_1_42 for several instances
+	playerPrefix = "org.mpris.MediaPlayer2."
+	playerPath   = "/org/mpris/MediaPlayer2"
+	playerIface  = "org.mpris.MediaPlayer2.Player"
+)
+
+// Playback statuses
+const (
+	Playing = "Playing"
+	Paused  = "Paused"
+	Stopped = "Stopped"
+)
+
+type Player struct {
+	Bus    string // e.g. org.mpris.MediaPlayer2.mpv
+	Status string // Playing, Paused or Stopped
+	Artist string // several artists are joined with ", "
+	Title  string
+	Album  string
+}
+
+// Name is the name of the player, like playerctl's playerName, e.g. "mpv"
+func (p Player) Name() string {
+	name := strings.TrimPrefix(p.Bus, playerPrefix)
+	name, _, _ = strings.Cut(name, ".")
+	return name
+}
+
+// SessionBus connects to the session bus, i.e. $DBUS_SESSION_BUS_ADDRESS, or
+// $XDG_RUNTIME_DIR/bus
+func SessionBus() (*Conn, error) {
+	addr := os.Getenv("DBUS_SESSION_BUS_ADDRESS")
+	if addr == "" {
+		dir := os.Getenv("XDG_RUNTIME_DIR")
+		if dir == "" {
+			return nil, errors.New("dbus: no session bus")
+		}
+		addr = "unix:path=" + filepath.Join(dir, "bus")
+	}
+	return Dial(addr)
+}
+
+// Players returns the bus names of all players, sorted
+func (c *Conn) Players(ctx context.Context) ([]string, error) {
+	body, err := c.call(ctx, busName, busPath, busName, "ListNames", "")
+	if err != nil {
+		return nil, err
+	}
+	names, _ := body[0].([]any)
+	var players []string
+	for _, n := range names {
+		if s, _ := n.(string); strings.HasPrefix(s, playerPrefix) {
+			players = append(players, s)
+		}
+	}
+	slices.Sort(players)
+	return players, nil
+}
+
+// Player reads the status and metadata of the player at bus
+func (c *Conn) Player(ctx context.Context, bus string) (Player, error) {
+	body, err := c.call(ctx, bus, playerPath, propsIface, "GetAll", "s", playerIface)
+	if err != nil {
+		return Player{}, err
+	}
+	props, _ := body[0].(map[string]any)
+	meta, _ := props["Metadata"].(map[string]any)
+	p := Player{Bus: bus}
+	p.Status, _ = props["PlaybackStatus"].(string)
+	p.Title, _ = meta["xesam:title"].(string)
+	p.Album, _ = meta["xesam:album"].(string)
+	artists, _ := meta["xesam:artist"].([]any)
+	var names []string
+	for _, a := range artists {
+		if s, _ := a.(string); s != "" {
+			names = append(names, s)
+		}
+	}
+	p.Artist = strings.Join(names, ", ")
+	return p, nil
+}
+
+// Active returns the first player that is playing, or else the first that is
+// paused; nil if there is none.
+func (c *Conn) Active(ctx context.Context) (*Player, error) {
+	buses, err := c.Players(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var paused *Player
+	for _, bus := range buses {
+		p, err := c.Player(ctx, bus)
+		var derr *Error
+		if errors.As(err, &derr) {
+			// the player quit, or does not implement the interface
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		switch {
+		case p.Status == Playing:
+			return &p, nil
+		case p.Status == Paused && paused == nil:
+			paused = &p
+		}
+	}
+	return paused, nil
+}
+
+// PlayPause toggles playback of the player at bus
+func (c *Conn) PlayPause(ctx context.Context, bus string) error {
+	_, err := c.call(ctx, bus, playerPath, playerIface, "PlayPause", "")
+	return err
+}
+
+// match rules for Subscribe
+var matchRules = []string{
+	"type='signal',interface='" + propsIface + "',member='PropertiesChanged',path='" + playerPath + "',arg0='" + playerIface + "'",
+	// players starting and quitting
+	"type='signal',sender='" + busName + "',interface='" + busName + "',member='NameOwnerChanged',arg0namespace='org.mpris.MediaPlayer2'",
+}
+
+// Subscribe signals whenever a player changes (e.g. on track change, or when
+// playback is paused), starts, or quits. Changes in quick succession may be
+// signalled once. The channel is closed when ctx is done, or when the
+// connection is closed.
+func (c *Conn) Subscribe(ctx context.Context) (<-chan struct{}, error) {
+	for _, rule := range matchRules {
+		if _, err := c.call(ctx, busName, busPath, busName, "AddMatch", "s", rule); err != nil {
+			return nil, err
+		}
+	}
+
+	signals := c.subscribe()
+	changes := make(chan struct{}, 1)
+	go func() {
+		defer close(changes)
+		defer c.unsubscribe(signals)
+		defer func() {
+			if c.Err() != nil {
+				return
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			for _, rule := range matchRules {
+				_, _ = c.call(ctx, busName, busPath, busName, "RemoveMatch", "s", rule)
+			}
+		}()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case m, ok := <-signals:
+				if !ok {
+					return
+				}
+				if !isPlayerChange(m) {
+					continue
+				}
+				select {
+				case changes <- struct{}{}:
+				default: // already pending
+				}
+			}
+		}
+	}()
+	return changes, nil
+}
+
+// isPlayerChange reports whether m is one of the signals of matchRules. Other
+// subscribers of the connection may have added other rules.
+func isPlayerChange(m *message) bool {
+	if len(m.Body) == 0 {
+		return false
+	}
+	arg0, _ := m.Body[0].(string)
+	switch {
+	case m.Interface == propsIface && m.Member == "PropertiesChanged":
+		return m.Path == playerPath && arg0 == playerIface
+	case m.Interface == busName && m.Member == "NameOwnerChanged":
+		return strings.HasPrefix(arg0, playerPrefix)
+	}
+	return false
+}
@@ -0,0 +1,352 @@
+package mpris
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMarshal(t *testing.T) {
+	m := &message{
+		Type:      typeSignal,
+		Serial:    7,
+		Path:      "/a/b",
+		Interface: "c.d",
+		Member:    "E",
+		Signature: "ybnqiuxtdsogva{sv}a(ys)asa{sa{sv}}",
+		Body: []any{
+			byte(1), true, int16(-2), uint16(3), int32(-4), uint32(5), int64(-6), uint64(7), 8.5,
+			"ß", "/o", "a{sv}",
+			Variant{"as", []any{"x", "y"}},
+			map[string]any{"k": Variant{"x", int64(9)}, "l": Variant{"s", ""}},
+			[]any{[]any{byte(1), "one"}, []any{byte(2), "two"}},
+			[]any{},
+			map[string]any{"m": map[string]any{"n": Variant{"b", false}}},
+		},
+	}
+	b, err := m.marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := readMessage(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.bodyErr != nil {
+		t.Fatal(got.bodyErr)
+	}
+	want := *m
+	// variants are unwrapped
+	want.Body = []any{
+		byte(1), true, int16(-2), uint16(3), int32(-4), uint32(5), int64(-6), uint64(7), 8.5,
+		"ß", "/o", "a{sv}",
+		[]any{"x", "y"},
+		map[string]any{"k": int64(9), "l": ""},
+		[]any{[]any{byte(1), "one"}, []any{byte(2), "two"}},
+		[]any{},
+		map[string]any{"m": map[string]any{"n": false}},
+	}
+	if !reflect.DeepEqual(*got, want) {
+		t.Errorf("got %+v\nwant %+v", *got, want)
+	}
+
+	// too short
+	if _, err := readMessage(bytes.NewReader(b[:len(b)-1])); err == nil {
+		t.Error("expected error")
+	}
+
+	// mismatched args
+	m.Signature = "s"
+	if _, err := m.marshal(); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestSplitSig(t *testing.T) {
+	got, err := splitSig("sa{sv}(ia(ss))aai")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"s", "a{sv}", "(ia(ss))", "aai"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	for _, sig := range []string{"a", "(ss", "z"} {
+		if _, err := splitSig(sig); err == nil {
+			t.Errorf("%s: expected error", sig)
+		}
+	}
+}
+
+const busConfig = `<!DOCTYPE busconfig PUBLIC "-//freedesktop//DTD D-Bus Bus Configuration 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/busconfig.dtd">
+<busconfig>
+  <type>session</type>
+  <listen>unix:path=%s</listen>
+  <auth>EXTERNAL</auth>
+  <policy context="default">
+    <allow send_destination="*" eavesdrop="true"/>
+    <allow eavesdrop="true"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>
+`
+
+// startBus starts a private dbus-daemon, and returns its address. The test
+// is skipped if there is no dbus-daemon.
+func startBus(t *testing.T) string {
+	bin, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon not found")
+	}
+	dir := t.TempDir()
+	config := filepath.Join(dir, "bus.conf")
+	if err := os.WriteFile(config, []byte(fmt.Sprintf(busConfig, filepath.Join(dir, "bus"))), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(bin, "--config-file="+config, "--nofork", "--print-address=1")
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	addr, err := bufio.NewReader(out).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(addr)
+}
+
+// fakePlayer is a player on the bus, which answers GetAll and PlayPause
+type fakePlayer struct {
+	conn *Conn
+	bus  string
+
+	mu     sync.Mutex
+	status string
+	title  string
+}
+
+func newFakePlayer(t *testing.T, addr, name, status string) *fakePlayer {
+	c, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	p := &fakePlayer{conn: c, bus: playerPrefix + name, status: status, title: "Loveless"}
+	c.mu.Lock()
+	c.onCall = p.answer
+	c.mu.Unlock()
+
+	// 0: no flags; replies 1 if we are the primary owner
+	body, err := c.call(context.Background(), busName, busPath, busName, "RequestName", "su", p.bus, uint32(0))
+	if err != nil || body[0] != uint32(1) {
+		t.Fatalf("RequestName: %v %v", body, err)
+	}
+	return p
+}
+
+func (p *fakePlayer) reply(call *message, sig string, args ...any) {
+	_ = p.conn.write(&message{
+		Type:        typeMethodReturn,
+		ReplySerial: call.Serial,
+		Destination: call.Sender,
+		Signature:   sig,
+		Body:        args,
+	}, nil)
+}
+
+func (p *fakePlayer) answer(call *message) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case call.Interface == propsIface && call.Member == "GetAll":
+		p.reply(call, "a{sv}", map[string]any{
+			"PlaybackStatus": Variant{"s", p.status},
+			"Metadata": Variant{"a{sv}", map[string]any{
+				"mpris:trackid": Variant{"o", "/track/1"},
+				"mpris:length":  Variant{"x", int64(4 * time.Minute / time.Microsecond)},
+				"xesam:artist":  Variant{"as", []any{"My Bloody Valentine", "Kevin Shields"}},
+				"xesam:album":   Variant{"s", "Loveless"},
+				"xesam:title":   Variant{"s", p.title},
+			}},
+			"Volume": Variant{"d", 1.0},
+		})
+	case call.Interface == playerIface && call.Member == "PlayPause":
+		if p.status == Playing {
+			p.status = Paused
+		} else {
+			p.status = Playing
+		}
+		p.reply(call, "")
+		_ = p.conn.write(&message{
+			Type:      typeSignal,
+			Path:      playerPath,
+			Interface: propsIface,
+			Member:    "PropertiesChanged",
+			Signature: "sa{sv}as",
+			Body: []any{
+				playerIface,
+				map[string]any{"PlaybackStatus": Variant{"s", p.status}},
+				[]any{},
+			},
+		}, nil)
+	default:
+		_ = p.conn.write(&message{
+			Type:        typeError,
+			ReplySerial: call.Serial,
+			Destination: call.Sender,
+			ErrorName:   "org.freedesktop.DBus.Error.UnknownMethod",
+			Signature:   "s",
+			Body:        []any{"unknown method " + call.Member},
+		}, nil)
+	}
+}
+
+func TestPlayers(t *testing.T) {
+	ctx := context.Background()
+	addr := startBus(t)
+	c, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if p, err := c.Active(ctx); p != nil || err != nil {
+		t.Errorf("no players: got %v %v", p, err)
+	}
+
+	mpv := newFakePlayer(t, addr, "mpv", Playing)
+	firefox := newFakePlayer(t, addr, "firefox.instance_1_42", Paused)
+
+	players, err := c.Players(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{firefox.bus, mpv.bus}; !reflect.DeepEqual(players, want) {
+		t.Errorf("got %q, want %q", players, want)
+	}
+
+	p, err := c.Player(ctx, firefox.bus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Player{
+		Bus:    firefox.bus,
+		Status: Paused,
+		Artist: "My Bloody Valentine, Kevin Shields",
+		Title:  "Loveless",
+		Album:  "Loveless",
+	}
+	if p != want {
+		t.Errorf("got %+v, want %+v", p, want)
+	}
+	if p.Name() != "firefox" {
+		t.Errorf("got %s, want firefox", p.Name())
+	}
+
+	// playing before paused
+	if p, err := c.Active(ctx); err != nil || p == nil || p.Name() != "mpv" {
+		t.Errorf("got %v %v, want mpv", p, err)
+	}
+
+	if _, err := c.Player(ctx, playerPrefix+"missing"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	addr := startBus(t)
+	c, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	changes, err := c.Subscribe(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wait := func(what string) {
+		t.Helper()
+		select {
+		case <-changes:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: no change", what)
+		}
+	}
+
+	mpv := newFakePlayer(t, addr, "mpv", Playing)
+	wait("start")
+
+	if err := c.PlayPause(ctx, mpv.bus); err != nil {
+		t.Fatal(err)
+	}
+	wait("pause")
+	if p, err := c.Player(ctx, mpv.bus); err != nil || p.Status != Paused {
+		t.Errorf("got %v %v, want paused", p, err)
+	}
+
+	mpv.conn.Close()
+	wait("quit")
+	if p, err := c.Active(ctx); p != nil || err != nil {
+		t.Errorf("got %v %v, want none", p, err)
+	}
+
+	cancel()
+	select {
+	case _, ok := <-changes:
+		if ok {
+			// a pending change may be delivered first
+			_, ok = <-changes
+		}
+		if ok {
+			t.Error("not closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("not closed")
+	}
+}
+
+func TestDial(t *testing.T) {
+	for _, addr := range []string{
+		"",
+		"tcp:host=localhost,port=1",
+		"unix:tmpdir=/tmp",
+		"unix:path=" + filepath.Join(t.TempDir(), "missing"),
+	} {
+		if _, err := Dial(addr); err == nil {
+			t.Errorf("%q: expected error", addr)
+		}
+	}
+
+	// the first usable address is used
+	addr := startBus(t)
+	c, err := Dial("tcp:host=localhost,port=1;" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(c.name, ":") {
+		t.Errorf("got unique name %q", c.name)
+	}
+	c.Close()
+	if _, err := c.Players(context.Background()); err == nil {
+		t.Error("expected error after close")
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Segment is the value of a block, as shown by an Output
+type Segment struct {
+	Name     string // of the block
+	Instance string // index of the block, as a block may be shown twice
+	Text     string // empty if hidden
+	Color    string // e.g. "#ff0000"; empty for the default
+	Urgent   bool
+}
+
+// An Output shows the status bar
+type Output interface {
+	// Render shows the segments of all blocks, in order. The prefix and
+	// separator are only used by outputs that show a single string.
+	Render(prefix, separator string, segments []Segment) error
+}
+
+// A Clicker is an output that reports clicks on blocks
+type Clicker interface {
+	Clicks() <-chan Click
+}
+
+type Click struct {
+	Name     string
+	Instance string
+	Button   int // 1: left, 2: middle, 3: right, 4/5: scroll
+}
+
+// outputs, by the name given to -output
+var outputs = map[string]func(w io.Writer, r io.Reader) (Output, error){
+	"xsetroot": func(io.Writer, io.Reader) (Output, error) { return xsetroot{}, nil },
+	"stdout":   func(w io.Writer, _ io.Reader) (Output, error) { return lines{w}, nil },
+	"i3bar":    newI3bar,
+	"swaybar":  newI3bar, // same protocol
+	"lemonbar": func(w io.Writer, _ io.Reader) (Output, error) { return lemonbar{w}, nil },
+}
+
+// line joins the visible segments into a single line
+func line(prefix, separator string, segments []Segment) string {
+	texts := make([]string, len(segments))
+	for i, s := range segments {
+		texts[i] = s.Text
+	}
+	return prefix + strings.Join(filter(texts), separator)
+}
+
+// xsetroot sets the name of the X root window, which dwm shows
+type xsetroot struct{}
+
+func (xsetroot) Render(prefix, separator string, segments []Segment) error {
+	// TODO: wide chars (e.g. korean) cause date to be truncated
+	return exec.Command("xsetroot", "-name", line(prefix, separator, segments)).Run()
+}
+
+// lines writes one line per update, e.g. for tmux
+type lines struct{ w io.Writer }
+
+func (o lines) Render(prefix, separator string, segments []Segment) error {
+	_, err := fmt.Fprintln(o.w, line(prefix, separator, segments))
+	return err
+}
+
+// lemonbar writes lines in lemonbar's format, with the blocks on the right.
+// Urgent blocks are reversed.
+type lemonbar struct{ w io.Writer }
+
+func (o lemonbar) Render(prefix, separator string, segments []Segment) error {
+	// % starts a formatting block
+	escape := strings.NewReplacer("%", "%%").Replace
+	var parts []string
+	for _, s := range segments {
+		if s.Text == "" {
+			continue
+		}
+		text := escape(s.Text)
+		if s.Color != "" {
+			text = "%{F" + s.Color + "}" + text + "%{F-}"
+		}
+		if s.Urgent {
+			text = "%{R}" + text + "%{R}"
+		}
+		parts = append(parts, text)
+	}
+	_, err := fmt.Fprintf(o.w, "%%{l}%s%%{r}%s\n", escape(prefix), strings.Join(parts, escape(separator)))
+	return err
+}
+
+// i3bar speaks the i3bar protocol (also used by swaybar), i.e. a header, then
+// an endless JSON array of status lines. Clicks are read from r, in the same
+// way. See https://i3wm.org/docs/i3bar-protocol.html
+type i3bar struct {
+	w      io.Writer
+	clicks chan Click
+	first  bool
+}
+
+type i3block struct {
+	FullText string `json:"full_text"`
+	Name     string `json:"name,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Color    string `json:"color,omitempty"`
+	Urgent   bool   `json:"urgent,omitempty"`
+}
+
+func newI3bar(w io.Writer, r io.Reader) (Output, error) {
+	o := &i3bar{w: w, clicks: make(chan Click), first: true}
+	header := struct {
+		Version     int  `json:"version"`
+		ClickEvents bool `json:"click_events"`
+	}{1, true}
+	b, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(w, "%s\n[\n", b); err != nil {
+		return nil, err
+	}
+	go o.readClicks(r)
+	return o, nil
+}
+
+func (o *i3bar) Render(prefix, _ string, segments []Segment) error {
+	blocks := []i3block{}
+	if prefix = strings.TrimSpace(prefix); prefix != "" {
+		blocks = append(blocks, i3block{FullText: prefix, Name: "prefix"})
+	}
+	for _, s := range segments {
+		if s.Text == "" {
+			continue
+		}
+		blocks = append(blocks, i3block{
+			FullText: s.Text,
+			Name:     s.Name,
+			Instance: s.Instance,
+			Color:    s.Color,
+			Urgent:   s.Urgent,
+		})
+	}
+	if !o.first {
+		if _, err := io.WriteString(o.w, ","); err != nil {
+			return err
+		}
+	}
+	o.first = false
+	enc := json.NewEncoder(o.w) // one line
+	enc.SetEscapeHTML(false)
+	return enc.Encode(blocks)
+}
+
+func (o *i3bar) Clicks() <-chan Click { return o.clicks }
+
+// readClicks reads click events until r is closed (or invalid), i.e.
+//
+//	[
+//	{"name":"sys","instance":"4","button":1,...}
+//	,{"name":"time","instance":"7","button":3,...}
+func (o *i3bar) readClicks(r io.Reader) {
+	dec := json.NewDecoder(r)
+	if _, err := dec.Token(); err != nil { // [
+		return
+	}
+	for dec.More() {
+		var c Click
+		err := dec.Decode(&c)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return
+		} else if err != nil {
+			die(fmt.Errorf("i3bar: %w", err))
+			return
+		}
+		o.clicks <- c
+	}
+}
+
+// instance identifies the block at index i of the config
+func instance(i int) string { return strconv.Itoa(i) }
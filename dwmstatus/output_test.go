@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSegments = []Segment{
+	{Name: "mail", Instance: "0"},
+	{Name: "sys", Instance: "1", Text: "99.0%, 6.8G, 85°C", Urgent: true},
+	{Name: "time", Instance: "2", Text: "Mon 26/08 13:44", Color: "#00ff00"},
+}
+
+func TestLines(t *testing.T) {
+	var sb strings.Builder
+	if err := (lines{&sb}).Render("pc > ", " | ", testSegments); err != nil {
+		t.Fatal(err)
+	}
+	if want := "pc > 99.0%, 6.8G, 85°C | Mon 26/08 13:44\n"; sb.String() != want {
+		t.Errorf("got %q, want %q", sb.String(), want)
+	}
+}
+
+func TestLemonbar(t *testing.T) {
+	var sb strings.Builder
+	if err := (lemonbar{&sb}).Render("pc > ", " | ", testSegments); err != nil {
+		t.Fatal(err)
+	}
+	want := "%{l}pc > %{r}%{R}99.0%%, 6.8G, 85°C%{R} | %{F#00ff00}Mon 26/08 13:44%{F-}\n"
+	if sb.String() != want {
+		t.Errorf("got %q, want %q", sb.String(), want)
+	}
+}
+
+func TestI3bar(t *testing.T) {
+	var sb strings.Builder
+	r, w := io.Pipe()
+	defer w.Close()
+	out, err := newI3bar(&sb, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if err := out.Render("pc > ", " | ", testSegments); err != nil {
+			t.Fatal(err)
+		}
+	}
+	line := `[{"full_text":"pc >","name":"prefix"},` +
+		`{"full_text":"99.0%, 6.8G, 85°C","name":"sys","instance":"1","urgent":true},` +
+		`{"full_text":"Mon 26/08 13:44","name":"time","instance":"2","color":"#00ff00"}]`
+	want := "{\"version\":1,\"click_events\":true}\n[\n" + line + "\n," + line + "\n"
+	if sb.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", sb.String(), want)
+	}
+
+	go func() {
+		_, _ = io.WriteString(w, "[\n"+
+			`{"name":"time","instance":"2","button":1,"x":1800,"y":10}`+"\n"+
+			`,{"name":"sys","instance":"1","button":3,"modifiers":["Shift"]}`+"\n")
+	}()
+	clicks := out.(Clicker).Clicks()
+	for _, want := range []Click{{"time", "2", 1}, {"sys", "1", 3}} {
+		select {
+		case got := <-clicks:
+			if got != want {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no click: %+v", want)
+		}
+	}
+}
+
+func TestClick(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	c := defaultConfig()
+	c.Blocks = []BlockConfig{
+		{Name: "time", OnClick: "echo $BUTTON > " + filepath.Join(dir, "clicked")},
+		{Name: "disk"},
+	}
+
+	i, err := c.click(ctx, Click{Name: "time", Instance: instance(0), Button: 3})
+	if i != 0 || err != nil {
+		t.Fatalf("got %d %v", i, err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "clicked"))
+	if err != nil || string(b) != "3\n" {
+		t.Errorf("got %q %v", b, err)
+	}
+
+	// no action
+	if i, err := c.click(ctx, Click{Name: "disk", Instance: instance(1), Button: 1}); i != 1 || err != nil {
+		t.Errorf("got %d %v", i, err)
+	}
+
+	// e.g. clicked before a reload
+	for _, cl := range []Click{
+		{Name: "disk", Instance: instance(0)},
+		{Name: "time", Instance: instance(2)},
+		{Name: "prefix"},
+	} {
+		if i, _ := c.click(ctx, cl); i != -1 {
+			t.Errorf("%+v: got %d, want -1", cl, i)
+		}
+	}
+}
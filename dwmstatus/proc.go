@@ -0,0 +1,242 @@
+package main
+
+// Native replacements for top, free, sensors, df and ip. Readers take the path of
+// the file (or dir) they read, so that they can be tested against fixtures
+// (see testdata).
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// cpuTimes are the total and idle jiffies of all cpus, since boot
+type cpuTimes struct {
+	Total uint64
+	Idle  uint64 // including iowait
+}
+
+// readCPU reads the summary line of /proc/stat, i.e.
+//
+//	cpu  user nice system idle iowait irq softirq steal guest guest_nice
+func readCPU(path string) (cpuTimes, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return cpuTimes{}, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 5 || fields[0] != "cpu" {
+			continue
+		}
+		var t cpuTimes
+		// guest time is already included in user time
+		for i, s := range fields[1:min(len(fields), 9)] {
+			n, err := strconv.ParseUint(s, 10, 64)
+			if err != nil {
+				return cpuTimes{}, err
+			}
+			t.Total += n
+			if i == 3 || i == 4 {
+				t.Idle += n
+			}
+		}
+		return t, nil
+	}
+	if err := sc.Err(); err != nil {
+		return cpuTimes{}, err
+	}
+	return cpuTimes{}, fmt.Errorf("%s: no cpu line", path)
+}
+
+// cpuUsage returns the usage (%) between two samples
+func cpuUsage(prev, cur cpuTimes) float64 {
+	total := cur.Total - prev.Total
+	if total == 0 || cur.Total < prev.Total {
+		return 0
+	}
+	return 100 * float64(total-(cur.Idle-prev.Idle)) / float64(total)
+}
+
+type memInfo struct {
+	Total     uint64 // bytes
+	Available uint64
+}
+
+func (m memInfo) Used() uint64 { return m.Total - m.Available }
+
+// readMeminfo reads /proc/meminfo. Like free, memory that is not available
+// (i.e. cannot be reclaimed without swapping) is used.
+func readMeminfo(path string) (memInfo, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return memInfo{}, err
+	}
+	var m memInfo
+	var found int
+	for _, line := range strings.Split(string(b), "\n") {
+		// MemTotal:       16318136 kB
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		var dst *uint64
+		switch fields[0] {
+		case "MemTotal:":
+			dst = &m.Total
+		case "MemAvailable:":
+			dst = &m.Available
+		default:
+			continue
+		}
+		n, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return memInfo{}, err
+		}
+		*dst = n * 1024
+		found++
+	}
+	if found < 2 || m.Available > m.Total {
+		return memInfo{}, fmt.Errorf("%s: no MemTotal or MemAvailable", path)
+	}
+	return m, nil
+}
+
+// maxTemp returns the highest temperature (°C) reported under root (i.e.
+// /sys/class), by both hwmon sensors and thermal zones.
+func maxTemp(root string) (float64, error) {
+	hwmon, _ := filepath.Glob(filepath.Join(root, "hwmon", "hwmon*", "temp*_input"))
+	thermal, _ := filepath.Glob(filepath.Join(root, "thermal", "thermal_zone*", "temp"))
+	paths := append(hwmon, thermal...)
+	if len(paths) == 0 {
+		return 0, errors.New("no temperature sensors")
+	}
+
+	var hottest float64
+	var read bool
+	for _, p := range paths {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			// some sensors cannot be read (e.g. while suspended)
+			continue
+		}
+		mc, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		if err != nil {
+			continue
+		}
+		hottest = max(hottest, float64(mc)/1000) // millidegrees
+		read = true
+	}
+	if !read {
+		return 0, errors.New("no readable temperature sensors")
+	}
+	return hottest, nil
+}
+
+// readMounts returns the mountpoints of the block devices in /proc/mounts,
+// with "/" first. Devices mounted more than once (e.g. bind mounts) are only
+// returned once.
+func readMounts(path string) ([]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var root string
+	var mounts []string
+	seen := map[string]bool{}
+	for _, line := range strings.Split(string(b), "\n") {
+		// /dev/sda2 / ext4 rw,relatime 0 0
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		dev, mnt := fields[0], unescapeMount(fields[1])
+		if !strings.HasPrefix(dev, "/dev/") || strings.HasPrefix(dev, "/dev/loop") || seen[dev] {
+			continue
+		}
+		seen[dev] = true
+		if mnt == "/" {
+			root = mnt
+		} else {
+			mounts = append(mounts, mnt)
+		}
+	}
+	if root != "" {
+		mounts = append([]string{root}, mounts...)
+	}
+	return mounts, nil
+}
+
+// spaces etc in mountpoints are octal-escaped, e.g. "/mnt/my\040disk"
+func unescapeMount(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				sb.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+// freeSpace returns the space available to unprivileged users, in bytes
+func freeSpace(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
+
+// humanBytes formats n like df and free do, e.g. "6.8G", "120G". unit is 1024
+// (df -h) or 1000 (free --si).
+func humanBytes(n uint64, unit float64) string {
+	v := float64(n)
+	suffixes := []string{"B", "K", "M", "G", "T", "P"}
+	i := 0
+	for v >= unit && i < len(suffixes)-1 {
+		v /= unit
+		i++
+	}
+	if v < 10 && i > 0 {
+		return strconv.FormatFloat(v, 'f', 1, 64) + suffixes[i]
+	}
+	return strconv.FormatFloat(v, 'f', 0, 64) + suffixes[i]
+}
+
+// netBytes returns the bytes received by all interfaces under root (i.e.
+// /sys/class), like the rx bytes of `ip -s link`.
+func netBytes(root string) (uint64, error) {
+	paths, _ := filepath.Glob(filepath.Join(root, "net", "*", "statistics", "rx_bytes"))
+	if len(paths) == 0 {
+		return 0, errors.New("no network interfaces")
+	}
+	var sum uint64
+	for _, p := range paths {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return 0, err
+		}
+		n, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", p, err)
+		}
+		sum += n
+	}
+	return sum, nil
+}
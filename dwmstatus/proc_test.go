@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestReadCPU(t *testing.T) {
+	got, err := readCPU("testdata/proc/stat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (cpuTimes{Total: 60377929, Idle: 46845166}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	if _, err := readCPU("testdata/proc/meminfo"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestCPUUsage(t *testing.T) {
+	for _, tc := range []struct {
+		prev, cur cpuTimes
+		want      float64
+	}{
+		{cpuTimes{1000, 800}, cpuTimes{1200, 950}, 25},
+		{cpuTimes{1000, 800}, cpuTimes{1000, 800}, 0},
+		{cpuTimes{1000, 800}, cpuTimes{1100, 800}, 100},
+		{cpuTimes{}, cpuTimes{1000, 750}, 25}, // first sample: since boot
+	} {
+		if got := cpuUsage(tc.prev, tc.cur); got != tc.want {
+			t.Errorf("cpuUsage(%+v, %+v) = %v, want %v", tc.prev, tc.cur, got, tc.want)
+		}
+	}
+}
+
+func TestReadMeminfo(t *testing.T) {
+	got, err := readMeminfo("testdata/proc/meminfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := uint64(6797561856); got.Used() != want {
+		t.Errorf("used: got %d, want %d", got.Used(), want)
+	}
+	if s := humanBytes(got.Used(), 1000); s != "6.8G" {
+		t.Errorf("got %s, want 6.8G", s)
+	}
+
+	if _, err := readMeminfo("testdata/proc/stat"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestMaxTemp(t *testing.T) {
+	// unreadable sensors are skipped
+	got, err := maxTemp("testdata/sys/class")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 72 {
+		t.Errorf("got %v, want 72", got)
+	}
+
+	if _, err := maxTemp(t.TempDir()); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestReadMounts(t *testing.T) {
+	got, err := readMounts("testdata/proc/mounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/", "/home", "/boot", "/mnt/my disk"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestFreeSpace(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := freeSpace(dir); err != nil {
+		t.Error(err)
+	}
+	if _, err := freeSpace(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("got %v, want not exist", err)
+	}
+}
+
+func TestHumanBytes(t *testing.T) {
+	for _, tc := range []struct {
+		n    uint64
+		unit float64
+		want string
+	}{
+		{0, 1024, "0B"},
+		{512, 1024, "512B"},
+		{1536, 1024, "1.5K"},
+		{120 << 30, 1024, "120G"},
+		{6_800_000_000, 1000, "6.8G"},
+		{2 << 50, 1024, "2.0P"},
+	} {
+		if got := humanBytes(tc.n, tc.unit); got != tc.want {
+			t.Errorf("humanBytes(%d, %v) = %s, want %s", tc.n, tc.unit, got, tc.want)
+		}
+	}
+}
+
+func TestNetBytes(t *testing.T) {
+	got, err := netBytes("testdata/sys/class")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 124456 {
+		t.Errorf("got %d, want 124456", got)
+	}
+
+	if _, err := netBytes(t.TempDir()); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -1,3 +1,8 @@
 module server
 
 go 1.23.3
+
+require dwmstatus v0.0.0
+
+// shares the MPRIS client of dwmstatus
+replace dwmstatus => ../dwmstatus
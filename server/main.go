@@ -5,8 +5,9 @@ import (
 	"log"
 	"net"
 	"net/http"
-	"os/exec"
 	"strings"
+
+	"dwmstatus/mpris"
 )
 
 const PORT = 3838
@@ -23,6 +24,21 @@ func init() {
 	conn.Close()
 }
 
+// activePlayer returns the player that is playing (or paused); nil if there is
+// none. The connection must be closed by the caller.
+func activePlayer(r *http.Request) (*mpris.Conn, *mpris.Player, error) {
+	bus, err := mpris.SessionBus()
+	if err != nil {
+		return nil, nil, err
+	}
+	p, err := bus.Active(r.Context())
+	if err != nil {
+		bus.Close()
+		return nil, nil, err
+	}
+	return bus, p, nil
+}
+
 func main() {
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path != "/" {
@@ -30,18 +46,34 @@ func main() {
 			return
 		}
 
-		b, _ := exec.Command("playerctl", "status").Output()
+		bus, p, err := activePlayer(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer bus.Close()
+		if p == nil {
+			return
+		}
 
-		switch strings.TrimSpace(string(b)) {
-		case "Playing":
+		switch p.Status {
+		case mpris.Playing:
 			fmt.Fprintln(w, `<a href="/toggle">Pause</a>`)
-		case "Paused":
+		case mpris.Paused:
 			fmt.Fprintln(w, `<a href="/toggle">Play</a>`)
 		}
 	})
 
 	http.HandleFunc("/toggle", func(w http.ResponseWriter, r *http.Request) {
-		_ = exec.Command("playerctl", "play-pause").Run()
+		bus, p, err := activePlayer(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer bus.Close()
+		if p != nil {
+			_ = bus.PlayPause(r.Context(), p.Bus)
+		}
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 	})
 